@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/bitsbeats/dronetrigger/config"
+	"github.com/bitsbeats/dronetrigger/core"
 	"github.com/bitsbeats/dronetrigger/drone"
+	"github.com/bitsbeats/dronetrigger/logging"
+	"github.com/bitsbeats/dronetrigger/metrics"
+	"github.com/bitsbeats/dronetrigger/store"
 	"github.com/bitsbeats/dronetrigger/web"
 )
 
@@ -16,6 +27,7 @@ func main() {
 	log.SetFlags(0)
 	log.SetOutput(os.Stdout)
 	configFile := flag.String("config", "/etc/dronetrigger.yml", "Configuration file.")
+	watch := flag.Duration("watch", 0, "Interval to check the configuration file for changes, 0 reloads only on SIGHUP.")
 	flag.Parse()
 
 	// load and validate config
@@ -23,28 +35,239 @@ func main() {
 	if err != nil {
 		log.Fatalf("unable to load config: %s", err)
 	}
-	if c.Web == nil {
-		log.Fatalf("no configuration for web found")
+	err = logging.Setup(c.Log, os.Stdout)
+	if err != nil {
+		log.Fatalf("unable to setup logging: %s", err)
 	}
-	for repo, token := range c.Web.BearerToken {
-		if len(token) < 8 {
-			log.Fatalf("configured bearer token for %q is to short", repo)
-		}
+	err = validate(c)
+	if err != nil {
+		fatal("invalid config", "error", err)
 	}
 
 	// setup drone
 	d := drone.New(c.Url, c.Token)
 
+	// setup token store
+	tokens, err := store.NewTokenStore(c.Web.TokenStore)
+	if err != nil {
+		fatal("unable to setup token store", "error", err)
+	}
+
 	// configure webserver
 	w := web.NewWeb(c.Web, d)
+	w.Tokens = tokens
+	if c.Web.DroneWebhook != nil {
+		w.Builds, err = store.NewBuildStore(c.Web.DroneWebhook.BuildStore)
+		if err != nil {
+			fatal("unable to setup build store", "error", err)
+		}
+	}
+	if len(c.Web.Promotions) > 0 && c.Web.DroneWebhook == nil {
+		slog.Warn("promotions require drone_webhook to observe builds")
+	}
+	if c.Web.Chains != nil {
+		if c.Web.DroneWebhook == nil {
+			slog.Warn("chains require drone_webhook to observe builds")
+		}
+		w.Chains, err = store.NewChainStore(c.Web.Chains.RunStore)
+		if err != nil {
+			fatal("unable to setup chain store", "error", err)
+		}
+	}
+	if c.Web.AuditLog != "" {
+		w.Audit, err = store.NewAuditLog(c.Web.AuditLog)
+		if err != nil {
+			fatal("unable to setup audit log", "error", err)
+		}
+	}
+	if c.Web.Jobs != nil {
+		w.Jobs, err = store.NewJobStore(c.Web.Jobs.Store)
+		if err != nil {
+			fatal("unable to setup job store", "error", err)
+		}
+		if c.Web.Jobs.Store == "" {
+			slog.Warn("no jobs store configured, queued jobs are lost on restart")
+		}
+		w.StartWorkers()
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", w.Handle)
-	middlewared := w.Middleware(mux)
+	mux.HandleFunc("/healthz", w.HandleHealth)
+	mux.HandleFunc("/readyz", w.HandleReady)
+	if c.Web.Jobs != nil {
+		mux.HandleFunc("/jobs/", w.HandleJob)
+		mux.HandleFunc("/scheduled", w.HandleScheduled)
+		mux.HandleFunc("/scheduled/", w.HandleScheduled)
+	}
+	if c.Web.Webhooks != nil {
+		for _, provider := range []string{web.PROVIDER_GITHUB, web.PROVIDER_GITEA, web.PROVIDER_GITLAB} {
+			mux.HandleFunc("/hooks/"+provider, w.HandleWebhook)
+		}
+	}
+	if c.Web.DroneWebhook != nil {
+		mux.HandleFunc("/hooks/drone", w.HandleDroneWebhook)
+	}
+	if c.Web.AdminToken != "" {
+		if c.Web.TokenStore == "" {
+			slog.Warn("no token_store configured, runtime tokens are lost on restart")
+		}
+		mux.HandleFunc("/admin/tokens", w.HandleAdminTokens)
+		mux.HandleFunc("/admin/tokens/rotate", w.HandleAdminTokenRotate)
+		mux.HandleFunc("/admin/builds", w.HandleAdminBuilds)
+		mux.HandleFunc("/admin/chains", w.HandleAdminChains)
+		mux.HandleFunc("/admin/jobs", w.HandleAdminJobs)
+		mux.HandleFunc("/admin/jobs/requeue", w.HandleAdminJobRequeue)
+		mux.HandleFunc("/admin/audit", w.HandleAdminAudit)
+	}
+	server := newServer(c.Web.Listen, w.Middleware(mux), &c.Web.Server)
+	if c.Web.TLS != nil {
+		server.TLSConfig, err = web.NewTLSConfig(c.Web.TLS)
+		if err != nil {
+			fatal("unable to setup tls", "error", err)
+		}
+	}
+	servers := []*http.Server{server}
+	if c.Web.MetricsListen == "" {
+		mux.Handle("/metrics", metrics.Default.Handler())
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Default.Handler())
+		servers = append(servers, newServer(c.Web.MetricsListen, metricsMux, &c.Web.Server))
+	}
 
 	// listen
-	log.Printf("listening on %s", c.Web.Listen)
-	err = http.ListenAndServe(c.Web.Listen, middlewared)
+	for _, server := range servers {
+		go func(server *http.Server) {
+			slog.Info("listening", "listen", server.Addr, "tls", server.TLSConfig != nil)
+			err := error(nil)
+			if server.TLSConfig != nil {
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("webserver stopped", "listen", server.Addr, "error", err)
+			}
+		}(server)
+	}
+
+	// reload on SIGHUP or changes of the config file
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	modified := modTime(*configFile)
+	changes := (<-chan time.Time)(nil)
+	if *watch > 0 {
+		ticker := time.NewTicker(*watch)
+		defer ticker.Stop()
+		changes = ticker.C
+	}
+	sig := os.Signal(nil)
+	for sig == nil {
+		select {
+		case <-changes:
+			if m := modTime(*configFile); !m.Equal(modified) {
+				modified = m
+				c = reload(w, *configFile, c)
+			}
+		case s := <-signals:
+			if s == syscall.SIGHUP {
+				modified = modTime(*configFile)
+				c = reload(w, *configFile, c)
+				continue
+			}
+			sig = s
+		}
+	}
+
+	// shutdown gracefully, a second signal exits immediately
+	signal.Stop(signals)
+	slog.Info("shutting down", "signal", sig.String(), "timeout", c.Web.Server.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), c.Web.Server.ShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("unable to drain requests", "listen", server.Addr, "error", err)
+		}
+	}
+	if err := w.Shutdown(ctx); err != nil {
+		slog.Error("unable to drain jobs", "error", err)
+	}
+	if w.Jobs != nil {
+		if err := w.Jobs.Close(); err != nil {
+			slog.Error("unable to close job store", "error", err)
+		}
+	}
+	if w.Audit != nil {
+		if err := w.Audit.Close(); err != nil {
+			slog.Error("unable to close audit log", "error", err)
+		}
+	}
+	slog.Info("stopped")
+}
+
+// validate checks that the config includes the webserver, its settings are
+// validated when loading it
+func validate(c *core.Config) error {
+	if c.Web == nil {
+		return fmt.Errorf("no configuration for web found")
+	}
+	return nil
+}
+
+// reload loads and validates the config file and swaps it in, on errors the
+// current config is kept. The current config is returned.
+func reload(w *web.Web, file string, current *core.Config) *core.Config {
+	c, err := config.LoadConfig(file)
+	if err == nil {
+		err = validate(c)
+	}
+	if err != nil {
+		slog.Error("unable to reload config, keeping the current one", "config", file, "error", err)
+		return current
+	}
+	err = logging.Setup(c.Log, os.Stdout)
+	if err != nil {
+		slog.Error("unable to setup logging", "error", err)
+	}
+	restart := w.Reload(c.Web, drone.New(c.Url, c.Token))
+	changes := config.Diff(current, c)
+	slog.Info("reloaded config",
+		"config", file,
+		"added_repos", changes.AddedRepos,
+		"removed_repos", changes.RemovedRepos,
+		"added_servers", changes.AddedServers,
+		"removed_servers", changes.RemovedServers,
+	)
+	if len(restart) > 0 {
+		slog.Warn("changed settings require a restart, keeping their current values", "settings", restart)
+	}
+	return c
+}
+
+// modTime returns the modification time of file, zero if it is missing
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
 	if err != nil {
-		log.Fatalf("webserver stopped: %s", err)
+		return time.Time{}
 	}
+	return info.ModTime()
+}
+
+// newServer creates a webserver with the configured timeouts
+func newServer(listen string, handler http.Handler, c *core.ServerConfig) *http.Server {
+	return &http.Server{
+		Addr:              listen,
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+}
+
+// fatal logs an error with its fields and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
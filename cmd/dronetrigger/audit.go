@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/config"
+	"github.com/bitsbeats/dronetrigger/store"
+)
+
+// runAudit queries the audit log through the admin api of dronetrigger-web
+func runAudit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	configFile := flags.String("config", "/etc/dronetrigger.yml", "Configuration file.")
+	server := flags.String("server", "", "URL of dronetrigger-web (default derived from web.listen).")
+	adminToken := flags.String("admin-token", "", "Admin token (default web.admin_token).")
+	repo := flags.String("repo", "", "Only list triggers of repositories matching this glob.")
+	action := flags.String("action", "", "Only list triggers with this action (rebuild, promote, rollback or cancel).")
+	since := flags.String("since", "", "Only list triggers since this RFC 3339 time or duration ago (i.e. 24h).")
+	until := flags.String("until", "", "Only list triggers before this RFC 3339 time or duration ago.")
+	limit := flags.Int("limit", 0, "Only list the latest triggers.")
+	jsonOutput := flags.Bool("json", false, "Print the entries as json lines.")
+	_ = flags.Parse(args)
+
+	c, err := config.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *server == "" && c.Web != nil {
+		*server = serverURL(c.Web.Listen)
+	}
+	if *adminToken == "" && c.Web != nil {
+		*adminToken = c.Web.AdminToken
+	}
+
+	query := url.Values{}
+	for key, value := range map[string]string{"repo": *repo, "action": *action, "since": *since, "until": *until} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if *limit > 0 {
+		query.Set("limit", strconv.Itoa(*limit))
+	}
+	entries := []*store.AuditEntry{}
+	adminRequest(*server, *adminToken, "GET", "/admin/audit?"+query.Encode(), nil, &entries)
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			_ = encoder.Encode(entry)
+		}
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tTOKEN\tSOURCE\tACTION\tREPO\tBRANCH\tTARGET\tPARENT\tBUILD\tOUTCOME\tERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			entry.Time.Format(time.RFC3339), entry.Token, entry.SourceIP, entry.Action, entry.Trigger.Repo,
+			entry.Trigger.Branch, entry.Trigger.Target, entry.Parent, entry.Build, entry.Outcome, entry.Err)
+	}
+	_ = tw.Flush()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bitsbeats/dronetrigger/config"
+)
+
+// runConfig checks config files, i.e. in CI before deploying them
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "validate" {
+		log.Fatal("usage: dronetrigger config validate [flags]")
+	}
+	flags := flag.NewFlagSet("config validate", flag.ExitOnError)
+	configFile := flags.String("config", "/etc/dronetrigger.yml", "Configuration file.")
+	web := flags.Bool("web", false, "Require the web configuration of dronetrigger-web.")
+	_ = flags.Parse(args[1:])
+
+	c, err := config.LoadConfig(*configFile)
+	errs := config.Errors{}
+	switch {
+	case errors.As(err, &errs):
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *configFile, err)
+		}
+		os.Exit(1)
+	case err != nil:
+		log.Fatal(err)
+	case *web && c.Web == nil:
+		log.Fatalf("%s: no configuration for web found", *configFile)
+	}
+	fmt.Printf("%s is valid\n", *configFile)
+}
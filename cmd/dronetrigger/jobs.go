@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/config"
+	"github.com/bitsbeats/dronetrigger/store"
+	"github.com/bitsbeats/dronetrigger/web"
+)
+
+// runJobs inspects and requeues jobs through the admin api of
+// dronetrigger-web
+func runJobs(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: dronetrigger jobs list|requeue [flags]")
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("jobs "+command, flag.ExitOnError)
+	configFile := flags.String("config", "/etc/dronetrigger.yml", "Configuration file.")
+	server := flags.String("server", "", "URL of dronetrigger-web (default derived from web.listen).")
+	adminToken := flags.String("admin-token", "", "Admin token (default web.admin_token).")
+	state := flags.String("state", "", "Only list jobs in this state (queued, scheduled, running, done, failed, dead or cancelled).")
+	id := flags.String("id", "", "ID of the job to requeue.")
+	_ = flags.Parse(args[1:])
+
+	c, err := config.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *server == "" && c.Web != nil {
+		*server = serverURL(c.Web.Listen)
+	}
+	if *adminToken == "" && c.Web != nil {
+		*adminToken = c.Web.AdminToken
+	}
+
+	switch command {
+	case "list":
+		jobs := []*store.Job{}
+		path := "/admin/jobs"
+		if *state != "" {
+			path += "?state=" + url.QueryEscape(*state)
+		}
+		adminRequest(*server, *adminToken, "GET", path, nil, &jobs)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATE\tACTION\tREPO\tBRANCH\tTARGET\tATTEMPTS\tBUILD\tUPDATED\tERROR")
+		for _, job := range jobs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+				job.ID, job.State, job.Trigger.GetAction(), job.Trigger.Repo, job.Trigger.Branch,
+				job.Trigger.Target, job.Attempts, job.Build, job.Updated.Format(time.RFC3339), job.Err)
+		}
+		_ = tw.Flush()
+	case "requeue":
+		if *id == "" {
+			log.Fatal("please specify a job with -id")
+		}
+		job := store.Job{}
+		adminRequest(*server, *adminToken, "POST", "/admin/jobs/requeue", web.JobRequest{ID: *id}, &job)
+		log.Printf("requeued job %s: %s %s@%s", job.ID, job.Trigger.GetAction(), job.Trigger.Repo, job.Trigger.Branch)
+	default:
+		log.Fatalf("unknown jobs command %q", command)
+	}
+}
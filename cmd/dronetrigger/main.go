@@ -1,26 +1,69 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/bitsbeats/dronetrigger/config"
 	"github.com/bitsbeats/dronetrigger/core"
 	"github.com/bitsbeats/dronetrigger/drone"
+	"github.com/bitsbeats/dronetrigger/logging"
+	"gopkg.in/yaml.v2"
 )
 
+// stringList is a flag which may be specified multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
 	log.SetFlags(0)
 	log.SetOutput(os.Stdout)
-	branch := flag.String("branch", "", "Git branch to trigger build.")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "token":
+			runToken(os.Args[2:])
+			return
+		case "org":
+			runOrg(os.Args[2:])
+			return
+		case "jobs":
+			runJobs(os.Args[2:])
+			return
+		case "audit":
+			runAudit(os.Args[2:])
+			return
+		case "config":
+			runConfig(os.Args[2:])
+			return
+		}
+	}
+
+	repos := stringList{}
+	branch := flag.String("branch", "", "Git branch to trigger build, globs rebuild every matching branch.")
 	release := flag.Bool("release", false, "Rebuild last release tag. Mutally exclusive with -branch")
-	repo := flag.String("repo", "", "Repository to build (i.e. octocat/awesome).")
+	flag.Var(&repos, "repo", "Repository to build (i.e. octocat/awesome), may be specified multiple times.")
+	file := flag.String("file", "", "YAML list of triggers, - reads from stdin.")
+	concurrency := flag.Int("concurrency", 4, "Number of parallel triggers.")
 	configFile := flag.String("config", "/etc/dronetrigger.yml", "Configuration file.")
 	verbose := flag.Bool("v", false, "Verbose output.")
 	flag.Parse()
 
-	if *repo == "" {
+	if len(repos) == 0 && *file == "" {
 		log.Print("dronetrigger\n\n")
 		flag.PrintDefaults()
 		log.Fatal("\nplease specify a repository.")
@@ -30,23 +73,130 @@ func main() {
 		log.Fatal("unable to use -release with -branch")
 	}
 
+	triggers := []*core.Trigger{}
+	for _, repo := range repos {
+		triggers = append(triggers, &core.Trigger{Repo: repo, Branch: *branch, Release: *release})
+	}
+	if *file != "" {
+		fileTriggers, err := loadTriggers(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		triggers = append(triggers, fileTriggers...)
+	}
+
 	c, err := config.LoadConfig(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	ctx := setupLogging(c, *verbose)
 	d := drone.New(c.Url, c.Token)
 
-	build := (*core.Build)(nil)
-	if *release {
-		build, err = d.RebuildLastTag(*repo)
-	} else {
-		build, err = d.RebuildLastBuild(*repo, *branch)
+	triggers, failed := expandBranches(ctx, d, triggers)
+	mu := sync.Mutex{}
+	parallel(len(triggers), *concurrency, func(i int) {
+		t := triggers[i]
+		build, err := core.Dispatch(ctx, d, t)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			failed += 1
+			slog.ErrorContext(ctx, "trigger failed", append(logging.TriggerAttrs(t, "", 0), "error", err)...)
+			return
+		}
+		slog.DebugContext(ctx, "started build", append(logging.TriggerAttrs(t, "", build.Number), "commit", build.After)...)
+	})
+	if failed > 0 {
+		slog.ErrorContext(ctx, "triggers failed", "failed", failed)
+		os.Exit(1)
+	}
+}
+
+// setupLogging configures the log output of the config, verbose lowers the
+// level to debug. The returned context carries a request ID for drone.
+func setupLogging(c *core.Config, verbose bool) context.Context {
+	logConfig := core.LogConfig{}
+	if c.Log != nil {
+		logConfig = *c.Log
+	}
+	if verbose {
+		logConfig.Level = "debug"
 	}
+	err := logging.Setup(&logConfig, os.Stdout)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if *verbose {
-		log.Printf("started build sha %s for %s", build.After, *repo)
+	return logging.WithRequestID(context.Background(), logging.NewRequestID())
+}
+
+// expandBranches replaces triggers with branch globs by a trigger for every
+// matching branch, it returns the number of repositories failed to expand
+func expandBranches(ctx context.Context, d *drone.Drone, triggers []*core.Trigger) (expanded []*core.Trigger, failed int) {
+	for _, t := range triggers {
+		if !core.IsGlob(t.Branch) {
+			expanded = append(expanded, t)
+			continue
+		}
+		builds, err := d.Branches(ctx, t.Repo)
+		if err != nil {
+			failed += 1
+			slog.ErrorContext(ctx, "unable to list branches", append(logging.TriggerAttrs(t, "", 0), "error", err)...)
+			continue
+		}
+		branches := core.MatchBranches(builds, t.Branch)
+		if len(branches) == 0 {
+			failed += 1
+			slog.ErrorContext(ctx, "no matching branches", logging.TriggerAttrs(t, "", 0)...)
+			continue
+		}
+		for _, branch := range branches {
+			branchTrigger := *t
+			branchTrigger.Branch = branch
+			expanded = append(expanded, &branchTrigger)
+		}
+	}
+	return expanded, failed
+}
+
+// loadTriggers reads a YAML list of triggers from path or stdin
+func loadTriggers(path string) (triggers []*core.Trigger, err error) {
+	data := []byte{}
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read triggers: %w", err)
+	}
+	err = yaml.Unmarshal(data, &triggers)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse triggers: %w", err)
+	}
+	for i, t := range triggers {
+		if t == nil {
+			return nil, fmt.Errorf("trigger %d is empty", i+1)
+		}
+	}
+	return triggers, nil
+}
+
+// parallel calls fn for 0..n-1 with at most concurrency parallel calls
+func parallel(n, concurrency int, fn func(i int)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	semaphore := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			fn(i)
+		}(i)
 	}
+	wg.Wait()
 }
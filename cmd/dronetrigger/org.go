@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/bitsbeats/dronetrigger/config"
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/drone"
+	"github.com/bitsbeats/dronetrigger/logging"
+)
+
+// runOrg rebuilds or promotes the default branch of all matching repositories
+func runOrg(args []string) {
+	flags := flag.NewFlagSet("org", flag.ExitOnError)
+	configFile := flags.String("config", "/etc/dronetrigger.yml", "Configuration file.")
+	namespace := flags.String("namespace", "", "Namespace (organisation) of the repositories.")
+	glob := flags.String("glob", "", "Glob for the repositories (i.e. platform/service-*).")
+	inactive := flags.Bool("inactive", false, "Include inactive repositories.")
+	target := flags.String("target", "", "Promote to target instead of rebuilding.")
+	concurrency := flags.Int("concurrency", 4, "Number of parallel triggers.")
+	dryRun := flags.Bool("dry-run", false, "Only list the matching repositories.")
+	_ = flags.Parse(args)
+
+	if *namespace == "" && *glob == "" {
+		flags.PrintDefaults()
+		log.Fatal("please specify -namespace or -glob")
+	}
+
+	c, err := config.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := setupLogging(c, false)
+	d := drone.New(c.Url, c.Token)
+
+	repos, err := d.Repos(ctx)
+	if err != nil {
+		log.Fatalf("unable to list repositories: %s", err)
+	}
+	repos = drone.FilterRepos(repos, *namespace, *glob, !*inactive)
+	if len(repos) == 0 {
+		log.Fatal("no matching repositories")
+	}
+
+	results := make([]core.TriggerResult, len(repos))
+	if !*dryRun {
+		done := 0
+		mu := sync.Mutex{}
+		parallel(len(repos), *concurrency, func(i int) {
+			t := &core.Trigger{Repo: repos[i].Slug, Branch: repos[i].DefaultBranch, Target: *target}
+			result := core.TriggerResult{Repo: t.Repo, Branch: t.Branch, Target: t.Target}
+			build, err := core.Dispatch(ctx, d, t)
+			if err != nil {
+				result.Err = err.Error()
+			} else {
+				result.Build = build.Number
+			}
+			results[i] = result
+
+			mu.Lock()
+			defer mu.Unlock()
+			done += 1
+			attrs := append(logging.TriggerAttrs(t, "", result.Build), "done", done, "total", len(repos))
+			if result.Err != "" {
+				slog.ErrorContext(ctx, "trigger failed", append(attrs, "error", result.Err)...)
+			} else {
+				slog.InfoContext(ctx, "started build", attrs...)
+			}
+		})
+	}
+
+	failed := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nREPO\tBRANCH\tBUILD\tRESULT")
+	for i, result := range results {
+		status := "ok"
+		build := fmt.Sprintf("%d", result.Build)
+		switch {
+		case *dryRun:
+			result = core.TriggerResult{Repo: repos[i].Slug, Branch: repos[i].DefaultBranch}
+			status, build = "dry run", "-"
+		case result.Err != "":
+			failed += 1
+			status, build = result.Err, "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", result.Repo, result.Branch, build, status)
+	}
+	_ = tw.Flush()
+	if failed > 0 {
+		slog.ErrorContext(ctx, "repositories failed", "failed", failed, "total", len(repos))
+		os.Exit(1)
+	}
+}
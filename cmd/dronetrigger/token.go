@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/config"
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/web"
+)
+
+// runToken manages runtime tokens through the admin api of dronetrigger-web
+func runToken(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: dronetrigger token list|create|revoke|rotate [flags]")
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("token "+command, flag.ExitOnError)
+	configFile := flags.String("config", "/etc/dronetrigger.yml", "Configuration file.")
+	server := flags.String("server", "", "URL of dronetrigger-web (default derived from web.listen).")
+	adminToken := flags.String("admin-token", "", "Admin token (default web.admin_token).")
+	repo := flags.String("repo", "", "Repository of the token (i.e. octocat/awesome or octocat/*).")
+	name := flags.String("name", "", "Name of the token.")
+	secret := flags.String("token", "", "Secret of the token, generated if empty.")
+	actions := flags.String("actions", "", "Comma separated list of allowed actions.")
+	branches := flags.String("branches", "", "Comma separated list of allowed branch globs.")
+	targets := flags.String("targets", "", "Comma separated list of allowed target globs.")
+	params := flags.String("params", "", "Comma separated list of allowed param globs.")
+	notBefore := flags.String("not-before", "", "Token is valid from (RFC 3339).")
+	expiresAt := flags.String("expires-at", "", "Token is valid until (RFC 3339).")
+	overlap := flags.Duration("overlap", 0, "Time the old secret stays valid after rotation.")
+	_ = flags.Parse(args[1:])
+
+	c, err := config.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *server == "" && c.Web != nil {
+		*server = serverURL(c.Web.Listen)
+	}
+	if *adminToken == "" && c.Web != nil {
+		*adminToken = c.Web.AdminToken
+	}
+
+	tr := web.TokenRequest{Repo: *repo}
+	tr.Name = *name
+	tr.Token.Token = *secret
+	for _, action := range splitList(*actions) {
+		tr.Actions = append(tr.Actions, core.Action(action))
+	}
+	tr.Branches = splitList(*branches)
+	tr.Targets = splitList(*targets)
+	tr.Params = splitList(*params)
+	tr.NotBefore = parseTime("not-before", *notBefore)
+	tr.ExpiresAt = parseTime("expires-at", *expiresAt)
+	if *overlap > 0 {
+		tr.Overlap = overlap.String()
+	}
+
+	switch command {
+	case "list":
+		infos := []web.TokenInfo{}
+		adminRequest(*server, *adminToken, "GET", "/admin/tokens", nil, &infos)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "REPO\tNAME\tSOURCE\tACTIONS\tNOT BEFORE\tEXPIRES AT")
+		for _, info := range infos {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				info.Repo, info.Name, info.Source, formatActions(info.Actions),
+				formatTime(info.NotBefore), formatTime(info.ExpiresAt))
+		}
+		_ = tw.Flush()
+	case "create":
+		info := web.TokenInfo{}
+		adminRequest(*server, *adminToken, "POST", "/admin/tokens", tr, &info)
+		log.Printf("created token %s for %s: %s", info.Name, info.Repo, info.Token.Token)
+	case "revoke":
+		adminRequest(*server, *adminToken, "DELETE", "/admin/tokens", tr, nil)
+		log.Printf("revoked token %s for %s", tr.Name, tr.Repo)
+	case "rotate":
+		info := web.TokenInfo{}
+		adminRequest(*server, *adminToken, "POST", "/admin/tokens/rotate", tr, &info)
+		log.Printf("rotated token %s for %s: %s", info.Name, info.Repo, info.Token.Token)
+	default:
+		log.Fatalf("unknown token command %q", command)
+	}
+}
+
+// adminRequest calls the admin api and decodes the response data into result
+func adminRequest(server, adminToken, method, path string, payload, result interface{}) {
+	body := &bytes.Buffer{}
+	if payload != nil {
+		_ = json.NewEncoder(body).Encode(payload)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(server, "/")+path, body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", adminToken))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	jr := core.JsonResponse{Data: result}
+	err = json.NewDecoder(resp.Body).Decode(&jr)
+	if err != nil {
+		log.Fatalf("unable to parse response: %s", err)
+	}
+	if resp.StatusCode >= 400 {
+		log.Fatalf("%s: %s", resp.Status, jr.Err)
+	}
+}
+
+// serverURL derives the url of dronetrigger-web from its listen address
+func serverURL(listen string) string {
+	if strings.HasPrefix(listen, ":") {
+		return "http://localhost" + listen
+	}
+	return "http://" + listen
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+func parseTime(name, value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("invalid -%s: %s", name, err)
+	}
+	return &t
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatActions(actions []core.Action) string {
+	if len(actions) == 0 {
+		return "*"
+	}
+	list := []string{}
+	for _, action := range actions {
+		list = append(list, string(action))
+	}
+	return strings.Join(list, ",")
+}
@@ -3,25 +3,188 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/bitsbeats/dronetrigger/core"
 	"gopkg.in/yaml.v2"
 )
 
+// LoadConfig reads the config file, see Parse
 func LoadConfig(path string) (c *core.Config, err error) {
 	configData, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("unable to open config: %w", err)
 	}
+	return Parse(configData)
+}
 
+// Parse decodes a config strictly, sets the defaults and validates it. All
+// invalid settings are returned as Errors with their lines.
+func Parse(configData []byte) (c *core.Config, err error) {
 	c = &core.Config{}
-	err = yaml.Unmarshal(configData, c)
+	err = yaml.UnmarshalStrict(configData, c)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse config: %w", err)
+		return nil, decodeErrors(err)
 	}
 
 	if c.Web != nil && (c.Web.Listen == "") {
 		c.Web.Listen = ":8080"
 	}
-	return
+	if c.Web != nil && (c.Web.ExpiryWarning == 0) {
+		c.Web.ExpiryWarning = 7 * 24 * time.Hour
+	}
+	if c.Web != nil && (c.Web.BatchConcurrency == 0) {
+		c.Web.BatchConcurrency = 4
+	}
+	if c.Web != nil && (c.Web.BatchMaxItems == 0) {
+		c.Web.BatchMaxItems = 100
+	}
+	if c.Web != nil && (c.Web.IdempotencyTTL == 0) {
+		c.Web.IdempotencyTTL = 24 * time.Hour
+	}
+	if c.Web != nil {
+		server := &c.Web.Server
+		if server.ReadHeaderTimeout == 0 {
+			server.ReadHeaderTimeout = 10 * time.Second
+		}
+		if server.ReadTimeout == 0 {
+			server.ReadTimeout = 30 * time.Second
+		}
+		if server.WriteTimeout == 0 {
+			server.WriteTimeout = 2 * time.Minute
+		}
+		if server.IdleTimeout == 0 {
+			server.IdleTimeout = 2 * time.Minute
+		}
+		if server.MaxHeaderBytes == 0 {
+			server.MaxHeaderBytes = 64 * 1024
+		}
+		if server.MaxBodyBytes == 0 {
+			server.MaxBodyBytes = 1024 * 1024
+		}
+		if server.ShutdownTimeout == 0 {
+			server.ShutdownTimeout = 30 * time.Second
+		}
+	}
+	if c.Web != nil && c.Web.TLS != nil && c.Web.TLS.MinVersion == "" {
+		c.Web.TLS.MinVersion = "1.2"
+	}
+	if c.Web != nil && c.Web.Jobs != nil {
+		if c.Web.Jobs.Workers == 0 {
+			c.Web.Jobs.Workers = 4
+		}
+		if c.Web.Jobs.QueueSize == 0 {
+			c.Web.Jobs.QueueSize = 100
+		}
+		if c.Web.Jobs.MaxAttempts == 0 {
+			c.Web.Jobs.MaxAttempts = 5
+		}
+		if c.Web.Jobs.RetryDelay == 0 {
+			c.Web.Jobs.RetryDelay = 30 * time.Second
+		}
+		if c.Web.Jobs.MaxScheduled == 0 {
+			c.Web.Jobs.MaxScheduled = 100
+		}
+	}
+	if c.Web != nil && c.Web.RateLimits != nil {
+		for _, limit := range []*core.RateLimit{c.Web.RateLimits.Repo, c.Web.RateLimits.Token, c.Web.RateLimits.IP} {
+			if limit == nil {
+				continue
+			}
+			if limit.Per == 0 {
+				limit.Per = time.Minute
+			}
+			if limit.Burst == 0 {
+				limit.Burst = limit.Requests
+			}
+		}
+	}
+	if c.Web != nil {
+		for i, rule := range c.Web.Promotions {
+			if rule != nil && rule.Name == "" {
+				rule.Name = fmt.Sprintf("promotion-%d", i)
+			}
+		}
+	}
+	if c.Web != nil && c.Web.Chains != nil {
+		if c.Web.Chains.Concurrency == 0 {
+			c.Web.Chains.Concurrency = 4
+		}
+		for i, rule := range c.Web.Chains.Rules {
+			if rule != nil && rule.Name == "" {
+				rule.Name = fmt.Sprintf("chain-%d", i)
+			}
+		}
+	}
+
+	err = validate(c, configData)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkChainCycles detects chain rules which trigger themselves. A trigger
+// leads to every rule matching its repository and branch, triggers of the
+// default branch match every branch.
+func checkChainCycles(rules []*core.ChainRule) error {
+	leadsTo := func(t *core.Trigger, rule *core.ChainRule) bool {
+		if ok, _ := path.Match(rule.Repo, t.Repo); !ok {
+			return false
+		}
+		if rule.Branch == "" || t.Branch == "" {
+			return true
+		}
+		ok, _ := path.Match(rule.Branch, t.Branch)
+		return ok
+	}
+	// empty entries are reported by the validator
+	valid := []*core.ChainRule{}
+	for _, rule := range rules {
+		if rule != nil {
+			valid = append(valid, rule)
+		}
+	}
+	rules = valid
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(rules))
+	stack := []string{}
+	var visit func(i int) error
+	visit = func(i int) error {
+		state[i] = visiting
+		stack = append(stack, rules[i].Name)
+		for _, t := range rules[i].Trigger {
+			for j, next := range rules {
+				if t == nil || !leadsTo(t, next) {
+					continue
+				}
+				switch state[j] {
+				case visiting:
+					return fmt.Errorf("cycle detected: %s -> %s", strings.Join(stack, " -> "), next.Name)
+				case unvisited:
+					if err := visit(j); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range rules {
+		if state[i] == unvisited {
+			if err := visit(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
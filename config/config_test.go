@@ -1,7 +1,9 @@
 package config
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bitsbeats/dronetrigger/core"
 	check "gopkg.in/check.v1"
@@ -16,16 +18,31 @@ type TestSuite struct{}
 var _ = check.Suite(&TestSuite{})
 
 func (s *TestSuite) TestConfig(c *check.C) {
+	defaultServer := core.ServerConfig{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      2 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    64 * 1024,
+		MaxBodyBytes:      1024 * 1024,
+		ShutdownTimeout:   30 * time.Second,
+	}
+
 	cfg, err := LoadConfig("test_files/with_web.yaml")
 	c.Assert(err, check.DeepEquals, nil)
 	c.Assert(cfg, check.DeepEquals, &core.Config{
 		Url:   "https://drone.example.com",
 		Token: "hi there",
 		Web: &core.WebConfig{
-			BearerToken: map[string]string{
-				"org/repo": "bearer_token",
+			BearerToken: map[string]core.Tokens{
+				"org/repo": {{Name: "default", Token: "bearer_token"}},
 			},
-			Listen: ":8080",
+			Listen:           ":8080",
+			ExpiryWarning:    7 * 24 * time.Hour,
+			BatchConcurrency: 4,
+			BatchMaxItems:    100,
+			IdempotencyTTL:   24 * time.Hour,
+			Server:           defaultServer,
 		},
 	})
 
@@ -35,11 +52,25 @@ func (s *TestSuite) TestConfig(c *check.C) {
 		Url:   "https://drone.example.com",
 		Token: "hi there",
 		Web: &core.WebConfig{
-			BearerToken: map[string]string{
-				"org/repo": "bearer_token",
+			BearerToken: map[string]core.Tokens{
+				"org/repo": {{Name: "default", Token: "bearer_token"}},
+			},
+			Listen:           ":1337",
+			ExpiryWarning:    7 * 24 * time.Hour,
+			BatchConcurrency: 4,
+			BatchMaxItems:    100,
+			IdempotencyTTL:   24 * time.Hour,
+			Server: core.ServerConfig{
+				ReadHeaderTimeout: 10 * time.Second,
+				ReadTimeout:       30 * time.Second,
+				WriteTimeout:      5 * time.Minute,
+				IdleTimeout:       2 * time.Minute,
+				MaxHeaderBytes:    64 * 1024,
+				MaxBodyBytes:      4096,
+				ShutdownTimeout:   time.Minute,
 			},
-			Listen: ":1337",
 		},
+		Log: &core.LogConfig{Format: "json", Level: "debug"},
 	})
 
 	cfg, err = LoadConfig("test_files/without_web.yaml")
@@ -50,11 +81,179 @@ func (s *TestSuite) TestConfig(c *check.C) {
 		Web:   nil,
 	})
 
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	cfg, err = LoadConfig("test_files/with_scoped_tokens.yaml")
+	c.Assert(err, check.DeepEquals, nil)
+	c.Assert(cfg.Web.BearerToken, check.DeepEquals, map[string]core.Tokens{
+		"org/repo": {{Name: "default", Token: "bearer_token"}},
+		"org/prod": {
+			{
+				Name:     "ci",
+				Token:    "ci_token",
+				Actions:  []core.Action{core.ACTION_REBUILD, core.ACTION_PROMOTE},
+				Branches: []string{"main", "release/*"},
+				Targets:  []string{"staging"},
+				Params:   []string{"VERSION"},
+			},
+			{Name: "token-1", Token: "admin_token"},
+			{
+				Name:      "rotated",
+				Token:     "rotated_token",
+				NotBefore: &notBefore,
+				ExpiresAt: &expiresAt,
+			},
+		},
+	})
+	c.Assert(cfg.Web.ExpiryWarning, check.Equals, 48*time.Hour)
+	c.Assert(cfg.Web.Debounce, check.DeepEquals, map[string]time.Duration{
+		"org/*":    30 * time.Second,
+		"org/prod": 2 * time.Minute,
+	})
+	c.Assert(cfg.Web.RateLimits, check.DeepEquals, &core.RateLimitsConfig{
+		Repo: &core.RateLimit{Requests: 10, Per: time.Hour, Burst: 20},
+		IP:   &core.RateLimit{Requests: 30, Per: time.Minute, Burst: 30},
+	})
+
+	_, err = LoadConfig("test_files/with_invalid_rate_limit.yaml")
+	c.Assert(err, check.ErrorMatches, "line 7: web.rate_limits.token.requests: must be positive")
+
+	_, err = LoadConfig("test_files/with_invalid_trusted_proxies.yaml")
+	c.Assert(err, check.ErrorMatches, `line 8: web.trusted_proxies\[1\]: invalid address or network "proxy.local"`)
+
+	_, err = LoadConfig("test_files/with_invalid_log.yaml")
+	c.Assert(err, check.ErrorMatches, `line 3: log: invalid log format "xml"`)
+
+	cfg, err = LoadConfig("test_files/with_webhooks.yaml")
+	c.Assert(err, check.DeepEquals, nil)
+	c.Assert(cfg.Web.Webhooks, check.DeepEquals, &core.WebhooksConfig{
+		Secrets: map[string]string{"github": "gh_s3cret"},
+		Rules: []*core.WebhookRule{{
+			Name:     "lib-to-app",
+			Provider: "github",
+			Repo:     "org/lib",
+			Event:    "push",
+			Ref:      "main",
+			Trigger: []*core.Trigger{
+				{Repo: "org/app", Branch: "main"},
+				{Repo: "org/app", Release: true, Target: "staging", Params: map[string]string{"UPSTREAM": "org/lib"}},
+			},
+		}},
+	})
+
+	cfg, err = LoadConfig("test_files/with_chains.yaml")
+	c.Assert(err, check.DeepEquals, nil)
+	c.Assert(cfg.Web.Chains.Concurrency, check.Equals, 4)
+	c.Assert(cfg.Web.Chains.Rules[1].Name, check.Equals, "chain-1")
+
+	cfg, err = LoadConfig("test_files/with_chain_cycle.yaml")
+	c.Assert(err, check.ErrorMatches, "line 5: web.chains.rules: cycle detected: base-image -> service-a -> library -> base-image")
+	c.Assert(cfg, check.Equals, (*core.Config)(nil))
+
+	cfg, err = LoadConfig("test_files/with_promotions.yaml")
+	c.Assert(err, check.DeepEquals, nil)
+	c.Assert(cfg.Web.Promotions, check.DeepEquals, []*core.PromotionRule{
+		{Name: "main-to-staging", Enabled: true, Repo: "org/app", Event: "push", Branch: "main", Target: "staging"},
+		{Name: "promotion-1", Enabled: true, DryRun: true, Repo: "org/*", Tag: "v*", Target: "production-canary", Params: map[string]string{"CANARY": "true"}},
+	})
+
+	cfg, err = LoadConfig("test_files/with_tls.yaml")
+	c.Assert(err, check.DeepEquals, nil)
+	c.Assert(cfg.Web.TLS, check.DeepEquals, &core.TLSConfig{
+		Cert:        "/etc/dronetrigger/tls.crt",
+		Key:         "/etc/dronetrigger/tls.key",
+		MinVersion:  "1.2",
+		ClientCA:    "/etc/dronetrigger/clients.crt",
+		ClientCerts: []*core.ClientCert{{Subject: "deploy-bot", Repos: []string{"org/*"}}},
+	})
+
+	_, err = LoadConfig("test_files/with_invalid_tls.yaml")
+	c.Assert(err, check.ErrorMatches, "line 7: web.tls.client_certs: client_certs require client_ca")
+
+	_, err = LoadConfig("test_files/with_errors.yaml")
+	c.Assert(err, check.FitsTypeOf, Errors{})
+	c.Assert(err.Error(), check.Equals, strings.Join([]string{
+		`token: drone token is required`,
+		`line 1: url: invalid url "drone.example.com", expected http(s)://host`,
+		`line 4: web.bearer_token.org/repo[0].token: too short, at least 8 characters are required`,
+		`line 5: web.bearer_token.invalid: invalid repository "invalid", expected owner/name`,
+		`line 8: web.bearer_token.org/app[0].token: token is required`,
+		`line 9: web.bearer_token.org/app[0].actions[0]: invalid value deploy, expected one of [rebuild promote rollback cancel]`,
+		`line 10: web.listen: invalid listen address "8080": address 8080: missing port in address`,
+		`line 16: web.drone_webhook.followups[0].notify[0]: invalid url "not a url", expected http(s)://host`,
+		`line 18: web.promotions[0].target: target is required`,
+		`line 21: web.jobs.workers: must be positive`,
+	}, "\n"))
+
+	_, err = LoadConfig("test_files/with_null_entries.yaml")
+	c.Assert(err, check.FitsTypeOf, Errors{})
+	c.Assert(err.Error(), check.Equals, strings.Join([]string{
+		`line 6: web.bearer_token.org/repo[0]: empty entry`,
+		`line 10: web.promotions[0]: empty entry`,
+		`line 15: web.chains.rules[0].trigger[0]: empty entry`,
+		`line 16: web.chains.rules[1]: empty entry`,
+	}, "\n"))
+
+	_, err = LoadConfig("test_files/with_unknown_keys.yaml")
+	c.Assert(err, check.ErrorMatches, "line 4: unknown key bearer_tokens\nline 7: unknown key worker")
+
 	cfg, err = LoadConfig("test_files/non-existent.yaml")
 	c.Assert(err, check.ErrorMatches, "unable to open config: open test_files/non-existent.yaml: no such file or directory")
 	c.Assert(cfg, check.Equals, (*core.Config)(nil))
 
 	cfg, err = LoadConfig("test_files/invalid.yaml")
-	c.Assert(err, check.ErrorMatches, "(?s)unable to parse config: yaml:.*")
+	c.Assert(err, check.ErrorMatches, "line 1: cannot unmarshal !!str `.` into core.Config")
 	c.Assert(cfg, check.Equals, (*core.Config)(nil))
 }
+
+func (s *TestSuite) TestDiff(c *check.C) {
+	old, err := LoadConfig("test_files/with_web.yaml")
+	c.Assert(err, check.Equals, nil)
+	new, err := LoadConfig("test_files/with_web_reloaded.yaml")
+	c.Assert(err, check.Equals, nil)
+	c.Assert(Diff(old, new), check.DeepEquals, Changes{
+		AddedRepos:     []string{"org/new", "org/other"},
+		RemovedRepos:   []string{"org/repo"},
+		AddedServers:   []string{"https://drone2.example.com"},
+		RemovedServers: []string{"https://drone.example.com"},
+	})
+	c.Assert(Diff(old, old), check.DeepEquals, Changes{
+		AddedRepos:     []string{},
+		RemovedRepos:   []string{},
+		AddedServers:   []string{},
+		RemovedServers: []string{},
+	})
+}
+
+func (s *TestSuite) TestLineOf(c *check.C) {
+	data := []byte(`# comment
+url: https://drone.example.com
+web:
+  bearer_token:
+    "org/*": token
+  chains:
+    rules:
+    - name: a
+      trigger:
+        - repo: org/a
+        - repo: org/b
+          branch: main
+    - name: b
+      trigger: [{repo: org/c}]
+`)
+	for _, test := range []struct {
+		path string
+		line int
+	}{
+		{"url", 2},
+		{"web.bearer_token.org/*", 5},
+		{"web.chains.rules.0.name", 8},
+		{"web.chains.rules.0.trigger.1.branch", 12},
+		{"web.chains.rules.1", 13},
+		{"web.chains.rules.1.trigger.0.repo", 14},
+		{"web.listen", 3},
+		{"token", 0},
+	} {
+		c.Check(lineOf(data, strings.Split(test.path, ".")), check.Equals, test.line, check.Commentf(test.path))
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"sort"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+// Changes summarizes the differences of a reloaded config
+type Changes struct {
+	AddedRepos     []string
+	RemovedRepos   []string
+	AddedServers   []string
+	RemovedServers []string
+}
+
+// Diff compares the repositories with bearer tokens and the drone servers of
+// two configs
+func Diff(old, new *core.Config) Changes {
+	changes := Changes{}
+	changes.AddedRepos, changes.RemovedRepos = diffKeys(repos(old), repos(new))
+	changes.AddedServers, changes.RemovedServers = diffKeys(servers(old), servers(new))
+	return changes
+}
+
+// repos returns the repository patterns with bearer tokens
+func repos(c *core.Config) map[string]bool {
+	repos := map[string]bool{}
+	if c.Web != nil {
+		for repo := range c.Web.BearerToken {
+			repos[repo] = true
+		}
+	}
+	return repos
+}
+
+// servers returns the drone servers
+func servers(c *core.Config) map[string]bool {
+	return map[string]bool{c.Url: true}
+}
+
+// diffKeys returns the sorted keys only found in new and those only found
+// in old
+func diffKeys(old, new map[string]bool) (added, removed []string) {
+	added, removed = []string{}, []string{}
+	for key := range new {
+		if !old[key] {
+			added = append(added, key)
+		}
+	}
+	for key := range old {
+		if !new[key] {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a line of a yaml document without its indentation
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// lineOf returns the line of the setting at path in the yaml document. Path
+// elements are keys of mappings or indices of sequences. If the setting is
+// not found the line of its closest parent is returned, 0 if there is none.
+// Only block style yaml is searched.
+func lineOf(data []byte, path []string) int {
+	block := []yamlLine{}
+	for i, line := range strings.Split(string(data), "\n") {
+		text := strings.TrimLeft(line, " ")
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		block = append(block, yamlLine{number: i + 1, indent: len(line) - len(text), text: text})
+	}
+	number := 0
+	for _, elem := range path {
+		found := 0
+		block, found = child(block, elem)
+		if found == 0 {
+			break
+		}
+		number = found
+	}
+	return number
+}
+
+// child returns the block of the key or index elem within block and its
+// line number
+func child(block []yamlLine, elem string) ([]yamlLine, int) {
+	if len(block) == 0 {
+		return nil, 0
+	}
+	indent := block[0].indent
+	index, err := strconv.Atoi(elem)
+	isIndex := err == nil
+	item := 0
+	for i, line := range block {
+		if line.indent != indent {
+			continue
+		}
+		if isIndex && (line.text == "-" || strings.HasPrefix(line.text, "- ")) {
+			if item == index {
+				// the content of the item starts on the line of its dash
+				rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+				nested := []yamlLine{}
+				if rest != "" {
+					nested = append(nested, yamlLine{line.number, line.indent + len(line.text) - len(rest), rest})
+				}
+				return append(nested, childLines(block[i+1:], indent, false)...), line.number
+			}
+			item += 1
+			continue
+		}
+		if !isIndex && isKey(line.text, elem) {
+			return childLines(block[i+1:], indent, true), line.number
+		}
+	}
+	return nil, 0
+}
+
+// childLines returns the leading lines of block belonging to an entry at
+// indent. Sequences of mappings may be indented like their key.
+func childLines(block []yamlLine, indent int, sequence bool) []yamlLine {
+	for i, line := range block {
+		if line.indent > indent {
+			continue
+		}
+		if sequence && line.indent == indent && strings.HasPrefix(line.text, "-") {
+			continue
+		}
+		return block[:i]
+	}
+	return block
+}
+
+// isKey checks if the line starts the mapping entry key
+func isKey(text, key string) bool {
+	for _, k := range []string{key, `"` + key + `"`, "'" + key + "'"} {
+		if text == k+":" || strings.HasPrefix(text, k+": ") {
+			return true
+		}
+	}
+	return false
+}
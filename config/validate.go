@@ -0,0 +1,472 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+	"gopkg.in/yaml.v2"
+)
+
+// minTokenLength is the minimum length of bearer and admin tokens
+const minTokenLength = 8
+
+var (
+	// repoPattern matches repository names and globs like owner/name
+	repoPattern = regexp.MustCompile(`^[A-Za-z0-9_.*?\[\]-]+/[A-Za-z0-9_.*?\[\]-]+$`)
+
+	// unknownField matches the errors of strict decoding for unknown keys
+	unknownField = regexp.MustCompile(`^line (\d+): field (\S+) not found in type \S+$`)
+
+	// yamlError matches the line of decoding errors
+	yamlError = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+	// the values supported by dronetrigger-web
+	tlsVersions      = []string{"1.0", "1.1", "1.2", "1.3"}
+	webhookProviders = []string{"github", "gitea", "gitlab"}
+	webhookEvents    = []string{"push", "tag", "release"}
+	actions          = []core.Action{core.ACTION_REBUILD, core.ACTION_PROMOTE, core.ACTION_ROLLBACK, core.ACTION_CANCEL}
+)
+
+type (
+	// ValidationError is an invalid setting of the config at Path, Line is 0
+	// if it is unknown
+	ValidationError struct {
+		Line int
+		Path string
+		Msg  string
+	}
+
+	// Errors are all errors of a config, sorted by line
+	Errors []*ValidationError
+
+	// validator collects the errors of a config with their yaml lines
+	validator struct {
+		data   []byte
+		errors Errors
+	}
+)
+
+func (e *ValidationError) Error() string {
+	msg := e.Msg
+	if e.Path != "" {
+		msg = e.Path + ": " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+	return msg
+}
+
+func (e Errors) Error() string {
+	msgs := []string{}
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// decodeErrors converts the errors of strict decoding
+func decodeErrors(err error) error {
+	typeErr := &yaml.TypeError{}
+	if !errors.As(err, &typeErr) {
+		return fmt.Errorf("unable to parse config: %w", err)
+	}
+	errs := Errors{}
+	for _, msg := range typeErr.Errors {
+		if m := unknownField.FindStringSubmatch(msg); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			errs = append(errs, &ValidationError{Line: line, Msg: fmt.Sprintf("unknown key %s", m[2])})
+			continue
+		}
+		if m := yamlError.FindStringSubmatch(msg); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			errs = append(errs, &ValidationError{Line: line, Msg: m[2]})
+			continue
+		}
+		errs = append(errs, &ValidationError{Msg: msg})
+	}
+	return errs
+}
+
+// errorf adds an error of the setting at path
+func (v *validator) errorf(path []string, format string, args ...any) {
+	v.errors = append(v.errors, &ValidationError{
+		Line: lineOf(v.data, path),
+		Path: formatPath(path),
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// formatPath joins the keys of path with dots, indices are enclosed in
+// brackets
+func formatPath(path []string) string {
+	b := strings.Builder{}
+	for _, elem := range path {
+		if _, err := strconv.Atoi(elem); err == nil {
+			b.WriteString("[" + elem + "]")
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(elem)
+	}
+	return b.String()
+}
+
+// at appends elements to a path
+func at(path []string, elems ...any) []string {
+	joined := append([]string{}, path...)
+	for _, elem := range elems {
+		joined = append(joined, fmt.Sprint(elem))
+	}
+	return joined
+}
+
+// validate checks the config parsed from data, all errors are returned
+func validate(c *core.Config, data []byte) error {
+	v := &validator{data: data}
+	v.url([]string{"url"}, c.Url)
+	if c.Token == "" {
+		v.errorf([]string{"token"}, "drone token is required")
+	}
+	if c.Log != nil {
+		if _, err := logging.New(c.Log, io.Discard); err != nil {
+			v.errorf([]string{"log"}, "%s", err)
+		}
+	}
+	if c.Web != nil {
+		v.web([]string{"web"}, c.Web)
+	}
+	if len(v.errors) > 0 {
+		sort.SliceStable(v.errors, func(i, j int) bool {
+			a, b := v.errors[i], v.errors[j]
+			if a.Line != b.Line {
+				return a.Line < b.Line
+			}
+			return a.Path < b.Path
+		})
+		return v.errors
+	}
+	return nil
+}
+
+func (v *validator) web(p []string, c *core.WebConfig) {
+	for repo, tokens := range c.BearerToken {
+		v.repo(at(p, "bearer_token", repo), repo, true)
+		if len(tokens) == 0 {
+			v.errorf(at(p, "bearer_token", repo), "no tokens configured")
+		}
+		names := map[string]bool{}
+		for i, token := range tokens {
+			if null(v, at(p, "bearer_token", repo, i), token) {
+				continue
+			}
+			v.token(at(p, "bearer_token", repo, i), token)
+			if names[token.Name] {
+				v.errorf(at(p, "bearer_token", repo, i, "name"), "duplicate token name %s", token.Name)
+			}
+			names[token.Name] = true
+		}
+	}
+	v.listen(at(p, "listen"), c.Listen)
+	if c.MetricsListen != "" {
+		v.listen(at(p, "metrics_listen"), c.MetricsListen)
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < minTokenLength {
+		v.errorf(at(p, "admin_token"), "too short, at least %d characters are required", minTokenLength)
+	}
+	v.positive(at(p, "expiry_warning"), int64(c.ExpiryWarning))
+	v.positive(at(p, "batch_concurrency"), int64(c.BatchConcurrency))
+	v.positive(at(p, "batch_max_items"), int64(c.BatchMaxItems))
+	v.positive(at(p, "idempotency_ttl"), int64(c.IdempotencyTTL))
+	if c.DuplicateWindow < 0 {
+		v.errorf(at(p, "duplicate_window"), "must not be negative")
+	}
+	for repo, window := range c.Debounce {
+		v.repo(at(p, "debounce", repo), repo, true)
+		v.positive(at(p, "debounce", repo), int64(window))
+	}
+	v.server(at(p, "server"), &c.Server)
+	if c.TLS != nil {
+		v.tls(at(p, "tls"), c.TLS)
+	}
+	if c.RateLimits != nil {
+		limits := map[string]*core.RateLimit{"repo": c.RateLimits.Repo, "token": c.RateLimits.Token, "ip": c.RateLimits.IP}
+		for name, limit := range limits {
+			if limit == nil {
+				continue
+			}
+			v.positive(at(p, "rate_limits", name, "requests"), int64(limit.Requests))
+			v.positive(at(p, "rate_limits", name, "per"), int64(limit.Per))
+			if limit.Requests > 0 {
+				v.positive(at(p, "rate_limits", name, "burst"), int64(limit.Burst))
+			}
+		}
+	}
+	for i, proxy := range c.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			if _, err := netip.ParseAddr(proxy); err != nil {
+				v.errorf(at(p, "trusted_proxies", i), "invalid address or network %q", proxy)
+			}
+		}
+	}
+	if c.Jobs != nil {
+		v.positive(at(p, "jobs", "workers"), int64(c.Jobs.Workers))
+		v.positive(at(p, "jobs", "queue_size"), int64(c.Jobs.QueueSize))
+		v.positive(at(p, "jobs", "max_attempts"), int64(c.Jobs.MaxAttempts))
+		v.positive(at(p, "jobs", "retry_delay"), int64(c.Jobs.RetryDelay))
+		v.positive(at(p, "jobs", "max_scheduled"), int64(c.Jobs.MaxScheduled))
+	}
+	if c.Webhooks != nil {
+		v.webhooks(at(p, "webhooks"), c.Webhooks)
+	}
+	if c.DroneWebhook != nil {
+		v.droneWebhook(at(p, "drone_webhook"), c.DroneWebhook)
+	}
+	if c.Chains != nil {
+		v.chains(at(p, "chains"), c.Chains)
+	}
+	for i, rule := range c.Promotions {
+		if null(v, at(p, "promotions", i), rule) {
+			continue
+		}
+		v.promotion(at(p, "promotions", i), rule)
+	}
+}
+
+// url checks for an absolute http or https url
+func (v *validator) url(p []string, value string) {
+	if value == "" {
+		v.errorf(p, "url is required")
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(p, "invalid url %q, expected http(s)://host", value)
+	}
+}
+
+// repo checks a repository name like owner/name, globs are allowed if glob
+func (v *validator) repo(p []string, repo string, glob bool) {
+	if repo == "" {
+		v.errorf(p, "repository is required")
+		return
+	}
+	if !repoPattern.MatchString(repo) {
+		v.errorf(p, "invalid repository %q, expected owner/name", repo)
+		return
+	}
+	if !glob && core.IsGlob(repo) {
+		v.errorf(p, "repository %q must not be a glob", repo)
+		return
+	}
+	if _, err := path.Match(repo, ""); err != nil {
+		v.errorf(p, "invalid repository pattern %q: %s", repo, err)
+	}
+}
+
+// globs checks a list of glob patterns
+func (v *validator) globs(p []string, patterns []string) {
+	for i, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			v.errorf(at(p, i), "invalid pattern %q: %s", pattern, err)
+		}
+	}
+}
+
+// positive checks that a number or duration is greater than zero
+func (v *validator) positive(p []string, value int64) {
+	if value <= 0 {
+		v.errorf(p, "must be positive")
+	}
+}
+
+// oneOf checks that value is empty or one of allowed
+func oneOf[T comparable](v *validator, p []string, value T, allowed []T) {
+	var empty T
+	if value != empty && !contains(allowed, value) {
+		v.errorf(p, "invalid value %v, expected one of %v", value, allowed)
+	}
+}
+
+// null reports an empty list entry, it is true if entry is nil
+func null[T any](v *validator, p []string, entry *T) bool {
+	if entry == nil {
+		v.errorf(p, "empty entry")
+	}
+	return entry == nil
+}
+
+func contains[T comparable](values []T, value T) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) token(p []string, token *core.Token) {
+	switch {
+	case token.Token == "":
+		v.errorf(at(p, "token"), "token is required")
+	case len(token.Token) < minTokenLength:
+		v.errorf(at(p, "token"), "too short, at least %d characters are required", minTokenLength)
+	}
+	for i, action := range token.Actions {
+		oneOf(v, at(p, "actions", i), action, actions)
+	}
+	v.globs(at(p, "branches"), token.Branches)
+	v.globs(at(p, "targets"), token.Targets)
+	v.globs(at(p, "params"), token.Params)
+	if token.NotBefore != nil && token.ExpiresAt != nil && !token.NotBefore.Before(*token.ExpiresAt) {
+		v.errorf(at(p, "expires_at"), "must be after not_before")
+	}
+}
+
+// listen checks an address like host:port
+func (v *validator) listen(p []string, address string) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		v.errorf(p, "invalid listen address %q: %s", address, err)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		v.errorf(p, "invalid port %q", port)
+	}
+}
+
+func (v *validator) server(p []string, c *core.ServerConfig) {
+	v.positive(at(p, "read_header_timeout"), int64(c.ReadHeaderTimeout))
+	v.positive(at(p, "read_timeout"), int64(c.ReadTimeout))
+	v.positive(at(p, "write_timeout"), int64(c.WriteTimeout))
+	v.positive(at(p, "idle_timeout"), int64(c.IdleTimeout))
+	v.positive(at(p, "max_header_bytes"), int64(c.MaxHeaderBytes))
+	v.positive(at(p, "max_body_bytes"), c.MaxBodyBytes)
+	v.positive(at(p, "shutdown_timeout"), int64(c.ShutdownTimeout))
+}
+
+func (v *validator) tls(p []string, c *core.TLSConfig) {
+	if c.Cert == "" {
+		v.errorf(at(p, "cert"), "cert is required")
+	}
+	if c.Key == "" {
+		v.errorf(at(p, "key"), "key is required")
+	}
+	oneOf(v, at(p, "min_version"), c.MinVersion, tlsVersions)
+	if len(c.ClientCerts) > 0 && c.ClientCA == "" {
+		v.errorf(at(p, "client_certs"), "client_certs require client_ca")
+	}
+	for i, cert := range c.ClientCerts {
+		if null(v, at(p, "client_certs", i), cert) {
+			continue
+		}
+		if cert.Subject == "" {
+			v.errorf(at(p, "client_certs", i, "subject"), "subject is required")
+		}
+		if len(cert.Repos) == 0 {
+			v.errorf(at(p, "client_certs", i, "repos"), "no repositories configured")
+		}
+		for j, repo := range cert.Repos {
+			v.repo(at(p, "client_certs", i, "repos", j), repo, true)
+		}
+	}
+}
+
+// triggers checks triggers of rules, they require explicit repositories
+func (v *validator) triggers(p []string, triggers []*core.Trigger) {
+	if len(triggers) == 0 {
+		v.errorf(p, "no triggers configured")
+	}
+	for i, t := range triggers {
+		if null(v, at(p, i), t) {
+			continue
+		}
+		v.repo(at(p, i, "repo"), t.Repo, false)
+		if t.Action != "" && !contains(actions, t.Action) {
+			v.errorf(at(p, i, "action"), "invalid value %s, expected one of %v", t.Action, actions)
+		} else if err := core.Validate(t); err != nil {
+			v.errorf(at(p, i), "fields do not fit action %s", t.GetAction())
+		}
+	}
+}
+
+func (v *validator) webhooks(p []string, c *core.WebhooksConfig) {
+	for provider, secret := range c.Secrets {
+		oneOf(v, at(p, "secrets", provider), provider, webhookProviders)
+		if secret == "" {
+			v.errorf(at(p, "secrets", provider), "secret is required")
+		}
+	}
+	for i, rule := range c.Rules {
+		rp := at(p, "rules", i)
+		if null(v, rp, rule) {
+			continue
+		}
+		oneOf(v, at(rp, "provider"), rule.Provider, webhookProviders)
+		if rule.Provider != "" && c.Secrets[rule.Provider] == "" {
+			v.errorf(at(rp, "provider"), "no secret configured for %s", rule.Provider)
+		}
+		v.repo(at(rp, "repo"), rule.Repo, true)
+		oneOf(v, at(rp, "event"), rule.Event, webhookEvents)
+		v.globs(at(rp, "ref"), []string{rule.Ref})
+		v.triggers(at(rp, "trigger"), rule.Trigger)
+	}
+}
+
+func (v *validator) droneWebhook(p []string, c *core.DroneWebhookConfig) {
+	if c.Secret == "" {
+		v.errorf(at(p, "secret"), "secret is required")
+	}
+	for i, followup := range c.Followups {
+		fp := at(p, "followups", i)
+		if null(v, fp, followup) {
+			continue
+		}
+		v.repo(at(fp, "repo"), followup.Repo, true)
+		v.globs(at(fp, "branch"), []string{followup.Branch})
+		for j, notify := range followup.Notify {
+			v.url(at(fp, "notify", j), notify)
+		}
+		if len(followup.Notify) == 0 || len(followup.Trigger) > 0 {
+			v.triggers(at(fp, "trigger"), followup.Trigger)
+		}
+	}
+}
+
+func (v *validator) chains(p []string, c *core.ChainsConfig) {
+	v.positive(at(p, "concurrency"), int64(c.Concurrency))
+	for i, rule := range c.Rules {
+		rp := at(p, "rules", i)
+		if null(v, rp, rule) {
+			continue
+		}
+		v.repo(at(rp, "repo"), rule.Repo, true)
+		v.globs(at(rp, "branch"), []string{rule.Branch})
+		v.triggers(at(rp, "trigger"), rule.Trigger)
+	}
+	if err := checkChainCycles(c.Rules); err != nil {
+		v.errorf(at(p, "rules"), "%s", err)
+	}
+}
+
+func (v *validator) promotion(p []string, rule *core.PromotionRule) {
+	v.repo(at(p, "repo"), rule.Repo, true)
+	if rule.Target == "" {
+		v.errorf(at(p, "target"), "target is required")
+	}
+	v.globs(at(p, "branch"), []string{rule.Branch})
+	v.globs(at(p, "tag"), []string{rule.Tag})
+}
@@ -1,14 +1,211 @@
 package core
 
+import (
+	"fmt"
+	"time"
+)
+
 type (
 	Config struct {
 		Url   string     `yaml:"url"`
 		Token string     `yaml:"token"`
 		Web   *WebConfig `yaml:"web"`
+		Log   *LogConfig `yaml:"log"`
+	}
+
+	// LogConfig selects the log format (text or json) and the minimum level
+	// (debug, info, warn or error)
+	LogConfig struct {
+		Format string `yaml:"format"`
+		Level  string `yaml:"level"`
 	}
 
 	WebConfig struct {
-		BearerToken map[string]string `yaml:"bearer_token"`
-		Listen      string            `yaml:"listen"`
+		BearerToken      map[string]Tokens        `yaml:"bearer_token"`
+		Listen           string                   `yaml:"listen"`
+		MetricsListen    string                   `yaml:"metrics_listen"`
+		ExpiryWarning    time.Duration            `yaml:"expiry_warning"`
+		AdminToken       string                   `yaml:"admin_token"`
+		TokenStore       string                   `yaml:"token_store"`
+		AuditLog         string                   `yaml:"audit_log"`
+		Webhooks         *WebhooksConfig          `yaml:"webhooks"`
+		DroneWebhook     *DroneWebhookConfig      `yaml:"drone_webhook"`
+		Chains           *ChainsConfig            `yaml:"chains"`
+		Promotions       []*PromotionRule         `yaml:"promotions"`
+		BatchConcurrency int                      `yaml:"batch_concurrency"`
+		BatchMaxItems    int                      `yaml:"batch_max_items"`
+		IdempotencyTTL   time.Duration            `yaml:"idempotency_ttl"`
+		DuplicateWindow  time.Duration            `yaml:"duplicate_window"`
+		Debounce         map[string]time.Duration `yaml:"debounce"`
+		RateLimits       *RateLimitsConfig        `yaml:"rate_limits"`
+		TrustedProxies   []string                 `yaml:"trusted_proxies"`
+		Jobs             *JobsConfig              `yaml:"jobs"`
+		Server           ServerConfig             `yaml:"server"`
+		TLS              *TLSConfig               `yaml:"tls"`
+	}
+
+	// TLSConfig serves https, the certificate is reloaded when its files
+	// change. Clients verified by ClientCA authenticate with ClientCerts
+	// instead of bearer tokens.
+	TLSConfig struct {
+		Cert        string        `yaml:"cert"`
+		Key         string        `yaml:"key"`
+		MinVersion  string        `yaml:"min_version"`
+		ClientCA    string        `yaml:"client_ca"`
+		ClientCerts []*ClientCert `yaml:"client_certs"`
+	}
+
+	// ClientCert allows the client certificate with Subject, its common name
+	// or distinguished name, to trigger the repositories matching Repos
+	ClientCert struct {
+		Subject string   `yaml:"subject"`
+		Repos   []string `yaml:"repos"`
+	}
+
+	// ServerConfig hardens the http server
+	ServerConfig struct {
+		ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+		ReadTimeout       time.Duration `yaml:"read_timeout"`
+		WriteTimeout      time.Duration `yaml:"write_timeout"`
+		IdleTimeout       time.Duration `yaml:"idle_timeout"`
+		MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+		MaxBodyBytes      int64         `yaml:"max_body_bytes"`
+		// ShutdownTimeout is the deadline to drain requests and jobs
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	}
+
+	// JobsConfig configures the asynchronous processing of triggers
+	JobsConfig struct {
+		Workers      int           `yaml:"workers"`
+		QueueSize    int           `yaml:"queue_size"`
+		Store        string        `yaml:"store"`
+		MaxAttempts  int           `yaml:"max_attempts"`
+		RetryDelay   time.Duration `yaml:"retry_delay"`
+		MaxScheduled int           `yaml:"max_scheduled"`
+	}
+
+	// RateLimitsConfig configures token bucket limits for triggers
+	RateLimitsConfig struct {
+		Repo  *RateLimit `yaml:"repo"`
+		Token *RateLimit `yaml:"token"`
+		IP    *RateLimit `yaml:"ip"`
+	}
+
+	// RateLimit allows Requests per Per with bursts of up to Burst requests
+	RateLimit struct {
+		Requests int           `yaml:"requests"`
+		Per      time.Duration `yaml:"per"`
+		Burst    int           `yaml:"burst"`
+	}
+
+	// PromotionRule promotes successful builds automatically
+	PromotionRule struct {
+		Name    string            `yaml:"name"`
+		Enabled bool              `yaml:"enabled"`
+		DryRun  bool              `yaml:"dry_run"`
+		Repo    string            `yaml:"repo"`
+		Event   string            `yaml:"event"`
+		Branch  string            `yaml:"branch"`
+		Tag     string            `yaml:"tag"`
+		Target  string            `yaml:"target"`
+		Params  map[string]string `yaml:"params"`
+	}
+
+	// ChainsConfig configures downstream triggers after successful builds
+	ChainsConfig struct {
+		Concurrency int          `yaml:"concurrency"`
+		RunStore    string       `yaml:"run_store"`
+		Rules       []*ChainRule `yaml:"rules"`
 	}
+
+	// ChainRule triggers downstream builds when a matching build succeeded
+	ChainRule struct {
+		Name    string     `yaml:"name"`
+		Repo    string     `yaml:"repo"`
+		Branch  string     `yaml:"branch"`
+		Event   string     `yaml:"event"`
+		Trigger []*Trigger `yaml:"trigger"`
+	}
+
+	// DroneWebhookConfig configures the receiver of drone global webhooks
+	DroneWebhookConfig struct {
+		Secret     string      `yaml:"secret"`
+		BuildStore string      `yaml:"build_store"`
+		Followups  []*Followup `yaml:"followups"`
+	}
+
+	// Followup runs when a matching build finished
+	Followup struct {
+		Name    string     `yaml:"name"`
+		Repo    string     `yaml:"repo"`
+		Branch  string     `yaml:"branch"`
+		Event   string     `yaml:"event"`
+		Status  []string   `yaml:"status"`
+		Notify  []string   `yaml:"notify"`
+		Trigger []*Trigger `yaml:"trigger"`
+	}
+
+	// WebhooksConfig configures webhooks of git providers
+	WebhooksConfig struct {
+		Secrets map[string]string `yaml:"secrets"`
+		Rules   []*WebhookRule    `yaml:"rules"`
+	}
+
+	// WebhookRule maps a git provider event onto drone triggers
+	WebhookRule struct {
+		Name     string     `yaml:"name"`
+		Provider string     `yaml:"provider"`
+		Repo     string     `yaml:"repo"`
+		Event    string     `yaml:"event"`
+		Ref      string     `yaml:"ref"`
+		Trigger  []*Trigger `yaml:"trigger"`
+	}
+
+	// Token is a named bearer token for a repository. Empty restrictions
+	// allow everything.
+	Token struct {
+		Name      string     `yaml:"name" json:"name"`
+		Token     string     `yaml:"token" json:"token,omitempty"`
+		Actions   []Action   `yaml:"actions" json:"actions,omitempty"`
+		Branches  []string   `yaml:"branches" json:"branches,omitempty"`
+		Targets   []string   `yaml:"targets" json:"targets,omitempty"`
+		Params    []string   `yaml:"params" json:"params,omitempty"`
+		NotBefore *time.Time `yaml:"not_before" json:"not_before,omitempty"`
+		ExpiresAt *time.Time `yaml:"expires_at" json:"expires_at,omitempty"`
+	}
+
+	// Tokens are all tokens configured for a repository
+	Tokens []*Token
 )
+
+// Valid checks if the token may be used at the given time
+func (t *Token) Valid(now time.Time) bool {
+	if t.NotBefore != nil && now.Before(*t.NotBefore) {
+		return false
+	}
+	if t.ExpiresAt != nil && !now.Before(*t.ExpiresAt) {
+		return false
+	}
+	return true
+}
+
+// UnmarshalYAML allows to configure a single unrestricted token as plain
+// string in addition to a list of tokens
+func (t *Tokens) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	token := ""
+	if err := unmarshal(&token); err == nil {
+		*t = Tokens{{Name: "default", Token: token}}
+		return nil
+	}
+	tokens := []*Token{}
+	if err := unmarshal(&tokens); err != nil {
+		return err
+	}
+	for i, token := range tokens {
+		if token != nil && token.Name == "" {
+			token.Name = fmt.Sprintf("token-%d", i)
+		}
+	}
+	*t = tokens
+	return nil
+}
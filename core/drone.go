@@ -1,5 +1,14 @@
 package core
 
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
 type (
 	// Build is a Drone build
 	Build struct {
@@ -9,18 +18,145 @@ type (
 		After   string `json:"after"`
 		Source  string `json:"source"`
 		Event   string `json:"event"`
+		// Parent is the build which was restarted or promoted
+		Parent int64 `json:"parent"`
+	}
+
+	// Repo is a Drone repository
+	Repo struct {
+		Slug          string `json:"slug"`
+		Namespace     string `json:"namespace"`
+		Name          string `json:"name"`
+		Active        bool   `json:"active"`
+		DefaultBranch string `json:"default_branch"`
+	}
+
+	// User is the Drone user of the token
+	User struct {
+		Login   string `json:"login"`
+		Admin   bool   `json:"admin"`
+		Message string `json:"message"`
 	}
 
 	// Drone is a api client for Drone
 	Drone interface {
-		PromoteLastBuild(repo, ref, target string) (*Build, error)
-		PromoteLastTag(repo, target string) (*Build, error)
-		Promote(repo, target string, buildID int64) (*Build, error)
-		RebuildLastBuild(repo, ref string) (*Build, error)
-		RebuildLastTag(repo string) (*Build, error)
+		PromoteLastBuild(ctx context.Context, repo, ref, target string, params map[string]string) (*Build, error)
+		PromoteLastTag(ctx context.Context, repo, target string, params map[string]string) (*Build, error)
+		Promote(ctx context.Context, repo, target string, buildID int64, params map[string]string) (*Build, error)
+		Rollback(ctx context.Context, repo, target string, buildID int64, params map[string]string) (*Build, error)
+		RebuildLastBuild(ctx context.Context, repo, ref string, params map[string]string) (*Build, error)
+		RebuildLastTag(ctx context.Context, repo string, params map[string]string) (*Build, error)
+		Cancel(ctx context.Context, repo string, buildID int64) (*Build, error)
+		Branches(ctx context.Context, repo string) ([]*Build, error)
+		User(ctx context.Context) (*User, error)
 	}
 )
 
+// ErrInvalidTrigger is returned for triggers with missing or conflicting fields
+var ErrInvalidTrigger = errors.New("invalid request")
+
+// APIError is an error response of the drone api
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Temporary checks if a failed drone call may succeed when retried, this
+// applies to transport errors and server errors of the api
+func Temporary(err error) bool {
+	apiErr := &APIError{}
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == 429
+	}
+	urlErr := &url.Error{}
+	return errors.As(err, &urlErr)
+}
+
 func (b *Build) GetMessage() string {
 	return b.Message
 }
+
+func (u *User) GetMessage() string {
+	return u.Message
+}
+
+// Dispatch calls the drone api matching the trigger
+func Dispatch(ctx context.Context, d Drone, t *Trigger) (*Build, error) {
+	if err := Validate(t); err != nil {
+		return nil, err
+	}
+	switch t.GetAction() {
+	case ACTION_REBUILD:
+		if t.Release {
+			return d.RebuildLastTag(ctx, t.Repo, t.Params)
+		}
+		return d.RebuildLastBuild(ctx, t.Repo, t.Branch, t.Params)
+	case ACTION_PROMOTE:
+		if t.BuildID != 0 {
+			return d.Promote(ctx, t.Repo, t.Target, t.BuildID, t.Params)
+		}
+		if t.Release {
+			return d.PromoteLastTag(ctx, t.Repo, t.Target, t.Params)
+		}
+		return d.PromoteLastBuild(ctx, t.Repo, t.Branch, t.Target, t.Params)
+	case ACTION_ROLLBACK:
+		return d.Rollback(ctx, t.Repo, t.Target, t.BuildID, t.Params)
+	case ACTION_CANCEL:
+		return d.Cancel(ctx, t.Repo, t.BuildID)
+	}
+	return nil, ErrInvalidTrigger
+}
+
+// Validate checks if the fields of a trigger fit its action
+func Validate(t *Trigger) error {
+	if t == nil {
+		return ErrInvalidTrigger
+	}
+	switch t.GetAction() {
+	case ACTION_REBUILD:
+		if t.Target != "" {
+			return ErrInvalidTrigger
+		}
+	case ACTION_PROMOTE:
+		if t.Target == "" {
+			return ErrInvalidTrigger
+		}
+	case ACTION_ROLLBACK:
+		if t.Target == "" || t.BuildID == 0 {
+			return ErrInvalidTrigger
+		}
+	case ACTION_CANCEL:
+		if t.BuildID == 0 {
+			return ErrInvalidTrigger
+		}
+	default:
+		return ErrInvalidTrigger
+	}
+	return nil
+}
+
+// IsGlob checks if a string contains glob characters
+func IsGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// MatchBranches returns the sorted branches of push builds matching glob
+func MatchBranches(builds []*Build, glob string) []string {
+	seen := map[string]bool{}
+	branches := []string{}
+	for _, build := range builds {
+		if build.Event != "push" || seen[build.Source] {
+			continue
+		}
+		if ok, _ := path.Match(glob, build.Source); ok {
+			seen[build.Source] = true
+			branches = append(branches, build.Source)
+		}
+	}
+	sort.Strings(branches)
+	return branches
+}
@@ -1,6 +1,52 @@
 package core
 
-type JsonResponse struct {
-	Status string `json:"status"`
-	Err    string `json:"error"`
+type (
+	JsonResponse struct {
+		Status string      `json:"status"`
+		Err    string      `json:"error"`
+		Data   interface{} `json:"data,omitempty"`
+	}
+
+	// Action is an operation a token may perform
+	Action string
+
+	// Trigger describes a drone operation
+	Trigger struct {
+		Repo    string            `json:"repo" yaml:"repo"`
+		Branch  string            `json:"branch" yaml:"branch"`
+		Release bool              `json:"release" yaml:"release"`
+		Target  string            `json:"target" yaml:"target"`
+		BuildID int64             `json:"build_id" yaml:"build_id"`
+		Action  Action            `json:"action" yaml:"action"`
+		Params  map[string]string `json:"params" yaml:"params"`
+	}
+
+	// TriggerResult is the outcome of a single trigger
+	TriggerResult struct {
+		Repo      string `json:"repo"`
+		Branch    string `json:"branch,omitempty"`
+		Target    string `json:"target,omitempty"`
+		Build     int64  `json:"build,omitempty"`
+		Duplicate bool   `json:"duplicate,omitempty"`
+		Debounced bool   `json:"debounced,omitempty"`
+		Err       string `json:"error,omitempty"`
+	}
+)
+
+const (
+	ACTION_REBUILD  Action = "rebuild"
+	ACTION_PROMOTE  Action = "promote"
+	ACTION_ROLLBACK Action = "rollback"
+	ACTION_CANCEL   Action = "cancel"
+)
+
+// GetAction returns the requested action, defaults to rebuild or promote
+func (t *Trigger) GetAction() Action {
+	if t.Action != "" {
+		return t.Action
+	}
+	if t.Target != "" {
+		return ACTION_PROMOTE
+	}
+	return ACTION_REBUILD
 }
@@ -1,13 +1,17 @@
 package drone
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"time"
 
 	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
 )
 
 type (
@@ -39,11 +43,62 @@ func New(url string, token string) *Drone {
 	}
 }
 
+// Repos lists all repositories of the user
+func (d *Drone) Repos(ctx context.Context) (repos []*core.Repo, err error) {
+	url := fmt.Sprintf("%s/api/user/repos", d.url)
+	repos = []*core.Repo{}
+	err = d.request(ctx, "repos", "GET", url, nil, &repos)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// User returns the user of the token, used to check connectivity
+func (d *Drone) User(ctx context.Context) (user *core.User, err error) {
+	url := fmt.Sprintf("%s/api/user", d.url)
+	user = &core.User{}
+	err = d.request(ctx, "user", "GET", url, nil, user)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// FilterRepos selects repositories by namespace, slug glob and active flag
+func FilterRepos(repos []*core.Repo, namespace, glob string, activeOnly bool) []*core.Repo {
+	filtered := []*core.Repo{}
+	for _, repo := range repos {
+		if namespace != "" && repo.Namespace != namespace {
+			continue
+		}
+		if ok, _ := path.Match(glob, repo.Slug); glob != "" && !ok {
+			continue
+		}
+		if activeOnly && !repo.Active {
+			continue
+		}
+		filtered = append(filtered, repo)
+	}
+	return filtered
+}
+
 // Builds lists all builds
-func (d *Drone) Builds(repo string, page int) (builds []*core.Build, err error) {
+func (d *Drone) Builds(ctx context.Context, repo string, page int) (builds []*core.Build, err error) {
 	url := fmt.Sprintf("%s/api/repos/%s/builds?page=%d", d.url, repo, page)
 	builds = []*core.Build{}
-	err = d.request("GET", url, nil, &builds)
+	err = d.request(ctx, "builds", "GET", url, nil, &builds)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Branches lists the latest build of every branch
+func (d *Drone) Branches(ctx context.Context, repo string) (builds []*core.Build, err error) {
+	url := fmt.Sprintf("%s/api/repos/%s/builds/branches", d.url, repo)
+	builds = []*core.Build{}
+	err = d.request(ctx, "branches", "GET", url, nil, &builds)
 	if err != nil {
 		return nil, err
 	}
@@ -51,14 +106,14 @@ func (d *Drone) Builds(repo string, page int) (builds []*core.Build, err error)
 }
 
 // Builds gets the last build for a specific branc
-func (d *Drone) LastBuild(repo string, branch string, kind BuildKind) (b *core.Build, err error) {
+func (d *Drone) LastBuild(ctx context.Context, repo string, branch string, kind BuildKind) (b *core.Build, err error) {
 	if branch != "" {
 		if kind == BUILD_TAG {
 			return nil, fmt.Errorf("unable to build tag with branch filter")
 		}
 		url := fmt.Sprintf("%s/api/repos/%s/builds/latest?branch=%s", d.url, repo, branch)
 		b = &core.Build{}
-		err = d.request("GET", url, nil, b)
+		err = d.request(ctx, "latest", "GET", url, nil, b)
 		if err != nil {
 			return nil, err
 		}
@@ -69,7 +124,8 @@ func (d *Drone) LastBuild(repo string, branch string, kind BuildKind) (b *core.B
 	page := 0
 	for b == nil {
 		page += 1
-		builds, err := d.Builds(repo, page)
+		lastBuildPages.Inc(string(kind))
+		builds, err := d.Builds(ctx, repo, page)
 		if err != nil {
 			return nil, err
 		}
@@ -90,10 +146,12 @@ func (d *Drone) LastBuild(repo string, branch string, kind BuildKind) (b *core.B
 }
 
 // Trigger restarts a existing build by buildId
-func (d *Drone) Trigger(repo string, buildId int64) (b *core.Build, err error) {
-	url := fmt.Sprintf("%s/api/repos/%s/builds/%d?DRONETRIGGER=true", d.url, repo, buildId)
+func (d *Drone) Trigger(ctx context.Context, repo string, buildId int64, params map[string]string) (b *core.Build, err error) {
+	query := buildParams(params)
+	query.Set("DRONETRIGGER", "true")
+	url := fmt.Sprintf("%s/api/repos/%s/builds/%d?%s", d.url, repo, buildId, query.Encode())
 	b = &core.Build{}
-	err = d.request("POST", url, nil, b)
+	err = d.request(ctx, "trigger", "POST", url, nil, b)
 	if err != nil {
 		return nil, err
 	}
@@ -101,12 +159,12 @@ func (d *Drone) Trigger(repo string, buildId int64) (b *core.Build, err error) {
 }
 
 // RebuildLastBuild restarts the last build of a ref
-func (d *Drone) RebuildLastBuild(repo string, branch string) (build *core.Build, err error) {
-	lastBuild, err := d.LastBuild(repo, branch, BUILD_PUSH)
+func (d *Drone) RebuildLastBuild(ctx context.Context, repo string, branch string, params map[string]string) (build *core.Build, err error) {
+	lastBuild, err := d.LastBuild(ctx, repo, branch, BUILD_PUSH)
 	if err != nil {
 		return nil, err
 	}
-	build, err = d.Trigger(repo, lastBuild.Number)
+	build, err = d.Trigger(ctx, repo, lastBuild.Number, params)
 	if err != nil {
 		return nil, err
 	}
@@ -114,12 +172,12 @@ func (d *Drone) RebuildLastBuild(repo string, branch string) (build *core.Build,
 }
 
 // RebuildLastTag restart the last tag build
-func (d *Drone) RebuildLastTag(repo string) (build *core.Build, err error) {
-	lastBuild, err := d.LastBuild(repo, "", BUILD_TAG)
+func (d *Drone) RebuildLastTag(ctx context.Context, repo string, params map[string]string) (build *core.Build, err error) {
+	lastBuild, err := d.LastBuild(ctx, repo, "", BUILD_TAG)
 	if err != nil {
 		return nil, err
 	}
-	build, err = d.Trigger(repo, lastBuild.Number)
+	build, err = d.Trigger(ctx, repo, lastBuild.Number, params)
 	if err != nil {
 		return nil, err
 	}
@@ -127,10 +185,36 @@ func (d *Drone) RebuildLastTag(repo string) (build *core.Build, err error) {
 }
 
 // Promote promotes an existing build to specified target
-func (d *Drone) Promote(repo, target string, buildId int64) (b *core.Build, err error) {
-	url := fmt.Sprintf("%s/api/repos/%s/builds/%d/promote?target=%s", d.url, repo, buildId, target)
+func (d *Drone) Promote(ctx context.Context, repo, target string, buildId int64, params map[string]string) (b *core.Build, err error) {
+	query := buildParams(params)
+	query.Set("target", target)
+	url := fmt.Sprintf("%s/api/repos/%s/builds/%d/promote?%s", d.url, repo, buildId, query.Encode())
 	b = &core.Build{}
-	err = d.request("POST", url, nil, b)
+	err = d.request(ctx, "promote", "POST", url, nil, b)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Rollback rolls back specified target to an existing build
+func (d *Drone) Rollback(ctx context.Context, repo, target string, buildId int64, params map[string]string) (b *core.Build, err error) {
+	query := buildParams(params)
+	query.Set("target", target)
+	url := fmt.Sprintf("%s/api/repos/%s/builds/%d/rollback?%s", d.url, repo, buildId, query.Encode())
+	b = &core.Build{}
+	err = d.request(ctx, "rollback", "POST", url, nil, b)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Cancel cancels a running build
+func (d *Drone) Cancel(ctx context.Context, repo string, buildId int64) (b *core.Build, err error) {
+	url := fmt.Sprintf("%s/api/repos/%s/builds/%d", d.url, repo, buildId)
+	b = &core.Build{Number: buildId}
+	err = d.request(ctx, "cancel", "DELETE", url, nil, b)
 	if err != nil {
 		return nil, err
 	}
@@ -138,12 +222,12 @@ func (d *Drone) Promote(repo, target string, buildId int64) (b *core.Build, err
 }
 
 // PromoteLastBuild runs promote on the last build of a ref
-func (d *Drone) PromoteLastBuild(repo, ref, target string) (build *core.Build, err error) {
-	lastBuild, err := d.LastBuild(repo, ref, BUILD_PUSH)
+func (d *Drone) PromoteLastBuild(ctx context.Context, repo, ref, target string, params map[string]string) (build *core.Build, err error) {
+	lastBuild, err := d.LastBuild(ctx, repo, ref, BUILD_PUSH)
 	if err != nil {
 		return nil, err
 	}
-	build, err = d.Promote(repo, target, lastBuild.Number)
+	build, err = d.Promote(ctx, repo, target, lastBuild.Number, params)
 	if err != nil {
 		return nil, err
 	}
@@ -151,20 +235,38 @@ func (d *Drone) PromoteLastBuild(repo, ref, target string) (build *core.Build, e
 }
 
 // PromoteLastTag urns promote on the last tag build
-func (d *Drone) PromoteLastTag(repo, target string) (build *core.Build, err error) {
-	lastBuild, err := d.LastBuild(repo, "", BUILD_TAG)
+func (d *Drone) PromoteLastTag(ctx context.Context, repo, target string, params map[string]string) (build *core.Build, err error) {
+	lastBuild, err := d.LastBuild(ctx, repo, "", BUILD_TAG)
 	if err != nil {
 		return nil, err
 	}
-	build, err = d.Promote(repo, target, lastBuild.Number)
+	build, err = d.Promote(ctx, repo, target, lastBuild.Number, params)
 	if err != nil {
 		return nil, err
 	}
 	return
 }
 
-func (d *Drone) request(method string, url string, body io.Reader, result interface{}) (err error) {
-	req, err := http.NewRequest(method, url, body)
+// buildParams converts build parameters to query values
+func buildParams(params map[string]string) url.Values {
+	query := url.Values{}
+	for key, value := range params {
+		query.Set(key, value)
+	}
+	return query
+}
+
+// request calls the drone api, the latency and errors are recorded by
+// endpoint. The request ID of ctx is forwarded.
+func (d *Drone) request(ctx context.Context, endpoint, method, url string, body io.Reader, result interface{}) (err error) {
+	start := time.Now()
+	defer func() {
+		requestDuration.Observe(time.Since(start).Seconds(), endpoint)
+		if err != nil {
+			requestErrors.Inc(endpoint)
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return err
 	}
@@ -172,6 +274,9 @@ func (d *Drone) request(method string, url string, body io.Reader, result interf
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	}
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", d.token))
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.REQUEST_ID_HEADER, id)
+	}
 	resp, err := d.client.Do(req)
 	if err != nil {
 		return err
@@ -179,13 +284,17 @@ func (d *Drone) request(method string, url string, body io.Reader, result interf
 	defer resp.Body.Close()
 
 	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err == io.EOF {
+		// some endpoints (i.e. cancel) respond without a body
+		err = nil
+	}
 	if resp.StatusCode >= 400 {
 		m, ok := result.(message)
 		msg := resp.Status
 		if ok && m.GetMessage() != "" {
 			msg = fmt.Sprintf("%d %s", resp.StatusCode, m.GetMessage())
 		}
-		err = errors.New(msg)
+		err = &core.APIError{StatusCode: resp.StatusCode, Message: msg}
 		return err
 	}
 	return err
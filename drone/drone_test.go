@@ -1,6 +1,7 @@
 package drone
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
 	"github.com/golang/mock/gomock"
 	check "gopkg.in/check.v1"
 )
@@ -29,7 +31,7 @@ func (s *TestSuite) TestApiFails(c *check.C) {
 	server := httptest.NewServer(nil)
 	d := New(server.URL, "")
 
-	_, err := d.LastBuild("test/test", "master", BUILD_TAG)
+	_, err := d.LastBuild(context.Background(), "test/test", "master", BUILD_TAG)
 	c.Assert(err, check.DeepEquals, fmt.Errorf("unable to build tag with branch filter"))
 }
 
@@ -53,31 +55,37 @@ func (s *TestSuite) TestFails(c *check.C) {
 	d := New(server.URL, "")
 
 	// 5xx
-	_, err := d.Builds("test/test", 1)
-	c.Assert(err, check.DeepEquals, fmt.Errorf("500 Internal Server Error"))
+	_, err := d.Builds(context.Background(), "test/test", 1)
+	c.Assert(err, check.DeepEquals, &core.APIError{StatusCode: 500, Message: "500 Internal Server Error"})
 
-	_, err = d.LastBuild("test/test", "", BUILD_PUSH)
-	c.Assert(err, check.DeepEquals, fmt.Errorf("500 Internal Server Error"))
+	_, err = d.LastBuild(context.Background(), "test/test", "", BUILD_PUSH)
+	c.Assert(err, check.DeepEquals, &core.APIError{StatusCode: 500, Message: "500 Internal Server Error"})
 
-	_, err = d.Trigger("test/test", 1337)
-	c.Assert(err, check.DeepEquals, fmt.Errorf("500 Internal Server Error"))
+	_, err = d.Trigger(context.Background(), "test/test", 1337, nil)
+	c.Assert(err, check.DeepEquals, &core.APIError{StatusCode: 500, Message: "500 Internal Server Error"})
 
-	_, err = d.Trigger("with/error", 42)
-	c.Assert(err, check.DeepEquals, fmt.Errorf("500 Error description"))
+	_, err = d.Trigger(context.Background(), "with/error", 42, nil)
+	c.Assert(err, check.DeepEquals, &core.APIError{StatusCode: 500, Message: "500 Error description"})
+	c.Assert(core.Temporary(err), check.Equals, true)
 
 	// 404s
-	_, err = d.LastBuild("not/found", "", BUILD_PUSH)
-	c.Assert(err, check.DeepEquals, fmt.Errorf("404 Not Found"))
+	_, err = d.LastBuild(context.Background(), "not/found", "", BUILD_PUSH)
+	c.Assert(err, check.DeepEquals, &core.APIError{StatusCode: 404, Message: "404 Not Found"})
 
-	_, err = d.LastBuild("not/found", "master", BUILD_PUSH)
-	c.Assert(err, check.DeepEquals, fmt.Errorf("404 Not Found"))
+	_, err = d.LastBuild(context.Background(), "not/found", "master", BUILD_PUSH)
+	c.Assert(err, check.DeepEquals, &core.APIError{StatusCode: 404, Message: "404 Not Found"})
 
-	_, err = d.Builds("not/found", 1)
-	c.Assert(err, check.DeepEquals, fmt.Errorf("404 Not Found"))
+	_, err = d.Builds(context.Background(), "not/found", 1)
+	c.Assert(err, check.DeepEquals, &core.APIError{StatusCode: 404, Message: "404 Not Found"})
 
-	_, err = d.Trigger("not/found", 23)
-	c.Assert(err, check.DeepEquals, fmt.Errorf("404 Not Found"))
+	_, err = d.Trigger(context.Background(), "not/found", 23, nil)
+	c.Assert(err, check.DeepEquals, &core.APIError{StatusCode: 404, Message: "404 Not Found"})
+	c.Assert(core.Temporary(err), check.Equals, false)
 
+	// transport errors
+	server.Close()
+	_, err = d.Trigger(context.Background(), "test/test", 1337, nil)
+	c.Assert(core.Temporary(err), check.Equals, true)
 }
 
 func (s *TestSuite) TestHandler(c *check.C) {
@@ -108,7 +116,7 @@ func (s *TestSuite) TestHandler(c *check.C) {
 
 	d := New(server.URL, token)
 
-	builds, err := d.Builds("bitsbeats/drone-test", 1)
+	builds, err := d.Builds(context.Background(), "bitsbeats/drone-test", 1)
 	buildsWant := []*core.Build{
 		&core.Build{
 			Message: "use alpine",
@@ -139,19 +147,19 @@ func (s *TestSuite) TestHandler(c *check.C) {
 	c.Assert(builds, check.DeepEquals, buildsWant)
 
 	// check list builds
-	latest, err := d.LastBuild("bitsbeats/drone-test", "master", BUILD_PUSH)
+	latest, err := d.LastBuild(context.Background(), "bitsbeats/drone-test", "master", BUILD_PUSH)
 	latestWant := buildsWant[0]
 	c.Assert(err, check.Equals, nil)
 	c.Assert(latest, check.DeepEquals, latestWant)
 
 	// check list builds for non-existing build tags
-	latest, err = d.LastBuild("bitsbeats/drone-test", "", BUILD_TAG)
+	latest, err = d.LastBuild(context.Background(), "bitsbeats/drone-test", "", BUILD_TAG)
 	c.Assert(err, check.DeepEquals, fmt.Errorf("unable to find matching build"))
 	c.Assert(latest, check.Equals, (*core.Build)(nil))
 
 	// check rebuild last build
 	c.Assert(buildWasStarted, check.Equals, false) // no one should have restared by now
-	build, err := d.RebuildLastBuild("bitsbeats/drone-test", "")
+	build, err := d.RebuildLastBuild(context.Background(), "bitsbeats/drone-test", "", nil)
 	buildWant := &core.Build{
 		Message: "use alpine",
 		Number:  59,
@@ -201,19 +209,127 @@ func (s *TestSuite) TestTagHandler(c *check.C) {
 	}
 
 	// just find last build
-	latest, err := d.LastBuild("bitsbeats/drone-test", "", BUILD_TAG)
+	latest, err := d.LastBuild(context.Background(), "bitsbeats/drone-test", "", BUILD_TAG)
 	c.Assert(err, check.Equals, nil)
 	c.Assert(latest, check.DeepEquals, buildWant)
 
 	// restart last build
 	buildWant.Number = 64
 	c.Assert(buildWasStarted, check.Equals, false) // no one should have started a build
-	latest, err = d.RebuildLastTag("bitsbeats/drone-test")
+	latest, err = d.RebuildLastTag(context.Background(), "bitsbeats/drone-test", nil)
 	c.Assert(err, check.Equals, nil)
 	c.Assert(latest, check.DeepEquals, buildWant)
 	c.Assert(buildWasStarted, check.Equals, true)
 }
 
+func (s *TestSuite) TestPromoteRollbackCancel(c *check.C) {
+	token := "q1QS0m6yFYRKm6TMPKeM8js8ZMbDLjPE"
+	calls := []string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/repos/bitsbeats/drone-test/builds/58/promote", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, fmt.Sprintf("%s promote %s %s", r.Method, r.URL.Query().Get("target"), r.URL.Query().Get("VERSION")))
+		servJSON("test_files/trigger.json", token)(w, r)
+	})
+	mux.HandleFunc("/api/repos/bitsbeats/drone-test/builds/58/rollback", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, fmt.Sprintf("%s rollback %s", r.Method, r.URL.Query().Get("target")))
+		servJSON("test_files/trigger.json", token)(w, r)
+	})
+	mux.HandleFunc("/api/repos/bitsbeats/drone-test/builds/59", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, fmt.Sprintf("%s cancel", r.Method))
+	})
+	server := httptest.NewServer(mux)
+	d := New(server.URL, token)
+
+	build, err := d.Promote(context.Background(), "bitsbeats/drone-test", "production", 58, map[string]string{"VERSION": "1.0"})
+	c.Assert(err, check.Equals, nil)
+	c.Assert(build.Number, check.Equals, int64(59))
+
+	build, err = d.Rollback(context.Background(), "bitsbeats/drone-test", "production", 58, nil)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(build.Number, check.Equals, int64(59))
+
+	build, err = d.Cancel(context.Background(), "bitsbeats/drone-test", 59)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(build.Number, check.Equals, int64(59))
+
+	c.Assert(calls, check.DeepEquals, []string{
+		"POST promote production 1.0",
+		"POST rollback production",
+		"DELETE cancel",
+	})
+}
+
+func (s *TestSuite) TestRepos(c *check.C) {
+	token := "q1QS0m6yFYRKm6TMPKeM8js8ZMbDLjPE"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/user/repos", servJSON("test_files/repos.json", token))
+	server := httptest.NewServer(mux)
+	d := New(server.URL, token)
+
+	repos, err := d.Repos(context.Background())
+	c.Assert(err, check.Equals, nil)
+	c.Assert(len(repos), check.Equals, 3)
+	c.Assert(repos[0], check.DeepEquals, &core.Repo{
+		Slug:          "platform/api",
+		Namespace:     "platform",
+		Name:          "api",
+		Active:        true,
+		DefaultBranch: "main",
+	})
+
+	slugs := func(repos []*core.Repo) []string {
+		list := []string{}
+		for _, repo := range repos {
+			list = append(list, repo.Slug)
+		}
+		return list
+	}
+	c.Assert(slugs(FilterRepos(repos, "platform", "", true)), check.DeepEquals, []string{"platform/api"})
+	c.Assert(slugs(FilterRepos(repos, "platform", "", false)), check.DeepEquals, []string{"platform/api", "platform/legacy"})
+	c.Assert(slugs(FilterRepos(repos, "", "*/hello-*", true)), check.DeepEquals, []string{"octocat/hello-world"})
+
+	_, err = New(server.URL, "wrong").Repos(context.Background())
+	c.Assert(err, check.DeepEquals, &core.APIError{StatusCode: 403, Message: "403 Forbidden"})
+}
+
+func (s *TestSuite) TestBranches(c *check.C) {
+	token := "q1QS0m6yFYRKm6TMPKeM8js8ZMbDLjPE"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/repos/bitsbeats/drone-test/builds/branches", servJSON("test_files/branches.json", token))
+	server := httptest.NewServer(mux)
+	d := New(server.URL, token)
+
+	builds, err := d.Branches(context.Background(), "bitsbeats/drone-test")
+	c.Assert(err, check.Equals, nil)
+	c.Assert(len(builds), check.Equals, 3)
+	c.Assert(core.MatchBranches(builds, "release/*"), check.DeepEquals, []string{"release/1.0"})
+	c.Assert(core.MatchBranches(builds, "*"), check.DeepEquals, []string{"master"})
+}
+
+func (s *TestSuite) TestUser(c *check.C) {
+	token := "q1QS0m6yFYRKm6TMPKeM8js8ZMbDLjPE"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/user", servJSON("test_files/user.json", token))
+	server := httptest.NewServer(mux)
+
+	user, err := New(server.URL, token).User(context.Background())
+	c.Assert(err, check.Equals, nil)
+	c.Assert(user.Login, check.Equals, "octocat")
+
+	_, err = New(server.URL, "invalid").User(context.Background())
+	c.Assert(err, check.ErrorMatches, "403 Forbidden")
+
+	// request IDs are forwarded
+	requestID := ""
+	mux.HandleFunc("/api/user/repos", func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get("X-Request-ID")
+		servJSON("test_files/repos.json", token)(w, r)
+	})
+	_, err = New(server.URL, token).Repos(logging.WithRequestID(context.Background(), "abc123"))
+	c.Assert(err, check.Equals, nil)
+	c.Assert(requestID, check.Equals, "abc123")
+}
+
 func servJSON(path, token string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Authorization") != fmt.Sprintf("Bearer %s", token) {
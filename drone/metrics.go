@@ -0,0 +1,21 @@
+package drone
+
+import "github.com/bitsbeats/dronetrigger/metrics"
+
+var (
+	requestDuration = metrics.NewHistogramVec(
+		"dronetrigger_drone_request_duration_seconds",
+		"Latency of drone api calls by endpoint.",
+		nil, "endpoint",
+	)
+	requestErrors = metrics.NewCounterVec(
+		"dronetrigger_drone_request_errors_total",
+		"Failed drone api calls by endpoint.",
+		"endpoint",
+	)
+	lastBuildPages = metrics.NewCounterVec(
+		"dronetrigger_drone_last_build_pages_total",
+		"Pages of builds scanned to find the last build by build kind.",
+		"kind",
+	)
+)
@@ -1,9 +1,10 @@
 module github.com/bitsbeats/dronetrigger
 
-go 1.19
+go 1.21
 
 require (
 	github.com/golang/mock v1.6.0
+	go.uber.org/mock v0.4.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -11,5 +12,4 @@ require (
 require (
 	github.com/kr/pretty v0.2.1 // indirect
 	github.com/kr/text v0.1.0 // indirect
-	go.uber.org/mock v0.4.0 // indirect
 )
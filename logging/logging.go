@@ -0,0 +1,124 @@
+// Package logging configures structured logging and carries request IDs
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+
+	// REQUEST_ID_HEADER carries the request ID from clients and to drone
+	REQUEST_ID_HEADER = "X-Request-ID"
+)
+
+type (
+	requestIDKey struct{}
+
+	// handler adds the request ID of the context to every record
+	handler struct {
+		slog.Handler
+	}
+)
+
+// New creates a logger writing to w in the configured format and level, nil
+// uses text and info
+func New(c *core.LogConfig, w io.Writer) (*slog.Logger, error) {
+	if c == nil {
+		c = &core.LogConfig{}
+	}
+	level, err := ParseLevel(c.Level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch c.Format {
+	case FORMAT_TEXT, "":
+		h = slog.NewTextHandler(w, opts)
+	case FORMAT_JSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", c.Format)
+	}
+	return slog.New(&handler{h}), nil
+}
+
+// Setup configures the default logger, the output of the log package is
+// written by it as well
+func Setup(c *core.LogConfig, w io.Writer) error {
+	logger, err := New(c, w)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// ParseLevel parses debug, info, warn or error, empty defaults to info
+func ParseLevel(level string) (slog.Level, error) {
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	l := slog.Level(0)
+	err := l.UnmarshalText([]byte(strings.ToUpper(level)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid log level %q", level)
+	}
+	return l, nil
+}
+
+// Handle adds the request ID to the record
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{h.Handler.WithGroup(name)}
+}
+
+// TriggerAttrs returns the fields every trigger is logged with
+func TriggerAttrs(t *core.Trigger, token string, build int64) []any {
+	return []any{
+		"action", t.GetAction(),
+		"repo", t.Repo,
+		"branch", t.Branch,
+		"target", t.Target,
+		"build", build,
+		"token", token,
+	}
+}
+
+// NewRequestID generates a random request ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID returns a context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID of the context
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type TestSuite struct{}
+
+var _ = check.Suite(&TestSuite{})
+
+func (s *TestSuite) TestNew(c *check.C) {
+	out := &bytes.Buffer{}
+	logger, err := New(&core.LogConfig{Format: FORMAT_JSON, Level: "warn"}, out)
+	c.Assert(err, check.Equals, nil)
+
+	ctx := WithRequestID(context.Background(), "abc123")
+	logger.InfoContext(ctx, "hidden")
+	t := &core.Trigger{Repo: "octocat/repo", Branch: "main"}
+	logger.WarnContext(ctx, "trigger failed", TriggerAttrs(t, "ci", 0)...)
+
+	record := map[string]interface{}{}
+	c.Assert(json.Unmarshal(out.Bytes(), &record), check.Equals, nil)
+	delete(record, "time")
+	c.Assert(record, check.DeepEquals, map[string]interface{}{
+		"level":      "WARN",
+		"msg":        "trigger failed",
+		"action":     "rebuild",
+		"repo":       "octocat/repo",
+		"branch":     "main",
+		"target":     "",
+		"build":      0.0,
+		"token":      "ci",
+		"request_id": "abc123",
+	})
+
+	_, err = New(&core.LogConfig{Format: "xml"}, out)
+	c.Assert(err, check.ErrorMatches, `invalid log format "xml"`)
+	_, err = New(&core.LogConfig{Level: "loud"}, out)
+	c.Assert(err, check.ErrorMatches, `invalid log level "loud"`)
+}
+
+func (s *TestSuite) TestParseLevel(c *check.C) {
+	for level, expected := range map[string]slog.Level{
+		"":      slog.LevelInfo,
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		parsed, err := ParseLevel(level)
+		c.Assert(err, check.Equals, nil)
+		c.Assert(parsed, check.Equals, expected)
+	}
+}
+
+func (s *TestSuite) TestRequestID(c *check.C) {
+	c.Assert(RequestID(context.Background()), check.Equals, "")
+	c.Assert(RequestID(WithRequestID(context.Background(), "abc123")), check.Equals, "abc123")
+	c.Assert(NewRequestID(), check.HasLen, 16)
+	c.Assert(NewRequestID(), check.Not(check.Equals), NewRequestID())
+}
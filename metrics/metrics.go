@@ -0,0 +1,248 @@
+// Package metrics provides counters and histograms exposed in the
+// Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histograms in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Default is the registry used by the constructors
+var Default = &Registry{}
+
+type (
+	// Collector writes metrics in the Prometheus text format
+	Collector interface {
+		Write(w io.Writer) error
+	}
+
+	// Registry is a list of collectors
+	Registry struct {
+		mu         sync.Mutex
+		collectors []Collector
+	}
+
+	// CounterVec is a counter partitioned by labels
+	CounterVec struct {
+		vec
+		values map[string]float64
+	}
+
+	// HistogramVec is a histogram partitioned by labels
+	HistogramVec struct {
+		vec
+		buckets []float64
+		values  map[string]*histogram
+	}
+
+	// vec holds the common fields of metrics partitioned by labels
+	vec struct {
+		mu     sync.Mutex
+		name   string
+		help   string
+		labels []string
+		keys   map[string][]string
+	}
+
+	histogram struct {
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+)
+
+// Register adds a collector to the registry
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes all metrics of the registry
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		if err := c.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics of the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.Write(w)
+	})
+}
+
+// NewCounterVec creates a counter registered in the Default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		vec:    vec{name: name, help: help, labels: labels, keys: map[string][]string{}},
+		values: map[string]float64{},
+	}
+	Default.Register(c)
+	return c
+}
+
+// Inc increases the counter of the label values by one
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increases the counter of the label values
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(values)] += v
+}
+
+// Get returns the counter of the label values
+func (c *CounterVec) Get(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[c.lookupKey(values)]
+}
+
+// Write writes the counter
+func (c *CounterVec) Write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(out, "%s%s %s\n", c.name, c.labelString(key, "", ""), formatFloat(c.values[key]))
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// NewHistogramVec creates a histogram registered in the Default registry,
+// nil buckets use DefaultBuckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{
+		vec:     vec{name: name, help: help, labels: labels, keys: map[string][]string{}},
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+	Default.Register(h)
+	return h
+}
+
+// Observe adds a value to the histogram of the label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := h.key(values)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i] += 1
+		}
+	}
+	hist.sum += v
+	hist.count += 1
+}
+
+// Count returns the number of observations of the label values
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[h.lookupKey(values)]
+	if !ok {
+		return 0
+	}
+	return hist.count
+}
+
+// Write writes the histogram
+func (h *HistogramVec) Write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range h.sortedKeys() {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(out, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(out, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(out, "%s_sum%s %s\n", h.name, h.labelString(key, "", ""), formatFloat(hist.sum))
+		fmt.Fprintf(out, "%s_count%s %d\n", h.name, h.labelString(key, "", ""), hist.count)
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// key returns the map key of label values and remembers the values
+func (v *vec) key(values []string) string {
+	key := v.lookupKey(values)
+	if _, ok := v.keys[key]; !ok {
+		padded := make([]string, len(v.labels))
+		copy(padded, values)
+		v.keys[key] = padded
+	}
+	return key
+}
+
+// lookupKey returns the map key of label values, missing values are empty
+func (v *vec) lookupKey(values []string) string {
+	padded := make([]string, len(v.labels))
+	copy(padded, values)
+	return strings.Join(padded, "\x00")
+}
+
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.keys))
+	for key := range v.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelString formats the labels of key with an optional extra label
+func (v *vec) labelString(key, extraName, extraValue string) string {
+	pairs := []string{}
+	for i, name := range v.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escape(v.keys[key][i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
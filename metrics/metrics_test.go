@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type TestSuite struct{}
+
+var _ = check.Suite(&TestSuite{})
+
+func (s *TestSuite) TestCounterVec(c *check.C) {
+	counter := NewCounterVec("test_counter_total", "A test counter.", "repo", "result")
+	counter.Inc("octocat/b", "success")
+	counter.Add(2, "octocat/a", "failure")
+	counter.Inc(`octo"cat`)
+	c.Assert(counter.Get("octocat/a", "failure"), check.Equals, 2.0)
+	c.Assert(counter.Get("octocat/a", "success"), check.Equals, 0.0)
+
+	out := &strings.Builder{}
+	c.Assert(counter.Write(out), check.Equals, nil)
+	c.Assert(out.String(), check.Equals, `# HELP test_counter_total A test counter.
+# TYPE test_counter_total counter
+test_counter_total{repo="octo\"cat",result=""} 1
+test_counter_total{repo="octocat/a",result="failure"} 2
+test_counter_total{repo="octocat/b",result="success"} 1
+`)
+}
+
+func (s *TestSuite) TestHistogramVec(c *check.C) {
+	histogram := NewHistogramVec("test_duration_seconds", "A test histogram.", []float64{.1, 1}, "status")
+	histogram.Observe(.05, "200")
+	histogram.Observe(.5, "200")
+	histogram.Observe(5, "200")
+	c.Assert(histogram.Count("200"), check.Equals, uint64(3))
+	c.Assert(histogram.Count("500"), check.Equals, uint64(0))
+
+	out := &strings.Builder{}
+	c.Assert(histogram.Write(out), check.Equals, nil)
+	c.Assert(out.String(), check.Equals, `# HELP test_duration_seconds A test histogram.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{status="200",le="0.1"} 1
+test_duration_seconds_bucket{status="200",le="1"} 2
+test_duration_seconds_bucket{status="200",le="+Inf"} 3
+test_duration_seconds_sum{status="200"} 5.55
+test_duration_seconds_count{status="200"} 3
+`)
+}
+
+func (s *TestSuite) TestHandler(c *check.C) {
+	NewCounterVec("test_handler_total", "Served by the handler.").Inc()
+
+	w := httptest.NewRecorder()
+	Default.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(w.Header().Get("Content-Type"), check.Equals, "text/plain; version=0.0.4; charset=utf-8")
+	c.Assert(w.Body.String(), check.Matches, "(?s).*\ntest_handler_total 1\n.*")
+}
@@ -10,6 +10,7 @@
 package mock
 
 import (
+	context "context"
 	reflect "reflect"
 
 	core "github.com/bitsbeats/dronetrigger/core"
@@ -39,77 +40,137 @@ func (m *MockDrone) EXPECT() *MockDroneMockRecorder {
 	return m.recorder
 }
 
+// Branches mocks base method.
+func (m *MockDrone) Branches(arg0 context.Context, arg1 string) ([]*core.Build, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Branches", arg0, arg1)
+	ret0, _ := ret[0].([]*core.Build)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Branches indicates an expected call of Branches.
+func (mr *MockDroneMockRecorder) Branches(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Branches", reflect.TypeOf((*MockDrone)(nil).Branches), arg0, arg1)
+}
+
+// Cancel mocks base method.
+func (m *MockDrone) Cancel(arg0 context.Context, arg1 string, arg2 int64) (*core.Build, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Cancel", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*core.Build)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Cancel indicates an expected call of Cancel.
+func (mr *MockDroneMockRecorder) Cancel(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Cancel", reflect.TypeOf((*MockDrone)(nil).Cancel), arg0, arg1, arg2)
+}
+
 // Promote mocks base method.
-func (m *MockDrone) Promote(arg0, arg1 string, arg2 int64) (*core.Build, error) {
+func (m *MockDrone) Promote(arg0 context.Context, arg1, arg2 string, arg3 int64, arg4 map[string]string) (*core.Build, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Promote", arg0, arg1, arg2)
+	ret := m.ctrl.Call(m, "Promote", arg0, arg1, arg2, arg3, arg4)
 	ret0, _ := ret[0].(*core.Build)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Promote indicates an expected call of Promote.
-func (mr *MockDroneMockRecorder) Promote(arg0, arg1, arg2 any) *gomock.Call {
+func (mr *MockDroneMockRecorder) Promote(arg0, arg1, arg2, arg3, arg4 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Promote", reflect.TypeOf((*MockDrone)(nil).Promote), arg0, arg1, arg2)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Promote", reflect.TypeOf((*MockDrone)(nil).Promote), arg0, arg1, arg2, arg3, arg4)
 }
 
 // PromoteLastBuild mocks base method.
-func (m *MockDrone) PromoteLastBuild(arg0, arg1, arg2 string) (*core.Build, error) {
+func (m *MockDrone) PromoteLastBuild(arg0 context.Context, arg1, arg2, arg3 string, arg4 map[string]string) (*core.Build, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "PromoteLastBuild", arg0, arg1, arg2)
+	ret := m.ctrl.Call(m, "PromoteLastBuild", arg0, arg1, arg2, arg3, arg4)
 	ret0, _ := ret[0].(*core.Build)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // PromoteLastBuild indicates an expected call of PromoteLastBuild.
-func (mr *MockDroneMockRecorder) PromoteLastBuild(arg0, arg1, arg2 any) *gomock.Call {
+func (mr *MockDroneMockRecorder) PromoteLastBuild(arg0, arg1, arg2, arg3, arg4 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PromoteLastBuild", reflect.TypeOf((*MockDrone)(nil).PromoteLastBuild), arg0, arg1, arg2)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PromoteLastBuild", reflect.TypeOf((*MockDrone)(nil).PromoteLastBuild), arg0, arg1, arg2, arg3, arg4)
 }
 
 // PromoteLastTag mocks base method.
-func (m *MockDrone) PromoteLastTag(arg0, arg1 string) (*core.Build, error) {
+func (m *MockDrone) PromoteLastTag(arg0 context.Context, arg1, arg2 string, arg3 map[string]string) (*core.Build, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "PromoteLastTag", arg0, arg1)
+	ret := m.ctrl.Call(m, "PromoteLastTag", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(*core.Build)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // PromoteLastTag indicates an expected call of PromoteLastTag.
-func (mr *MockDroneMockRecorder) PromoteLastTag(arg0, arg1 any) *gomock.Call {
+func (mr *MockDroneMockRecorder) PromoteLastTag(arg0, arg1, arg2, arg3 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PromoteLastTag", reflect.TypeOf((*MockDrone)(nil).PromoteLastTag), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PromoteLastTag", reflect.TypeOf((*MockDrone)(nil).PromoteLastTag), arg0, arg1, arg2, arg3)
 }
 
 // RebuildLastBuild mocks base method.
-func (m *MockDrone) RebuildLastBuild(arg0, arg1 string) (*core.Build, error) {
+func (m *MockDrone) RebuildLastBuild(arg0 context.Context, arg1, arg2 string, arg3 map[string]string) (*core.Build, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "RebuildLastBuild", arg0, arg1)
+	ret := m.ctrl.Call(m, "RebuildLastBuild", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(*core.Build)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // RebuildLastBuild indicates an expected call of RebuildLastBuild.
-func (mr *MockDroneMockRecorder) RebuildLastBuild(arg0, arg1 any) *gomock.Call {
+func (mr *MockDroneMockRecorder) RebuildLastBuild(arg0, arg1, arg2, arg3 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RebuildLastBuild", reflect.TypeOf((*MockDrone)(nil).RebuildLastBuild), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RebuildLastBuild", reflect.TypeOf((*MockDrone)(nil).RebuildLastBuild), arg0, arg1, arg2, arg3)
 }
 
 // RebuildLastTag mocks base method.
-func (m *MockDrone) RebuildLastTag(arg0 string) (*core.Build, error) {
+func (m *MockDrone) RebuildLastTag(arg0 context.Context, arg1 string, arg2 map[string]string) (*core.Build, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "RebuildLastTag", arg0)
+	ret := m.ctrl.Call(m, "RebuildLastTag", arg0, arg1, arg2)
 	ret0, _ := ret[0].(*core.Build)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // RebuildLastTag indicates an expected call of RebuildLastTag.
-func (mr *MockDroneMockRecorder) RebuildLastTag(arg0 any) *gomock.Call {
+func (mr *MockDroneMockRecorder) RebuildLastTag(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RebuildLastTag", reflect.TypeOf((*MockDrone)(nil).RebuildLastTag), arg0, arg1, arg2)
+}
+
+// Rollback mocks base method.
+func (m *MockDrone) Rollback(arg0 context.Context, arg1, arg2 string, arg3 int64, arg4 map[string]string) (*core.Build, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Rollback", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(*core.Build)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Rollback indicates an expected call of Rollback.
+func (mr *MockDroneMockRecorder) Rollback(arg0, arg1, arg2, arg3, arg4 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rollback", reflect.TypeOf((*MockDrone)(nil).Rollback), arg0, arg1, arg2, arg3, arg4)
+}
+
+// User mocks base method.
+func (m *MockDrone) User(arg0 context.Context) (*core.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "User", arg0)
+	ret0, _ := ret[0].(*core.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// User indicates an expected call of User.
+func (mr *MockDroneMockRecorder) User(arg0 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RebuildLastTag", reflect.TypeOf((*MockDrone)(nil).RebuildLastTag), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "User", reflect.TypeOf((*MockDrone)(nil).User), arg0)
 }
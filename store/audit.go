@@ -0,0 +1,164 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+const (
+	AUDIT_SUCCESS   = "success"
+	AUDIT_FAILURE   = "failure"
+	AUDIT_DUPLICATE = "duplicate"
+	// AUDIT_DENIED triggers were rejected by authentication, authorization
+	// or rate limits
+	AUDIT_DENIED = "denied"
+)
+
+// maxAuditLine limits the size of a single entry when reading the audit log
+const maxAuditLine = 1024 * 1024
+
+type (
+	// AuditEntry records a trigger and its outcome
+	AuditEntry struct {
+		Time      time.Time    `json:"time"`
+		RequestID string       `json:"request_id,omitempty"`
+		Token     string       `json:"token"`
+		SourceIP  string       `json:"source_ip,omitempty"`
+		Action    core.Action  `json:"action"`
+		Trigger   core.Trigger `json:"trigger"`
+		// Parent is the build which was restarted or promoted
+		Parent  int64  `json:"parent,omitempty"`
+		Commit  string `json:"commit,omitempty"`
+		Build   int64  `json:"build,omitempty"`
+		Outcome string `json:"outcome"`
+		Err     string `json:"error,omitempty"`
+	}
+
+	// AuditFilter selects audit entries, empty fields match everything
+	AuditFilter struct {
+		// Repo is a glob of repositories
+		Repo   string
+		Action core.Action
+		Since  time.Time
+		Until  time.Time
+		// Limit returns only the latest entries
+		Limit int
+	}
+
+	// AuditLog is an append-only file of audit entries as json lines
+	AuditLog struct {
+		path string
+		mu   sync.Mutex
+		file *os.File
+	}
+)
+
+// NewAuditLog opens the audit log at path for appending
+func NewAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	return &AuditLog{path: path, file: file}, nil
+}
+
+// Append writes an entry to the audit log
+func (a *AuditLog) Append(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return errors.New("audit log closed")
+	}
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+// Query returns the matching entries, oldest first. The log is read through
+// a separate file up to its size at the time of the call, appends are not
+// blocked meanwhile.
+func (a *AuditLog) Query(filter AuditFilter) ([]*AuditEntry, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read audit log: %w", err)
+	}
+	defer file.Close()
+	size, err := a.size()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read audit log: %w", err)
+	}
+
+	entries := []*AuditEntry{}
+	scanner := bufio.NewScanner(io.LimitReader(file, size))
+	scanner.Buffer(make([]byte, 64*1024), maxAuditLine)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		entry := &AuditEntry{}
+		err := json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse audit log line %d: %w", line, err)
+		}
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read audit log: %w", err)
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+// size returns the size of the log, entries are only written completely
+func (a *AuditLog) size() (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Close closes the audit log
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return errors.New("audit log closed")
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+func (f *AuditFilter) matches(entry *AuditEntry) bool {
+	if ok, _ := path.Match(f.Repo, entry.Trigger.Repo); f.Repo != "" && !ok {
+		return false
+	}
+	if f.Action != "" && f.Action != entry.Action {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
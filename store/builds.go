@@ -0,0 +1,138 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+// maxBuildRecords limits the number of builds kept in a BuildStore
+const maxBuildRecords = 1000
+
+type (
+	// BuildRecord is a build started by dronetrigger
+	BuildRecord struct {
+		Repo    string      `json:"repo"`
+		Number  int64       `json:"number"`
+		Action  core.Action `json:"action"`
+		Branch  string      `json:"branch,omitempty"`
+		Target  string      `json:"target,omitempty"`
+		Status  string      `json:"status"`
+		Created time.Time   `json:"created"`
+		Updated time.Time   `json:"updated"`
+	}
+
+	// BuildStore tracks the status of builds started by dronetrigger
+	BuildStore struct {
+		path   string
+		mu     sync.RWMutex
+		builds map[string]*BuildRecord
+	}
+)
+
+// NewBuildStore loads a BuildStore from path, an empty path keeps the builds
+// in memory only
+func NewBuildStore(path string) (*BuildStore, error) {
+	s := &BuildStore{
+		path:   path,
+		builds: map[string]*BuildRecord{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	err := readJSON(path, &s.builds)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load build store: %w", err)
+	}
+	return s, nil
+}
+
+// Add records a started build
+func (s *BuildStore) Add(record *BuildRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.builds[buildKey(record.Repo, record.Number)] = record
+	s.prune()
+	return s.save()
+}
+
+// Update sets the status of a recorded build, it returns false for builds
+// not started by dronetrigger
+func (s *BuildStore) Update(repo string, number int64, status string, now time.Time) (*BuildRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.builds[buildKey(repo, number)]
+	if !ok {
+		return nil, false, nil
+	}
+	record.Status = status
+	record.Updated = now
+	copied := *record
+	return &copied, true, s.save()
+}
+
+// Get returns a recorded build
+func (s *BuildStore) Get(repo string, number int64) (*BuildRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.builds[buildKey(repo, number)]
+	if !ok {
+		return nil, false
+	}
+	copied := *record
+	return &copied, true
+}
+
+// List returns all recorded builds, newest first
+func (s *BuildStore) List() []*BuildRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make([]*BuildRecord, 0, len(s.builds))
+	for _, record := range s.builds {
+		copied := *record
+		records = append(records, &copied)
+	}
+	sortRecords(records)
+	return records
+}
+
+// prune drops the oldest builds above maxBuildRecords
+func (s *BuildStore) prune() {
+	if len(s.builds) <= maxBuildRecords {
+		return
+	}
+	records := make([]*BuildRecord, 0, len(s.builds))
+	for _, record := range s.builds {
+		records = append(records, record)
+	}
+	sortRecords(records)
+	for _, record := range records[maxBuildRecords:] {
+		delete(s.builds, buildKey(record.Repo, record.Number))
+	}
+}
+
+func (s *BuildStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return writeJSON(s.path, s.builds)
+}
+
+func sortRecords(records []*BuildRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Created.Equal(records[j].Created) {
+			return records[i].Created.After(records[j].Created)
+		}
+		if records[i].Repo != records[j].Repo {
+			return records[i].Repo < records[j].Repo
+		}
+		return records[i].Number > records[j].Number
+	})
+}
+
+func buildKey(repo string, number int64) string {
+	return fmt.Sprintf("%s#%d", repo, number)
+}
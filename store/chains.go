@@ -0,0 +1,89 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+// maxChainRuns limits the number of runs kept in a ChainStore
+const maxChainRuns = 1000
+
+type (
+	// ChainRun records the downstream triggers of a chain
+	ChainRun struct {
+		ID       string               `json:"id"`
+		Chain    string               `json:"chain"`
+		Repo     string               `json:"repo"`
+		Build    int64                `json:"build"`
+		Started  time.Time            `json:"started"`
+		Finished time.Time            `json:"finished"`
+		Failed   int                  `json:"failed"`
+		Results  []core.TriggerResult `json:"results"`
+	}
+
+	// ChainStore keeps the runs of chains
+	ChainStore struct {
+		path string
+		mu   sync.RWMutex
+		runs []*ChainRun
+	}
+)
+
+// NewChainStore loads a ChainStore from path, an empty path keeps the runs
+// in memory only
+func NewChainStore(path string) (*ChainStore, error) {
+	s := &ChainStore{
+		path: path,
+		runs: []*ChainRun{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	err := readJSON(path, &s.runs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load chain store: %w", err)
+	}
+	return s, nil
+}
+
+// Add records a finished chain run
+func (s *ChainStore) Add(run *ChainRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs = append(s.runs, run)
+	sort.SliceStable(s.runs, func(i, j int) bool {
+		return s.runs[i].Started.After(s.runs[j].Started)
+	})
+	if len(s.runs) > maxChainRuns {
+		s.runs = s.runs[:maxChainRuns]
+	}
+	if s.path == "" {
+		return nil
+	}
+	return writeJSON(s.path, s.runs)
+}
+
+// List returns all chain runs, newest first
+func (s *ChainStore) List() []*ChainRun {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	runs := make([]*ChainRun, 0, len(s.runs))
+	for _, run := range s.runs {
+		copied := *run
+		runs = append(runs, &copied)
+	}
+	return runs
+}
+
+// NewID creates a random identifier
+func NewID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
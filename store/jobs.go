@@ -0,0 +1,449 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+const (
+	// maxFinishedJobs limits the number of finished jobs kept in a JobStore
+	maxFinishedJobs = 1000
+	// maxJobLine limits the size of a single record when loading the log
+	maxJobLine = 1024 * 1024
+	// compactSlack is the number of records above twice the number of jobs
+	// which triggers rewriting the log
+	compactSlack = 1000
+)
+
+const (
+	JOB_QUEUED  = "queued"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	// JOB_FAILED jobs are retried at NextRun
+	JOB_FAILED = "failed"
+	// JOB_DEAD jobs failed too often and are only retried when requeued
+	JOB_DEAD = "dead"
+	// JOB_SCHEDULED jobs wait for NextRun
+	JOB_SCHEDULED = "scheduled"
+	JOB_CANCELLED = "cancelled"
+)
+
+var (
+	// ErrJobNotFound is returned for unknown jobs
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobNotDead is returned when requeueing a job which is not dead
+	ErrJobNotDead = errors.New("job is not dead")
+	// ErrJobNotScheduled is returned when cancelling a job which is not
+	// scheduled
+	ErrJobNotScheduled = errors.New("job is not scheduled")
+	// ErrJobNotPending is returned when starting a finished or cancelled job
+	ErrJobNotPending = errors.New("job is not pending")
+	// ErrTooManyScheduled is returned when adding a scheduled job to a
+	// repository which has the maximum number of scheduled jobs
+	ErrTooManyScheduled = errors.New("too many scheduled jobs")
+)
+
+type (
+	// Job is a trigger processed asynchronously
+	Job struct {
+		ID      string       `json:"id"`
+		State   string       `json:"state"`
+		Trigger core.Trigger `json:"trigger"`
+		Token   string       `json:"token"`
+		// RequestID and SourceIP of the request which queued the job
+		RequestID string     `json:"request_id,omitempty"`
+		SourceIP  string     `json:"source_ip,omitempty"`
+		Build     int64      `json:"build,omitempty"`
+		Err       string     `json:"error,omitempty"`
+		Attempts  int        `json:"attempts"`
+		NextRun   *time.Time `json:"next_run,omitempty"`
+		Created   time.Time  `json:"created"`
+		Updated   time.Time  `json:"updated"`
+	}
+
+	// JobStore keeps asynchronous jobs. Changes are appended to a log of
+	// json lines which is rewritten once it holds too many stale records.
+	JobStore struct {
+		path    string
+		mu      sync.RWMutex
+		jobs    map[string]*Job
+		file    *os.File
+		records int
+	}
+
+	// jobRecord is a line of the job log, the new state of a job or the ID
+	// of a deleted one
+	jobRecord struct {
+		Job     *Job   `json:"job,omitempty"`
+		Deleted string `json:"deleted,omitempty"`
+	}
+)
+
+// NewJobStore loads a JobStore from path, an empty path keeps the jobs in
+// memory only
+func NewJobStore(path string) (*JobStore, error) {
+	s := &JobStore{
+		path: path,
+		jobs: map[string]*Job{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	err := s.load()
+	if err == nil {
+		s.prune()
+		err = s.compact()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load job store: %w", err)
+	}
+	return s, nil
+}
+
+// Add stores a new job, it is not kept if it cannot be persisted
+func (s *JobStore) Add(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(job)
+}
+
+// AddIfBelow stores a new job unless the repository of its trigger already
+// has max scheduled jobs
+func (s *JobStore) AddIfBelow(job *Job, max int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, other := range s.jobs {
+		if other.State == JOB_SCHEDULED && other.Trigger.Repo == job.Trigger.Repo {
+			count += 1
+		}
+	}
+	if count >= max {
+		return ErrTooManyScheduled
+	}
+	return s.add(job)
+}
+
+func (s *JobStore) add(job *Job) error {
+	copied := *job
+	s.jobs[job.ID] = &copied
+	if err := s.append(jobRecord{Job: &copied}); err != nil {
+		delete(s.jobs, job.ID)
+		return err
+	}
+	s.prune()
+	return nil
+}
+
+// Update changes a job using fn and returns the updated job, the change is
+// reverted if it cannot be persisted
+func (s *JobStore) Update(id string, fn func(job *Job)) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	previous := *job
+	fn(job)
+	return s.persist(job, previous)
+}
+
+// Delete removes a job
+func (s *JobStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	delete(s.jobs, id)
+	if err := s.append(jobRecord{Deleted: id}); err != nil {
+		s.jobs[id] = job
+		return err
+	}
+	return nil
+}
+
+// Requeue resets a dead job to be run again
+func (s *JobStore) Requeue(id string, now time.Time) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	if job.State != JOB_DEAD {
+		return nil, ErrJobNotDead
+	}
+	previous := *job
+	job.State = JOB_QUEUED
+	job.Attempts = 0
+	job.Err = ""
+	job.NextRun = nil
+	job.Updated = now
+	return s.persist(job, previous)
+}
+
+// Start marks a pending job as running
+func (s *JobStore) Start(id string, now time.Time) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	if !pending(job) {
+		return nil, ErrJobNotPending
+	}
+	previous := *job
+	job.State = JOB_RUNNING
+	job.Updated = now
+	return s.persist(job, previous)
+}
+
+// Cancel stops a scheduled job
+func (s *JobStore) Cancel(id string, now time.Time) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	if job.State != JOB_SCHEDULED {
+		return nil, ErrJobNotScheduled
+	}
+	previous := *job
+	job.State = JOB_CANCELLED
+	job.NextRun = nil
+	job.Updated = now
+	return s.persist(job, previous)
+}
+
+// Interrupt marks running jobs dead, they were interrupted if the store was
+// just loaded. The drone call may have succeeded, so they are only run again
+// when requeued.
+func (s *JobStore) Interrupt(now time.Time) ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	interrupted := []*Job{}
+	for _, job := range s.jobs {
+		if job.State != JOB_RUNNING {
+			continue
+		}
+		previous := *job
+		job.State = JOB_DEAD
+		job.Err = "interrupted while running"
+		job.NextRun = nil
+		job.Updated = now
+		copied, err := s.persist(job, previous)
+		if err != nil {
+			sortJobs(interrupted)
+			return interrupted, err
+		}
+		interrupted = append(interrupted, copied)
+	}
+	if len(interrupted) == 0 {
+		return nil, nil
+	}
+	sortJobs(interrupted)
+	return interrupted, nil
+}
+
+// Pending returns the jobs which are not finished or running, oldest first
+func (s *JobStore) Pending() []*Job {
+	all := s.List()
+	jobs := []*Job{}
+	for i := len(all) - 1; i >= 0; i-- {
+		if pending(all[i]) {
+			jobs = append(jobs, all[i])
+		}
+	}
+	return jobs
+}
+
+// pending checks if a job still has to run
+func pending(job *Job) bool {
+	switch job.State {
+	case JOB_QUEUED, JOB_FAILED, JOB_SCHEDULED:
+		return true
+	}
+	return false
+}
+
+// Get returns a job
+func (s *JobStore) Get(id string) (*Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *job
+	return &copied, true
+}
+
+// List returns all jobs, newest first
+func (s *JobStore) List() []*Job {
+	return s.Filter("")
+}
+
+// Filter returns the jobs in state, newest first. An empty state returns all
+// jobs.
+func (s *JobStore) Filter(state string) []*Job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if state != "" && job.State != state {
+			continue
+		}
+		copied := *job
+		jobs = append(jobs, &copied)
+	}
+	sortJobs(jobs)
+	return jobs
+}
+
+// prune drops the oldest done or cancelled jobs above maxFinishedJobs, dead
+// jobs are kept until they are requeued or deleted
+func (s *JobStore) prune() {
+	finished := []*Job{}
+	for _, job := range s.jobs {
+		if job.State == JOB_DONE || job.State == JOB_CANCELLED {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sortJobs(finished)
+	for _, job := range finished[maxFinishedJobs:] {
+		delete(s.jobs, job.ID)
+	}
+}
+
+// Close closes the log, later changes fail
+func (s *JobStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// persist appends the state of a changed job to the log and returns a copy,
+// on failure the job is reset to its previous state
+func (s *JobStore) persist(job *Job, previous Job) (*Job, error) {
+	copied := *job
+	if err := s.append(jobRecord{Job: &copied}); err != nil {
+		*job = previous
+		return nil, err
+	}
+	if job.State == JOB_DONE || job.State == JOB_CANCELLED {
+		s.prune()
+	}
+	return &copied, nil
+}
+
+// append writes a record to the log, the log is compacted once the stale
+// records exceed the slack
+func (s *JobStore) append(record jobRecord) error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	s.records += 1
+	if s.records > 2*len(s.jobs)+compactSlack {
+		// the record is written, a failed compaction is retried later
+		_ = s.compact()
+	}
+	return nil
+}
+
+// load replays the log, lines which cannot be decoded, i.e. of an
+// interrupted write, are skipped
+func (s *JobStore) load() error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxJobLine)
+	for scanner.Scan() {
+		record := jobRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		switch {
+		case record.Job != nil:
+			s.jobs[record.Job.ID] = record.Job
+		case record.Deleted != "":
+			delete(s.jobs, record.Deleted)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact replaces the log with a record per job and reopens it for
+// appending
+func (s *JobStore) compact() error {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sortJobs(jobs)
+	buf := bytes.Buffer{}
+	for _, job := range jobs {
+		data, err := json.Marshal(jobRecord{Job: job})
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	if err := writeFile(s.path, buf.Bytes()); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.records = len(jobs)
+	return nil
+}
+
+func sortJobs(jobs []*Job) {
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].Created.Equal(jobs[j].Created) {
+			return jobs[i].Created.After(jobs[j].Created)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+}
@@ -0,0 +1,336 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type TestSuite struct{}
+
+var _ = check.Suite(&TestSuite{})
+
+func (s *TestSuite) TestTokenStore(c *check.C) {
+	path := filepath.Join(c.MkDir(), "tokens.json")
+	tokens, err := NewTokenStore(path)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(tokens.Tokens(), check.DeepEquals, map[string]core.Tokens{})
+
+	err = tokens.Create("octocat/repo", &core.Token{Name: "ci", Token: "s3cret_t0ken"})
+	c.Assert(err, check.Equals, nil)
+	err = tokens.Create("octocat/repo", &core.Token{Name: "ci", Token: "other_t0ken"})
+	c.Assert(err, check.Equals, ErrTokenExists)
+	err = tokens.Create("octocat/*", &core.Token{Name: "org", Token: "0rg_t0ken"})
+	c.Assert(err, check.Equals, nil)
+
+	// rotate with overlap
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt := now.Add(time.Hour)
+	rotated, err := tokens.Rotate("octocat/repo", "ci", "n3w_t0ken", time.Hour, now)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(rotated, check.DeepEquals, &core.Token{Name: "ci", Token: "n3w_t0ken"})
+	_, err = tokens.Rotate("octocat/repo", "unknown", "n3w_t0ken", time.Hour, now)
+	c.Assert(err, check.Equals, ErrTokenNotFound)
+
+	// reload from disk
+	tokens, err = NewTokenStore(path)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(tokens.Tokens(), check.DeepEquals, map[string]core.Tokens{
+		"octocat/repo": {
+			{Name: "ci", Token: "n3w_t0ken"},
+			{Name: "ci-previous", Token: "s3cret_t0ken", ExpiresAt: &expiresAt},
+		},
+		"octocat/*": {{Name: "org", Token: "0rg_t0ken"}},
+	})
+
+	// revoke
+	c.Assert(tokens.Revoke("octocat/*", "org"), check.Equals, nil)
+	c.Assert(tokens.Revoke("octocat/*", "org"), check.Equals, ErrTokenNotFound)
+	_, ok := tokens.Tokens()["octocat/*"]
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *TestSuite) TestTokenStoreInvalid(c *check.C) {
+	_, err := NewTokenStore("store_test.go")
+	c.Assert(err, check.ErrorMatches, "unable to load token store: .*")
+}
+
+func (s *TestSuite) TestBuildStore(c *check.C) {
+	path := filepath.Join(c.MkDir(), "builds.json")
+	builds, err := NewBuildStore(path)
+	c.Assert(err, check.Equals, nil)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = builds.Add(&BuildRecord{Repo: "octocat/repo", Number: 1, Action: core.ACTION_REBUILD, Status: "pending", Created: now, Updated: now})
+	c.Assert(err, check.Equals, nil)
+	err = builds.Add(&BuildRecord{Repo: "octocat/repo", Number: 2, Action: core.ACTION_PROMOTE, Target: "production", Status: "pending", Created: now.Add(time.Minute), Updated: now})
+	c.Assert(err, check.Equals, nil)
+
+	record, tracked, err := builds.Update("octocat/repo", 1, "success", now.Add(time.Hour))
+	c.Assert(err, check.Equals, nil)
+	c.Assert(tracked, check.Equals, true)
+	c.Assert(record.Status, check.Equals, "success")
+	_, tracked, _ = builds.Update("octocat/other", 1, "success", now)
+	c.Assert(tracked, check.Equals, false)
+
+	// reload from disk
+	builds, err = NewBuildStore(path)
+	c.Assert(err, check.Equals, nil)
+	records := builds.List()
+	c.Assert(len(records), check.Equals, 2)
+	c.Assert(records[0].Number, check.Equals, int64(2))
+	c.Assert(records[1].Status, check.Equals, "success")
+	c.Assert(records[1].Updated.Equal(now.Add(time.Hour)), check.Equals, true)
+}
+
+func (s *TestSuite) TestChainStore(c *check.C) {
+	path := filepath.Join(c.MkDir(), "chains.json")
+	chains, err := NewChainStore(path)
+	c.Assert(err, check.Equals, nil)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(chains.Add(&ChainRun{ID: "a", Chain: "base", Started: now}), check.Equals, nil)
+	c.Assert(chains.Add(&ChainRun{ID: "b", Chain: "base", Started: now.Add(time.Minute), Failed: 1, Results: []core.TriggerResult{
+		{Repo: "octocat/app", Build: 1},
+		{Repo: "octocat/other", Err: "Fail"},
+	}}), check.Equals, nil)
+
+	chains, err = NewChainStore(path)
+	c.Assert(err, check.Equals, nil)
+	runs := chains.List()
+	c.Assert(len(runs), check.Equals, 2)
+	c.Assert(runs[0].ID, check.Equals, "b")
+	c.Assert(runs[0].Results[1].Err, check.Equals, "Fail")
+	c.Assert(NewID(), check.Not(check.Equals), NewID())
+}
+
+func (s *TestSuite) TestJobStore(c *check.C) {
+	path := filepath.Join(c.MkDir(), "jobs.jsonl")
+	jobs, err := NewJobStore(path)
+	c.Assert(err, check.Equals, nil)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(jobs.Add(&Job{ID: "a", State: JOB_QUEUED, Trigger: core.Trigger{Repo: "octocat/app"}, Created: now}), check.Equals, nil)
+	c.Assert(jobs.Add(&Job{ID: "b", State: JOB_QUEUED, Trigger: core.Trigger{Repo: "octocat/app"}, Created: now.Add(time.Minute)}), check.Equals, nil)
+
+	job, err := jobs.Update("a", func(job *Job) {
+		job.State = JOB_DONE
+		job.Build = 42
+	})
+	c.Assert(err, check.Equals, nil)
+	c.Assert(job.State, check.Equals, JOB_DONE)
+	_, err = jobs.Update("c", func(job *Job) {})
+	c.Assert(err, check.Equals, ErrJobNotFound)
+
+	job, ok := jobs.Get("a")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(job.Build, check.Equals, int64(42))
+	_, ok = jobs.Get("c")
+	c.Assert(ok, check.Equals, false)
+
+	list := jobs.List()
+	c.Assert(len(list), check.Equals, 2)
+	c.Assert(list[0].ID, check.Equals, "b")
+
+	_, err = jobs.Requeue("b", now)
+	c.Assert(err, check.Equals, ErrJobNotDead)
+	_, err = jobs.Update("b", func(job *Job) {
+		job.State = JOB_DEAD
+		job.Attempts = 5
+		job.Err = "Fail"
+	})
+	c.Assert(err, check.Equals, nil)
+	c.Assert(jobs.Add(&Job{ID: "c", State: JOB_FAILED, Created: now.Add(2 * time.Minute)}), check.Equals, nil)
+	c.Assert(jobs.Add(&Job{ID: "d", State: JOB_RUNNING, Created: now.Add(3 * time.Minute)}), check.Equals, nil)
+	c.Assert(len(jobs.Filter(JOB_DEAD)), check.Equals, 1)
+
+	// reload from disk
+	jobs, err = NewJobStore(path)
+	c.Assert(err, check.Equals, nil)
+	job, err = jobs.Requeue("b", now)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(job.State, check.Equals, JOB_QUEUED)
+	c.Assert(job.Attempts, check.Equals, 0)
+	c.Assert(job.Err, check.Equals, "")
+
+	ids := []string{}
+	for _, job := range jobs.Pending() {
+		ids = append(ids, job.ID)
+	}
+	c.Assert(ids, check.DeepEquals, []string{"b", "c"})
+
+	// running jobs were interrupted
+	interrupted, err := jobs.Interrupt(now)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(interrupted, check.HasLen, 1)
+	c.Assert(interrupted[0].ID, check.Equals, "d")
+	c.Assert(interrupted[0].State, check.Equals, JOB_DEAD)
+	c.Assert(interrupted[0].Err, check.Equals, "interrupted while running")
+	_, err = jobs.Start("d", now)
+	c.Assert(err, check.Equals, ErrJobNotPending)
+
+	c.Assert(jobs.Delete("d"), check.Equals, nil)
+	c.Assert(jobs.Delete("d"), check.Equals, ErrJobNotFound)
+
+	// scheduled jobs may be cancelled until they are started
+	runAt := now.Add(time.Hour)
+	c.Assert(jobs.Add(&Job{ID: "e", State: JOB_SCHEDULED, NextRun: &runAt, Created: now}), check.Equals, nil)
+	c.Assert(jobs.Add(&Job{ID: "f", State: JOB_SCHEDULED, NextRun: &runAt, Created: now}), check.Equals, nil)
+	job, err = jobs.Cancel("e", now)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(job.State, check.Equals, JOB_CANCELLED)
+	_, err = jobs.Start("e", now)
+	c.Assert(err, check.Equals, ErrJobNotPending)
+	job, err = jobs.Start("f", now)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(job.State, check.Equals, JOB_RUNNING)
+	_, err = jobs.Cancel("f", now)
+	c.Assert(err, check.Equals, ErrJobNotScheduled)
+
+	// a truncated record is skipped when loading
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	c.Assert(err, check.Equals, nil)
+	_, err = file.WriteString(`{"job":{"id":"g"`)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(file.Close(), check.Equals, nil)
+	jobs, err = NewJobStore(path)
+	c.Assert(err, check.Equals, nil)
+	_, ok = jobs.Get("g")
+	c.Assert(ok, check.Equals, false)
+	_, ok = jobs.Get("d")
+	c.Assert(ok, check.Equals, false)
+	job, ok = jobs.Get("e")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(job.State, check.Equals, JOB_CANCELLED)
+
+	// changes which cannot be written are reverted
+	c.Assert(jobs.Close(), check.Equals, nil)
+	c.Assert(jobs.Add(&Job{ID: "h", State: JOB_QUEUED, Created: now}), check.Not(check.Equals), nil)
+	_, ok = jobs.Get("h")
+	c.Assert(ok, check.Equals, false)
+	_, err = jobs.Update("b", func(job *Job) { job.State = JOB_DONE })
+	c.Assert(err, check.Not(check.Equals), nil)
+	job, _ = jobs.Get("b")
+	c.Assert(job.State, check.Equals, JOB_QUEUED)
+	c.Assert(jobs.Delete("b"), check.Not(check.Equals), nil)
+	_, ok = jobs.Get("b")
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *TestSuite) TestJobStoreAddIfBelow(c *check.C) {
+	jobs, err := NewJobStore("")
+	c.Assert(err, check.Equals, nil)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(jobs.Add(&Job{ID: "other", State: JOB_SCHEDULED, Trigger: core.Trigger{Repo: "octocat/other"}, Created: now}), check.Equals, nil)
+	c.Assert(jobs.Add(&Job{ID: "queued", State: JOB_QUEUED, Trigger: core.Trigger{Repo: "octocat/app"}, Created: now}), check.Equals, nil)
+
+	// concurrent adds never exceed max
+	errs := make(chan error, 20)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- jobs.AddIfBelow(&Job{ID: fmt.Sprint(i), State: JOB_SCHEDULED, Trigger: core.Trigger{Repo: "octocat/app"}, Created: now}, 5)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	added := 0
+	for err := range errs {
+		if err == nil {
+			added += 1
+			continue
+		}
+		c.Assert(err, check.Equals, ErrTooManyScheduled)
+	}
+	c.Assert(added, check.Equals, 5)
+	c.Assert(jobs.Filter(JOB_SCHEDULED), check.HasLen, 6)
+}
+
+func (s *TestSuite) TestJobStoreCompact(c *check.C) {
+	path := filepath.Join(c.MkDir(), "jobs.jsonl")
+	jobs, err := NewJobStore(path)
+	c.Assert(err, check.Equals, nil)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(jobs.Add(&Job{ID: "a", State: JOB_QUEUED, Created: now}), check.Equals, nil)
+	for i := 0; i < 2*compactSlack; i++ {
+		_, err = jobs.Update("a", func(job *Job) { job.Attempts = i })
+		c.Assert(err, check.Equals, nil)
+	}
+	c.Assert(jobs.records <= 2+compactSlack, check.Equals, true)
+
+	jobs, err = NewJobStore(path)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(jobs.records, check.Equals, 1)
+	job, ok := jobs.Get("a")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(job.Attempts, check.Equals, 2*compactSlack-1)
+}
+
+func (s *TestSuite) TestAuditLog(c *check.C) {
+	path := filepath.Join(c.MkDir(), "audit.jsonl")
+	audit, err := NewAuditLog(path)
+	c.Assert(err, check.Equals, nil)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []*AuditEntry{
+		{Time: now, Token: "ci", Action: core.ACTION_REBUILD, Trigger: core.Trigger{Repo: "octocat/app", Branch: "main"}, Parent: 3, Build: 4, Outcome: AUDIT_SUCCESS},
+		{Time: now.Add(time.Hour), Token: "ci", Action: core.ACTION_PROMOTE, Trigger: core.Trigger{Repo: "octocat/app", Target: "production"}, Outcome: AUDIT_FAILURE, Err: "no build"},
+		{Time: now.Add(2 * time.Hour), Token: "", Action: core.ACTION_REBUILD, Trigger: core.Trigger{Repo: "other/lib"}, Outcome: AUDIT_DENIED, Err: "invalid bearer token"},
+	}
+	for _, entry := range entries {
+		c.Assert(audit.Append(entry), check.Equals, nil)
+	}
+
+	all, err := audit.Query(AuditFilter{})
+	c.Assert(err, check.Equals, nil)
+	c.Assert(all, check.DeepEquals, entries)
+	found, err := audit.Query(AuditFilter{Repo: "octocat/*"})
+	c.Assert(err, check.Equals, nil)
+	c.Assert(found, check.DeepEquals, entries[:2])
+	found, err = audit.Query(AuditFilter{Action: core.ACTION_REBUILD, Limit: 1})
+	c.Assert(err, check.Equals, nil)
+	c.Assert(found, check.DeepEquals, entries[2:])
+	found, err = audit.Query(AuditFilter{Since: now.Add(time.Hour), Until: now.Add(2 * time.Hour)})
+	c.Assert(err, check.Equals, nil)
+	c.Assert(found, check.DeepEquals, entries[1:2])
+
+	// reopening appends
+	c.Assert(audit.Close(), check.Equals, nil)
+	c.Assert(audit.Append(entries[0]), check.ErrorMatches, "audit log closed")
+	audit, err = NewAuditLog(path)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(audit.Append(entries[0]), check.Equals, nil)
+	all, err = audit.Query(AuditFilter{})
+	c.Assert(err, check.Equals, nil)
+	c.Assert(all, check.HasLen, 4)
+
+	// queries see complete entries while appending
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = audit.Append(entries[i%len(entries)])
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		all, err = audit.Query(AuditFilter{})
+		c.Assert(err, check.Equals, nil)
+		c.Assert(len(all) >= 4, check.Equals, true)
+	}
+	<-done
+	all, err = audit.Query(AuditFilter{})
+	c.Assert(err, check.Equals, nil)
+	c.Assert(all, check.HasLen, 104)
+}
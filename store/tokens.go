@@ -0,0 +1,179 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+var (
+	// ErrTokenExists is returned when creating a token with a used name
+	ErrTokenExists = errors.New("token already exists")
+	// ErrTokenNotFound is returned for unknown tokens
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+// TokenStore persists repository tokens managed at runtime
+type TokenStore struct {
+	path   string
+	mu     sync.RWMutex
+	tokens map[string]core.Tokens
+}
+
+// NewTokenStore loads a TokenStore from path, an empty path keeps the tokens
+// in memory only
+func NewTokenStore(path string) (*TokenStore, error) {
+	s := &TokenStore{
+		path:   path,
+		tokens: map[string]core.Tokens{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	err := readJSON(path, &s.tokens)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load token store: %w", err)
+	}
+	return s, nil
+}
+
+// Tokens returns a copy of all stored tokens by repository
+func (s *TokenStore) Tokens() map[string]core.Tokens {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := make(map[string]core.Tokens, len(s.tokens))
+	for repo, t := range s.tokens {
+		tokens[repo] = append(core.Tokens{}, t...)
+	}
+	return tokens
+}
+
+// Create adds a new token for repo
+func (s *TokenStore) Create(repo string, token *core.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(repo, token.Name) >= 0 {
+		return ErrTokenExists
+	}
+	s.tokens[repo] = append(s.tokens[repo], token)
+	return s.save()
+}
+
+// Revoke removes a token from repo
+func (s *TokenStore) Revoke(repo, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(repo, name)
+	if i < 0 {
+		return ErrTokenNotFound
+	}
+	tokens := append(core.Tokens{}, s.tokens[repo][:i]...)
+	tokens = append(tokens, s.tokens[repo][i+1:]...)
+	if len(tokens) == 0 {
+		delete(s.tokens, repo)
+	} else {
+		s.tokens[repo] = tokens
+	}
+	return s.save()
+}
+
+// Rotate replaces the secret of a token. The old secret stays valid as
+// "<name>-previous" until now+overlap.
+func (s *TokenStore) Rotate(repo, name, secret string, overlap time.Duration, now time.Time) (*core.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.find(repo, name)
+	if i < 0 {
+		return nil, ErrTokenNotFound
+	}
+	current := s.tokens[repo][i]
+	rotated := *current
+	rotated.Token = secret
+	rotated.NotBefore = nil
+
+	tokens := core.Tokens{}
+	for _, token := range s.tokens[repo] {
+		switch token.Name {
+		case name:
+			tokens = append(tokens, &rotated)
+		case name + "-previous":
+			// replaced by the current token
+		default:
+			tokens = append(tokens, token)
+		}
+	}
+	if overlap > 0 {
+		previous := *current
+		previous.Name = name + "-previous"
+		expiresAt := now.Add(overlap)
+		if previous.ExpiresAt == nil || previous.ExpiresAt.After(expiresAt) {
+			previous.ExpiresAt = &expiresAt
+		}
+		tokens = append(tokens, &previous)
+	}
+	s.tokens[repo] = tokens
+	return &rotated, s.save()
+}
+
+func (s *TokenStore) find(repo, name string) int {
+	for i, token := range s.tokens[repo] {
+		if token.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *TokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return writeJSON(s.path, s.tokens)
+}
+
+// readJSON loads a json file into v, a missing file is no error
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON atomically replaces path with the json encoding of v
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile atomically replaces path with data
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
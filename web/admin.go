@@ -0,0 +1,397 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/store"
+)
+
+type (
+	// TokenRequest is the payload to create, revoke or rotate a token
+	TokenRequest struct {
+		Repo    string `json:"repo"`
+		Overlap string `json:"overlap,omitempty"`
+		core.Token
+	}
+
+	// JobRequest is the payload to requeue a job
+	JobRequest struct {
+		ID string `json:"id"`
+	}
+
+	// TokenInfo describes a token without its secret
+	TokenInfo struct {
+		Repo   string `json:"repo"`
+		Source string `json:"source"`
+		core.Token
+	}
+)
+
+// bearerTokens merges the configured tokens with the runtime tokens
+func (web *Web) bearerTokens(ctx context.Context) map[string]core.Tokens {
+	configured := web.snapshot(ctx).config.BearerToken
+	if web.Tokens == nil {
+		return configured
+	}
+	merged := map[string]core.Tokens{}
+	for repo, tokens := range configured {
+		merged[repo] = append(core.Tokens{}, tokens...)
+	}
+	for repo, tokens := range web.Tokens.Tokens() {
+		merged[repo] = append(merged[repo], tokens...)
+	}
+	return merged
+}
+
+// HandleAdminTokens lists (GET), creates (POST) and revokes (DELETE) tokens
+func (web *Web) HandleAdminTokens(w http.ResponseWriter, r *http.Request) {
+	if !web.adminAuthorized(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		web.listTokens(w, r)
+	case http.MethodPost:
+		web.createToken(w, r)
+	case http.MethodDelete:
+		web.revokeToken(w, r)
+	default:
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusMethodNotAllowed,
+			LogMsg:      fmt.Sprintf("method %s not allowed", r.Method),
+			ResponseMsg: "method not allowed",
+		})
+	}
+}
+
+// HandleAdminTokenRotate replaces the secret of a runtime token
+func (web *Web) HandleAdminTokenRotate(w http.ResponseWriter, r *http.Request) {
+	if !web.adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusMethodNotAllowed,
+			LogMsg:      fmt.Sprintf("method %s not allowed", r.Method),
+			ResponseMsg: "method not allowed",
+		})
+		return
+	}
+	tr, ok := decodeTokenRequest(w, r)
+	if !ok {
+		return
+	}
+	overlap := time.Duration(0)
+	if tr.Overlap != "" {
+		var err error
+		overlap, err = time.ParseDuration(tr.Overlap)
+		if err != nil {
+			WriteResponse(w, Response{
+				StatusCode:  http.StatusBadRequest,
+				LogMsg:      fmt.Sprintf("invalid overlap: %s", err),
+				ResponseMsg: "invalid overlap",
+			})
+			return
+		}
+	}
+	secret, err := generateToken()
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusInternalServerError,
+			LogMsg:      fmt.Sprintf("unable to generate token: %s", err),
+			ResponseMsg: "unable to generate token",
+		})
+		return
+	}
+	token, err := web.Tokens.Rotate(tr.Repo, tr.Name, secret, overlap, time.Now())
+	if err != nil {
+		writeStoreError(w, err, fmt.Sprintf("unable to rotate token %s for %s", tr.Name, tr.Repo))
+		return
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("rotated token %s for %s, overlap %s", tr.Name, tr.Repo, overlap),
+		ResponseMsg: "ok",
+		Data:        TokenInfo{Repo: tr.Repo, Source: "store", Token: *token},
+	})
+}
+
+// HandleAdminBuilds lists the builds started by dronetrigger
+func (web *Web) HandleAdminBuilds(w http.ResponseWriter, r *http.Request) {
+	if !web.adminAuthorized(w, r) {
+		return
+	}
+	if web.Builds == nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      "build tracking is disabled",
+			ResponseMsg: "build tracking is disabled",
+		})
+		return
+	}
+	builds := web.Builds.List()
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("listed %d builds", len(builds)),
+		ResponseMsg: "ok",
+		Data:        builds,
+	})
+}
+
+// HandleAdminChains lists the runs of chains
+func (web *Web) HandleAdminChains(w http.ResponseWriter, r *http.Request) {
+	if !web.adminAuthorized(w, r) {
+		return
+	}
+	if web.Chains == nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      "chains are disabled",
+			ResponseMsg: "chains are disabled",
+		})
+		return
+	}
+	runs := web.Chains.List()
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("listed %d chain runs", len(runs)),
+		ResponseMsg: "ok",
+		Data:        runs,
+	})
+}
+
+// HandleAdminJobs lists the jobs, optionally filtered by the query parameter
+// state
+func (web *Web) HandleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	if !web.adminAuthorized(w, r) {
+		return
+	}
+	if web.Jobs == nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      "jobs are disabled",
+			ResponseMsg: "jobs are disabled",
+		})
+		return
+	}
+	jobs := web.Jobs.Filter(r.URL.Query().Get("state"))
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("listed %d jobs", len(jobs)),
+		ResponseMsg: "ok",
+		Data:        jobs,
+	})
+}
+
+// HandleAdminJobRequeue queues a dead job again
+func (web *Web) HandleAdminJobRequeue(w http.ResponseWriter, r *http.Request) {
+	if !web.adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusMethodNotAllowed,
+			LogMsg:      fmt.Sprintf("method %s not allowed", r.Method),
+			ResponseMsg: "method not allowed",
+		})
+		return
+	}
+	if web.Jobs == nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      "jobs are disabled",
+			ResponseMsg: "jobs are disabled",
+		})
+		return
+	}
+	jr := JobRequest{}
+	err := json.NewDecoder(r.Body).Decode(&jr)
+	if err != nil || jr.ID == "" {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("invalid requeue request: %v", err),
+			ResponseMsg: "no job id specified",
+		})
+		return
+	}
+	job, err := web.requeue(jr.ID)
+	if err != nil {
+		writeStoreError(w, err, fmt.Sprintf("unable to requeue job %s", jr.ID))
+		return
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("requeued job %s", jr.ID),
+		ResponseMsg: "ok",
+		Data:        job,
+	})
+}
+
+func (web *Web) listTokens(w http.ResponseWriter, r *http.Request) {
+	infos := []TokenInfo{}
+	add := func(source string, tokens map[string]core.Tokens) {
+		for repo, repoTokens := range tokens {
+			for _, token := range repoTokens {
+				info := TokenInfo{Repo: repo, Source: source, Token: *token}
+				info.Token.Token = ""
+				infos = append(infos, info)
+			}
+		}
+	}
+	add("config", web.snapshot(r.Context()).config.BearerToken)
+	add("store", web.Tokens.Tokens())
+	sort.SliceStable(infos, func(i, j int) bool {
+		if infos[i].Repo != infos[j].Repo {
+			return infos[i].Repo < infos[j].Repo
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("listed %d tokens", len(infos)),
+		ResponseMsg: "ok",
+		Data:        infos,
+	})
+}
+
+func (web *Web) createToken(w http.ResponseWriter, r *http.Request) {
+	tr, ok := decodeTokenRequest(w, r)
+	if !ok {
+		return
+	}
+	if findName(web.snapshot(r.Context()).config.BearerToken[tr.Repo], tr.Name) {
+		writeStoreError(w, store.ErrTokenExists, fmt.Sprintf("unable to create token %s for %s", tr.Name, tr.Repo))
+		return
+	}
+	if tr.Token.Token == "" {
+		secret, err := generateToken()
+		if err != nil {
+			WriteResponse(w, Response{
+				StatusCode:  http.StatusInternalServerError,
+				LogMsg:      fmt.Sprintf("unable to generate token: %s", err),
+				ResponseMsg: "unable to generate token",
+			})
+			return
+		}
+		tr.Token.Token = secret
+	}
+	if len(tr.Token.Token) < 8 {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("token %s for %s is to short", tr.Name, tr.Repo),
+			ResponseMsg: "token is to short",
+		})
+		return
+	}
+	token := tr.Token
+	err := web.Tokens.Create(tr.Repo, &token)
+	if err != nil {
+		writeStoreError(w, err, fmt.Sprintf("unable to create token %s for %s", tr.Name, tr.Repo))
+		return
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusCreated,
+		LogMsg:      fmt.Sprintf("created token %s for %s", tr.Name, tr.Repo),
+		ResponseMsg: "ok",
+		Data:        TokenInfo{Repo: tr.Repo, Source: "store", Token: token},
+	})
+}
+
+func (web *Web) revokeToken(w http.ResponseWriter, r *http.Request) {
+	tr, ok := decodeTokenRequest(w, r)
+	if !ok {
+		return
+	}
+	err := web.Tokens.Revoke(tr.Repo, tr.Name)
+	if err != nil {
+		writeStoreError(w, err, fmt.Sprintf("unable to revoke token %s for %s", tr.Name, tr.Repo))
+		return
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("revoked token %s for %s", tr.Name, tr.Repo),
+		ResponseMsg: "ok",
+	})
+}
+
+// adminAuthorized validates the admin bearer token
+func (web *Web) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	bearer := bearerToken(r)
+	adminToken := web.snapshot(r.Context()).config.AdminToken
+	if adminToken == "" || web.Tokens == nil ||
+		subtle.ConstantTimeCompare([]byte(adminToken), []byte(bearer)) != 1 {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusForbidden,
+			LogMsg:      "invalid admin token",
+			ResponseMsg: "invalid admin token",
+		})
+		return false
+	}
+	return true
+}
+
+func decodeTokenRequest(w http.ResponseWriter, r *http.Request) (*TokenRequest, bool) {
+	tr := &TokenRequest{}
+	err := json.NewDecoder(r.Body).Decode(tr)
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("unable to load request body as json: %s", err),
+			ResponseMsg: "unable to parse request body",
+		})
+		return nil, false
+	}
+	if tr.Repo == "" || tr.Name == "" {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      "no repo or token name specified",
+			ResponseMsg: "no repo or token name specified",
+		})
+		return nil, false
+	}
+	return tr, true
+}
+
+func writeStoreError(w http.ResponseWriter, err error, msg string) {
+	statusCode := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, store.ErrTokenExists), errors.Is(err, store.ErrJobNotDead), errors.Is(err, store.ErrJobNotScheduled):
+		statusCode = http.StatusConflict
+	case errors.Is(err, store.ErrTokenNotFound), errors.Is(err, store.ErrJobNotFound):
+		statusCode = http.StatusNotFound
+	}
+	WriteResponse(w, Response{
+		StatusCode:  statusCode,
+		LogMsg:      fmt.Sprintf("%s: %s", msg, err),
+		ResponseMsg: err.Error(),
+	})
+}
+
+func findName(tokens core.Tokens, name string) bool {
+	for _, token := range tokens {
+		if token.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// generateToken creates a random bearer token
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,136 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+	"github.com/bitsbeats/dronetrigger/store"
+)
+
+type sourceIPKey struct{}
+
+// withSourceIP returns a context carrying the source IP of a request
+func withSourceIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, sourceIPKey{}, ip)
+}
+
+// sourceIPFrom returns the source IP of the context
+func sourceIPFrom(ctx context.Context) string {
+	ip, _ := ctx.Value(sourceIPKey{}).(string)
+	return ip
+}
+
+// audit appends a trigger and its outcome to the audit log
+func (web *Web) audit(ctx context.Context, t *core.Trigger, token string, build *core.Build, outcome string, err error) {
+	if web.Audit == nil {
+		return
+	}
+	entry := &store.AuditEntry{
+		Time:      time.Now(),
+		RequestID: logging.RequestID(ctx),
+		Token:     token,
+		SourceIP:  sourceIPFrom(ctx),
+		Action:    t.GetAction(),
+		Trigger:   *t,
+		Outcome:   outcome,
+	}
+	if build != nil {
+		entry.Parent = build.Parent
+		entry.Commit = build.After
+		entry.Build = build.Number
+	}
+	if err != nil {
+		entry.Err = err.Error()
+	}
+	if err := web.Audit.Append(entry); err != nil {
+		slog.ErrorContext(ctx, "unable to write audit log", append(logging.TriggerAttrs(t, token, entry.Build), "error", err)...)
+	}
+}
+
+// HandleAdminAudit queries the audit log, filtered by the parameters repo
+// (glob), action, since, until and limit. Times are RFC 3339 or durations
+// before now.
+func (web *Web) HandleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if !web.adminAuthorized(w, r) {
+		return
+	}
+	if web.Audit == nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      "audit log is disabled",
+			ResponseMsg: "audit log is disabled",
+		})
+		return
+	}
+	filter, err := parseAuditFilter(r, time.Now())
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("invalid audit query: %s", err),
+			ResponseMsg: err.Error(),
+		})
+		return
+	}
+	entries, err := web.Audit.Query(filter)
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusInternalServerError,
+			LogMsg:      fmt.Sprintf("unable to query audit log: %s", err),
+			ResponseMsg: "unable to query audit log",
+		})
+		return
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("listed %d audit entries", len(entries)),
+		ResponseMsg: "ok",
+		Data:        entries,
+	})
+}
+
+// parseAuditFilter reads the filter of an audit query
+func parseAuditFilter(r *http.Request, now time.Time) (store.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := store.AuditFilter{
+		Repo:   query.Get("repo"),
+		Action: core.Action(query.Get("action")),
+	}
+	var err error
+	filter.Since, err = parseQueryTime(query.Get("since"), now)
+	if err != nil {
+		return filter, fmt.Errorf("invalid since: %w", err)
+	}
+	filter.Until, err = parseQueryTime(query.Get("until"), now)
+	if err != nil {
+		return filter, fmt.Errorf("invalid until: %w", err)
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 0 {
+			return filter, fmt.Errorf("invalid limit")
+		}
+	}
+	return filter, nil
+}
+
+// parseQueryTime parses a RFC 3339 time or a duration before now, empty
+// values return the zero time
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ts, err := time.Parse(time.RFC3339, value); err == nil {
+		return ts, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 time or duration")
+	}
+	return now.Add(-d), nil
+}
@@ -0,0 +1,200 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+var errTokenNotValid = errors.New("token expired or not yet valid")
+
+// bearerToken extracts the bearer token from the Authorization header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// credential identifies the caller of a request by the hash of its bearer
+// token or the subject of its verified client certificate. It is empty
+// unless the token is valid or the subject is configured.
+func (web *Web) credential(r *http.Request) string {
+	if bearer := bearerToken(r); bearer != "" {
+		now := time.Now()
+		for _, tokens := range web.bearerTokens(r.Context()) {
+			if token, err := findToken(tokens, bearer, now); token != nil && err == nil {
+				return hashSecret(bearer)
+			}
+		}
+		return ""
+	}
+	if subject := web.certSubject(r); subject != "" {
+		return "cert:" + subject
+	}
+	return ""
+}
+
+// tokenIdentity identifies an authenticated token, bearer tokens by the hash
+// of their secret and certificate tokens by their name
+func tokenIdentity(token *core.Token) string {
+	if token.Token == "" {
+		return token.Name
+	}
+	return hashSecret(token.Token)
+}
+
+// hashSecret returns the hex encoded sha256 of secret
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupTokens returns the tokens configured for a repository. Exact entries
+// take precedence, otherwise the most specific matching glob is used.
+func lookupTokens(bearerTokens map[string]core.Tokens, repo string) (core.Tokens, bool) {
+	patterns := []string{}
+	for pattern := range bearerTokens {
+		patterns = append(patterns, pattern)
+	}
+	pattern, ok := lookupPattern(patterns, repo)
+	if !ok {
+		return nil, false
+	}
+	return bearerTokens[pattern], true
+}
+
+// lookupPattern returns the pattern matching repo, an exact match takes
+// precedence over the most specific glob
+func lookupPattern(patterns []string, repo string) (string, bool) {
+	globs := []string{}
+	for _, pattern := range patterns {
+		if pattern == repo {
+			return pattern, true
+		}
+		if core.IsGlob(pattern) {
+			globs = append(globs, pattern)
+		}
+	}
+	sortPatterns(globs)
+	for _, pattern := range globs {
+		if ok, _ := path.Match(pattern, repo); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// sortPatterns orders patterns by the number of literal characters, most
+// specific first. Ties are sorted alphabetically.
+func sortPatterns(patterns []string) {
+	literals := func(pattern string) int {
+		return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		li, lj := literals(patterns[i]), literals(patterns[j])
+		if li != lj {
+			return li > lj
+		}
+		return patterns[i] < patterns[j]
+	})
+}
+
+// findToken returns the configured token matching bearer. If only an expired
+// or not yet valid token matches it is returned together with
+// errTokenNotValid.
+func findToken(tokens core.Tokens, bearer string, now time.Time) (*core.Token, error) {
+	if bearer == "" {
+		return nil, nil
+	}
+	invalid := (*core.Token)(nil)
+	for _, token := range tokens {
+		if token.Token == "" || subtle.ConstantTimeCompare([]byte(token.Token), []byte(bearer)) != 1 {
+			continue
+		}
+		if token.Valid(now) {
+			return token, nil
+		}
+		invalid = token
+	}
+	if invalid != nil {
+		return invalid, errTokenNotValid
+	}
+	return nil, nil
+}
+
+// expiresSoon checks if the token expires within the warning period
+func expiresSoon(t *core.Token, now time.Time, warning time.Duration) bool {
+	return t.ExpiresAt != nil && t.ExpiresAt.Sub(now) < warning
+}
+
+// authorize checks if the token is allowed to run the trigger
+func authorize(token *core.Token, t *core.Trigger) error {
+	if err := authorizeScope(token, t); err != nil {
+		return err
+	}
+	if len(token.Branches) == 0 {
+		return nil
+	}
+	// the branch of a build is not known, only the claimed one
+	action := t.GetAction()
+	if t.BuildID != 0 || action == core.ACTION_CANCEL || action == core.ACTION_ROLLBACK {
+		return fmt.Errorf("build_id not allowed for tokens restricted to branches")
+	}
+	if t.Release || t.Branch == "" {
+		return fmt.Errorf("token requires an explicit branch")
+	}
+	if !matchAny(token.Branches, t.Branch) {
+		return fmt.Errorf("branch %s not allowed", t.Branch)
+	}
+	return nil
+}
+
+// authorizeScope checks the action, target and params of the trigger but not
+// its branch, which is not known for branch globs before they are resolved
+func authorizeScope(token *core.Token, t *core.Trigger) error {
+	action := t.GetAction()
+	if len(token.Actions) > 0 && !containsAction(token.Actions, action) {
+		return fmt.Errorf("action %s not allowed", action)
+	}
+	if len(token.Targets) > 0 && t.Target != "" && !matchAny(token.Targets, t.Target) {
+		return fmt.Errorf("target %s not allowed", t.Target)
+	}
+	if len(token.Params) > 0 {
+		for key := range t.Params {
+			if !matchAny(token.Params, key) {
+				return fmt.Errorf("param %s not allowed", key)
+			}
+		}
+	}
+	return nil
+}
+
+// matchAny checks if value matches one of the glob patterns
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAction(actions []core.Action, action core.Action) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+// handleBatch authorizes every item of a batch individually and runs the
+// allowed items concurrently
+func (web *Web) handleBatch(w http.ResponseWriter, r *http.Request, p *Payload) {
+	if p.Repo != "" {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      "batch with repo specified",
+			ResponseMsg: "invalid request",
+		})
+		return
+	}
+	cfg := web.snapshot(r.Context()).config
+	if maxItems := cfg.BatchMaxItems; maxItems > 0 && len(p.Items) > maxItems {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("%s batch of %d items exceeds the maximum of %d", web.clientIP(r), len(p.Items), maxItems),
+			ResponseMsg: fmt.Sprintf("too many items, at most %d are allowed", maxItems),
+		})
+		return
+	}
+
+	results := make([]core.TriggerResult, len(p.Items))
+	statuses := make([]int, len(p.Items))
+	allowed := []*core.Trigger{}
+	indexes := []int{}
+	allowedTokens := []string{}
+	tokenNames := map[string]bool{}
+	for i, item := range p.Items {
+		if item == nil {
+			results[i] = core.TriggerResult{Err: "invalid trigger"}
+			statuses[i] = http.StatusBadRequest
+			continue
+		}
+		if item.Repo == "" {
+			results[i] = core.TriggerResult{Branch: item.Branch, Target: item.Target, Err: "no repo specified"}
+			statuses[i] = http.StatusBadRequest
+			continue
+		}
+		if core.IsGlob(item.Branch) {
+			results[i] = core.TriggerResult{Repo: item.Repo, Branch: item.Branch, Target: item.Target, Err: "branch globs are not supported in batches"}
+			statuses[i] = http.StatusBadRequest
+			continue
+		}
+		token, failure := web.authenticate(r, item)
+		if failure != nil {
+			results[i] = core.TriggerResult{Repo: item.Repo, Branch: item.Branch, Target: item.Target, Err: failure.ResponseMsg}
+			statuses[i] = failure.StatusCode
+			continue
+		}
+		tokenNames[token.Name] = true
+		allowedTokens = append(allowedTokens, token.Name)
+		allowed = append(allowed, item)
+		indexes = append(indexes, i)
+	}
+	for i, result := range web.runAll(r.Context(), allowed, allowedTokens, cfg.BatchConcurrency) {
+		results[indexes[i]] = result
+		logTrigger(r.Context(), "batch item", allowed[i], allowedTokens[i], result, "source_ip", web.clientIP(r))
+	}
+
+	names := []string{}
+	for name := range tokenNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeResults(w, results, statuses, fmt.Sprintf("%s batch of %d items, tokens %s", web.clientIP(r), len(results), strings.Join(names, ",")))
+}
+
+// writeResults responds with the results of multiple triggers, the status
+// code is 201 if all succeeded, 207 if some and 500 if all failed. statuses
+// holds the status code of items rejected before running, if all items were
+// rejected with client errors their common status code or 400 is used.
+func writeResults(w http.ResponseWriter, results []core.TriggerResult, statuses []int, logMsg string) {
+	failed := []string{}
+	for _, result := range results {
+		if result.Err != "" {
+			failed = append(failed, fmt.Sprintf("%s@%s: %s", result.Repo, result.Branch, result.Err))
+		}
+	}
+	logMsg = fmt.Sprintf("%s, %d failed", logMsg, len(failed))
+	if len(failed) > 0 {
+		logMsg += ": " + strings.Join(failed, "; ")
+	}
+
+	statusCode := http.StatusCreated
+	responseMsg := "ok"
+	switch {
+	case len(failed) > 0 && len(failed) == len(results):
+		statusCode = rejectedStatus(statuses)
+		responseMsg = "all items failed"
+	case len(failed) > 0:
+		statusCode = http.StatusMultiStatus
+		responseMsg = "partial"
+	}
+	WriteResponse(w, Response{
+		StatusCode:  statusCode,
+		LogMsg:      logMsg,
+		ResponseMsg: responseMsg,
+		Data:        results,
+	})
+}
+
+// rejectedStatus returns the status code for a response of which all items
+// failed, 500 unless every item was rejected with a client error
+func rejectedStatus(statuses []int) int {
+	common := 0
+	for _, status := range statuses {
+		if status < 400 || status >= 500 {
+			return http.StatusInternalServerError
+		}
+		if common == 0 {
+			common = status
+		} else if common != status {
+			common = http.StatusBadRequest
+		}
+	}
+	if common == 0 {
+		return http.StatusInternalServerError
+	}
+	return common
+}
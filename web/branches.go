@@ -0,0 +1,72 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+// handleBranches restarts the latest build of every branch matching the
+// branch glob of the payload. The token is authorized for the repository and
+// action first, its branches are checked for every resolved branch.
+func (web *Web) handleBranches(w http.ResponseWriter, r *http.Request, p *Payload) {
+	if p.GetAction() != core.ACTION_REBUILD || p.Release {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      "branch globs are only supported for rebuilds",
+			ResponseMsg: "invalid request",
+		})
+		return
+	}
+	token, failure := web.authenticateWith(r, &p.Trigger, authorizeScope)
+	if failure != nil {
+		WriteResponse(w, *failure)
+		return
+	}
+
+	snapshot := web.snapshot(r.Context())
+	builds, err := snapshot.drone.Branches(r.Context(), p.Repo)
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusInternalServerError,
+			LogMsg:      fmt.Sprintf("unable to list branches of %s: %s", p.Repo, err),
+			ResponseMsg: "unable to list branches",
+		})
+		return
+	}
+	branches := core.MatchBranches(builds, p.Branch)
+	if len(branches) == 0 {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      fmt.Sprintf("no branches of %s match %s", p.Repo, p.Branch),
+			ResponseMsg: "no matching branches",
+		})
+		return
+	}
+
+	results := make([]core.TriggerResult, len(branches))
+	statuses := make([]int, len(branches))
+	allowed := []*core.Trigger{}
+	indexes := []int{}
+	for i, branch := range branches {
+		t := p.Trigger
+		t.Branch = branch
+		err := authorize(token, &t)
+		if err != nil {
+			results[i] = core.TriggerResult{Repo: t.Repo, Branch: branch, Err: err.Error()}
+			statuses[i] = http.StatusForbidden
+			continue
+		}
+		allowed = append(allowed, &t)
+		indexes = append(indexes, i)
+	}
+	for i, result := range web.runAll(r.Context(), allowed, repeat(token.Name, len(allowed)), snapshot.config.BatchConcurrency) {
+		results[indexes[i]] = result
+		logTrigger(r.Context(), "branch", allowed[i], token.Name, result, "source_ip", web.clientIP(r))
+	}
+	writeResults(w, results, statuses, fmt.Sprintf(
+		"%s rebuild %d branches %s@%s, token %s",
+		web.clientIP(r), len(branches), p.Repo, p.Branch, token.Name,
+	))
+}
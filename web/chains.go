@@ -0,0 +1,67 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/store"
+)
+
+// runChains triggers the downstream builds of all chains matching a
+// successful build
+func (web *Web) runChains(ctx context.Context, event *BuildEvent) {
+	cfg := web.snapshot(ctx).config.Chains
+	if cfg == nil || event.Status != "success" {
+		return
+	}
+	for _, rule := range cfg.Rules {
+		if !chainMatches(rule, event) {
+			continue
+		}
+		run := &store.ChainRun{
+			ID:      store.NewID(),
+			Chain:   rule.Name,
+			Repo:    event.Repo,
+			Build:   event.Number,
+			Started: time.Now(),
+		}
+		run.Results = web.runAll(ctx, rule.Trigger, repeat("chain:"+rule.Name, len(rule.Trigger)), cfg.Concurrency)
+		run.Finished = time.Now()
+		for i, result := range run.Results {
+			if result.Err != "" {
+				run.Failed += 1
+			}
+			logTrigger(ctx, "chain", rule.Trigger[i], "chain:"+rule.Name, result, "run", run.ID, "after_repo", event.Repo, "after_build", event.Number)
+		}
+		slog.InfoContext(ctx, "chain finished", "chain", rule.Name, "run", run.ID, "repo", event.Repo, "build", event.Number, "triggered", len(run.Results), "failed", run.Failed)
+		if web.Chains == nil {
+			continue
+		}
+		err := web.Chains.Add(run)
+		if err != nil {
+			slog.ErrorContext(ctx, "unable to record chain run", "chain", rule.Name, "run", run.ID, "error", err)
+		}
+	}
+}
+
+// chainMatches checks if a chain rule applies to a build. Rules without
+// event match push and tag builds, so promotions and rollbacks do not start
+// the chain again.
+func chainMatches(rule *core.ChainRule, event *BuildEvent) bool {
+	if ok, _ := path.Match(rule.Repo, event.Repo); !ok {
+		return false
+	}
+	if ok, _ := path.Match(rule.Branch, event.Branch); rule.Branch != "" && !ok {
+		return false
+	}
+	switch {
+	case rule.Event != "" && rule.Event != event.Event:
+		return false
+	case rule.Event == "" && event.Event != "push" && event.Event != "tag":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+)
+
+type (
+	// debouncer coalesces identical triggers arriving within the debounce
+	// window of their repository
+	debouncer struct {
+		mu      sync.Mutex
+		pending map[string]*debounced
+	}
+
+	// debounced is a trigger waiting for its debounce window to end, done
+	// holds a callback per registered trigger
+	debounced struct {
+		done []func(*core.Build, bool, error)
+	}
+
+	// debounceKey marks contexts whose triggers wait for their debounce
+	// window
+	debounceKey struct{}
+)
+
+// withDebounce returns a context whose triggers wait for the debounce window
+// of their repository
+func withDebounce(ctx context.Context) context.Context {
+	return context.WithValue(ctx, debounceKey{}, true)
+}
+
+// debounceWindow returns the debounce window configured for a repository
+func (web *Web) debounceWindow(ctx context.Context, repo string) time.Duration {
+	debounce := web.snapshot(ctx).config.Debounce
+	patterns := []string{}
+	for pattern := range debounce {
+		patterns = append(patterns, pattern)
+	}
+	pattern, ok := lookupPattern(patterns, repo)
+	if !ok {
+		return 0
+	}
+	return debounce[pattern]
+}
+
+// debounce registers a trigger in the debounce window of its repository, the
+// window is started by the first trigger. When it ended fn is called once
+// and done of every trigger registered meanwhile receives its outcome. It
+// returns false without registering if the repository has no window or the
+// trigger is a cancellation, the caller has to run it right away.
+func (web *Web) debounce(ctx context.Context, t *core.Trigger, fn func() (*core.Build, bool, error), done func(*core.Build, bool, error)) bool {
+	window := web.debounceWindow(ctx, t.Repo)
+	if window <= 0 || t.GetAction() == core.ACTION_CANCEL {
+		return false
+	}
+	key, err := triggerKey(t)
+	if err != nil {
+		return false
+	}
+
+	web.debouncer.mu.Lock()
+	defer web.debouncer.mu.Unlock()
+	if web.debouncer.pending == nil {
+		web.debouncer.pending = map[string]*debounced{}
+	}
+	d, ok := web.debouncer.pending[key]
+	if !ok {
+		d = &debounced{}
+		web.debouncer.pending[key] = d
+		time.AfterFunc(window, func() {
+			web.debouncer.mu.Lock()
+			delete(web.debouncer.pending, key)
+			web.debouncer.mu.Unlock()
+
+			build, duplicate, err := fn()
+			if err == nil && build != nil && len(d.done) > 1 {
+				slog.InfoContext(ctx, "debounce coalesced triggers", append(logging.TriggerAttrs(t, "", build.Number), "triggers", len(d.done))...)
+			}
+			for _, done := range d.done {
+				done(build, duplicate, err)
+				web.background.Done()
+			}
+		})
+	}
+	web.background.Add(1)
+	d.done = append(d.done, done)
+	return true
+}
@@ -0,0 +1,273 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+// maxSignatureAge is the allowed clock skew of signed drone webhooks
+const maxSignatureAge = 5 * time.Minute
+
+type (
+	// BuildEvent is a build status reported by a drone global webhook
+	BuildEvent struct {
+		Repo    string `json:"repo"`
+		Number  int64  `json:"number"`
+		Status  string `json:"status"`
+		Event   string `json:"event"`
+		Branch  string `json:"branch"`
+		Ref     string `json:"ref"`
+		Deploy  string `json:"deploy_to,omitempty"`
+		Tracked bool   `json:"tracked"`
+	}
+
+	// droneHookPayload is the payload of a drone global webhook
+	droneHookPayload struct {
+		Event  string `json:"event"`
+		Action string `json:"action"`
+		Repo   struct {
+			Slug string `json:"slug"`
+		} `json:"repo"`
+		Build struct {
+			Number   int64  `json:"number"`
+			Status   string `json:"status"`
+			Event    string `json:"event"`
+			Target   string `json:"target"`
+			Ref      string `json:"ref"`
+			DeployTo string `json:"deploy_to"`
+		} `json:"build"`
+	}
+)
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// HandleDroneWebhook receives drone global webhooks, updates the status of
+// recorded builds and runs follow-ups of finished builds
+func (web *Web) HandleDroneWebhook(w http.ResponseWriter, r *http.Request) {
+	cfg := web.snapshot(r.Context()).config.DroneWebhook
+	if cfg == nil || cfg.Secret == "" {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      "no drone webhook configured",
+			ResponseMsg: "not found",
+		})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("unable to read drone webhook: %s", err),
+			ResponseMsg: "unable to read request body",
+		})
+		return
+	}
+	err = verifyHTTPSignature(r, cfg.Secret, body, time.Now())
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusForbidden,
+			LogMsg:      fmt.Sprintf("drone webhook: %s", err),
+			ResponseMsg: errInvalidSignature.Error(),
+		})
+		return
+	}
+
+	payload := droneHookPayload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("unable to parse drone webhook: %s", err),
+			ResponseMsg: "unable to parse request body",
+		})
+		return
+	}
+	if payload.Event != "build" || payload.Repo.Slug == "" {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusOK,
+			LogMsg:      fmt.Sprintf("ignored drone %s webhook", payload.Event),
+			ResponseMsg: "ignored",
+		})
+		return
+	}
+
+	event := &BuildEvent{
+		Repo:   payload.Repo.Slug,
+		Number: payload.Build.Number,
+		Status: payload.Build.Status,
+		Event:  payload.Build.Event,
+		Branch: payload.Build.Target,
+		Ref:    payload.Build.Ref,
+		Deploy: payload.Build.DeployTo,
+	}
+	if web.Builds != nil {
+		_, event.Tracked, err = web.Builds.Update(event.Repo, event.Number, event.Status, time.Now())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "unable to update build", "repo", event.Repo, "build", event.Number, "error", err)
+		}
+	}
+	if payload.Action == "updated" && finished(event.Status) {
+		if event.Tracked {
+			buildOutcomesTotal.Inc(event.Repo, event.Status)
+		}
+		ctx := withDebounce(context.WithoutCancel(r.Context()))
+		web.background.Add(1)
+		go func() {
+			defer web.background.Done()
+			web.buildFinished(ctx, event)
+		}()
+	}
+
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("drone build %s#%d %s (tracked: %t)", event.Repo, event.Number, event.Status, event.Tracked),
+		ResponseMsg: "ok",
+	})
+}
+
+// buildFinished runs the follow-ups matching a finished build started by
+// dronetrigger and the chains and promotions matching any finished build
+func (web *Web) buildFinished(ctx context.Context, event *BuildEvent) {
+	for _, followup := range web.snapshot(ctx).config.DroneWebhook.Followups {
+		if !event.Tracked || !followupMatches(followup, event) {
+			continue
+		}
+		for _, url := range followup.Notify {
+			err := notify(url, event)
+			if err != nil {
+				slog.WarnContext(ctx, "unable to notify followup", "followup", followup.Name, "url", url, "repo", event.Repo, "build", event.Number, "error", err)
+			}
+		}
+		for _, t := range followup.Trigger {
+			token := "followup:" + followup.Name
+			result := web.run(ctx, t, token)
+			logTrigger(ctx, "followup", t, token, result, "after_repo", event.Repo, "after_build", event.Number)
+		}
+	}
+	web.runChains(ctx, event)
+	web.runPromotions(ctx, event)
+}
+
+// followupMatches checks if a follow-up applies to a finished build
+func followupMatches(followup *core.Followup, event *BuildEvent) bool {
+	if ok, _ := path.Match(followup.Repo, event.Repo); !ok {
+		return false
+	}
+	if ok, _ := path.Match(followup.Branch, event.Branch); followup.Branch != "" && !ok {
+		return false
+	}
+	if followup.Event != "" && followup.Event != event.Event {
+		return false
+	}
+	if len(followup.Status) > 0 && !matchAny(followup.Status, event.Status) {
+		return false
+	}
+	return true
+}
+
+// finished checks if a drone build status is final
+func finished(status string) bool {
+	switch status {
+	case "success", "failure", "error", "killed", "declined":
+		return true
+	}
+	return false
+}
+
+// notify posts a build event to url
+func notify(url string, event *BuildEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// verifyHTTPSignature validates a request signed with HTTP signatures using
+// hmac-sha256 as sent by drone
+func verifyHTTPSignature(r *http.Request, secret string, body []byte, now time.Time) error {
+	header := r.Header.Get("Signature")
+	if header == "" {
+		header = strings.TrimPrefix(r.Header.Get("Authorization"), "Signature ")
+	}
+	params := map[string]string{}
+	for _, param := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok {
+			params[key] = strings.Trim(value, `"`)
+		}
+	}
+	if params["signature"] == "" {
+		return errors.New("missing signature")
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && algorithm != "hmac-sha256" {
+		return fmt.Errorf("unsupported signature algorithm %q", algorithm)
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+
+	lines := []string{}
+	signed := map[string]bool{}
+	for _, h := range headers {
+		signed[h] = true
+		if h == "(request-target)" {
+			lines = append(lines, fmt.Sprintf("%s: %s %s", h, strings.ToLower(r.Method), r.URL.RequestURI()))
+			continue
+		}
+		if r.Header.Get(h) == "" {
+			return fmt.Errorf("signed header %s missing", h)
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", h, r.Header.Get(h)))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil || !hmac.Equal(mac.Sum(nil), signature) {
+		return errInvalidSignature
+	}
+
+	// the body is only covered by the signature through the digest
+	if !signed["digest"] {
+		return errors.New("digest is not signed")
+	}
+	digest := sha256.Sum256(body)
+	if r.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+		return errors.New("digest mismatch")
+	}
+	// without a signed date captured requests could be replayed forever
+	if !signed["date"] {
+		return errors.New("date is not signed")
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("invalid date: %w", err)
+	}
+	if age := now.Sub(date); age > maxSignatureAge || age < -maxSignatureAge {
+		return errors.New("signature expired")
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyInterval is the time the result of the drone check is cached
+const readyInterval = 10 * time.Second
+
+// readiness caches the result of the drone check
+type readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// HandleHealth reports that the process is alive at /healthz
+func (web *Web) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      "healthy",
+		ResponseMsg: "ok",
+	})
+}
+
+// HandleReady reports at /readyz if the config is loaded and drone is
+// reachable with a valid token
+func (web *Web) HandleReady(w http.ResponseWriter, r *http.Request) {
+	err := web.checkReady(r.Context(), time.Now())
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusServiceUnavailable,
+			LogMsg:      fmt.Sprintf("not ready: %s", err),
+			ResponseMsg: err.Error(),
+		})
+		return
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      "ready",
+		ResponseMsg: "ok",
+	})
+}
+
+// checkReady checks the config and the drone api, the result of the drone
+// api is cached for readyInterval. Changes of the result are logged.
+func (web *Web) checkReady(ctx context.Context, now time.Time) error {
+	snapshot := web.snapshot(ctx)
+	if snapshot.config == nil {
+		return fmt.Errorf("no config loaded")
+	}
+	web.ready.mu.Lock()
+	defer web.ready.mu.Unlock()
+	if !web.ready.checked.IsZero() && now.Sub(web.ready.checked) < readyInterval {
+		return web.ready.err
+	}
+	_, err := snapshot.drone.User(ctx)
+	if err != nil {
+		err = fmt.Errorf("unable to reach drone: %w", err)
+	}
+	switch {
+	case err != nil && web.ready.err == nil:
+		slog.WarnContext(ctx, "readiness check failed", "error", err)
+	case err == nil && web.ready.err != nil:
+		slog.InfoContext(ctx, "readiness check recovered")
+	}
+	web.ready.checked = now
+	web.ready.err = err
+	return err
+}
+
+// quiet checks if requests to path are excluded from the request log
+func quiet(path string) bool {
+	return path == "/healthz" || path == "/readyz"
+}
@@ -0,0 +1,241 @@
+package web
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+)
+
+// maxCacheEntries triggers dropping the kept entry which expires first
+const maxCacheEntries = 10000
+
+type (
+	// resultCache shares the result of an operation between calls with the
+	// same key, concurrent calls wait for the first one to finish
+	resultCache struct {
+		mu      sync.Mutex
+		entries map[string]*cacheEntry
+		expiry  expiryHeap
+	}
+
+	cacheEntry struct {
+		key         string
+		fingerprint string
+		done        chan struct{}
+		value       interface{}
+		expires     time.Time
+	}
+
+	// expiryHeap orders the kept entries of a resultCache by expiry
+	expiryHeap []*cacheEntry
+
+	// cachedResponse is a response replayed for a repeated idempotency key
+	cachedResponse struct {
+		statusCode int
+		header     http.Header
+		body       []byte
+		logMsg     string
+		logAttrs   []any
+	}
+
+	// duplicateResult is the outcome of a trigger shared with duplicates
+	duplicateResult struct {
+		build *core.Build
+		err   error
+	}
+
+	// responseRecorder passes a response through and keeps a copy
+	responseRecorder struct {
+		http.ResponseWriter
+		statusCode int
+		header     http.Header
+		body       bytes.Buffer
+	}
+)
+
+// begin returns the entry of key, owner is true if the caller has to run the
+// operation and finish the entry. Expired entries are dropped, at most
+// maxCacheEntries are kept.
+func (c *resultCache) begin(key, fingerprint string, now time.Time) (entry *cacheEntry, owner bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]*cacheEntry{}
+	}
+	for len(c.expiry) > 0 && !now.Before(c.expiry[0].expires) {
+		c.drop()
+	}
+	entry, ok := c.entries[key]
+	if ok {
+		return entry, false
+	}
+	for len(c.entries) >= maxCacheEntries && len(c.expiry) > 0 {
+		c.drop()
+	}
+	entry = &cacheEntry{key: key, fingerprint: fingerprint, done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// drop removes the kept entry which expires first
+func (c *resultCache) drop() {
+	entry := heap.Pop(&c.expiry).(*cacheEntry)
+	delete(c.entries, entry.key)
+}
+
+// finish stores the value of an entry for ttl and releases waiting calls,
+// entries which should not be kept are removed
+func (c *resultCache) finish(key string, entry *cacheEntry, value interface{}, ttl time.Duration, keep bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.value = value
+	entry.expires = time.Now().Add(ttl)
+	if keep {
+		heap.Push(&c.expiry, entry)
+	} else {
+		delete(c.entries, key)
+	}
+	close(entry.done)
+}
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x any) { *h = append(*h, x.(*cacheEntry)) }
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// handleIdempotent handles a request with an Idempotency-Key header. The
+// first request of a key per credential is executed, repetitions within
+// the ttl receive its response. Server errors and rate limited requests are
+// not kept to allow retries, denied requests are not kept at all.
+func (web *Web) handleIdempotent(w http.ResponseWriter, r *http.Request, key string) {
+	body, err := io.ReadAll(r.Body)
+	if tooLarge(err) {
+		WriteResponse(w, bodyTooLarge(err))
+		return
+	}
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusInternalServerError,
+			LogMsg:      fmt.Sprintf("unable to read request body: %s", err),
+			ResponseMsg: "unable to parse request body",
+		})
+		return
+	}
+	cacheKey := web.credential(r) + ":" + key
+	fingerprint := sha256.Sum256(body)
+
+	entry, owner := web.idempotency.begin(cacheKey, hex.EncodeToString(fingerprint[:]), time.Now())
+	if !owner {
+		if entry.fingerprint != hex.EncodeToString(fingerprint[:]) {
+			WriteResponse(w, Response{
+				StatusCode:  http.StatusUnprocessableEntity,
+				LogMsg:      fmt.Sprintf("idempotency key %s reused with a different request", key),
+				ResponseMsg: "idempotency key reused with a different request",
+			})
+			return
+		}
+		<-entry.done
+		cached := entry.value.(*cachedResponse)
+		w.(*ResponseWriterWithStatus).SetMessage(fmt.Sprintf("replayed idempotency key %s: %s", key, cached.logMsg), cached.logAttrs...)
+		for name, values := range cached.header {
+			// the request ID belongs to the replaying request
+			if name != logging.REQUEST_ID_HEADER {
+				w.Header()[name] = values
+			}
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(cached.statusCode)
+		_, _ = w.Write(cached.body)
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	inner := NewResponseWriterWithStatus(recorder)
+	web.handle(inner, r)
+	w.(*ResponseWriterWithStatus).SetMessage(inner.LogMessage, inner.LogAttrs...)
+
+	cached := &cachedResponse{
+		statusCode: recorder.statusCode,
+		header:     recorder.header,
+		body:       recorder.body.Bytes(),
+		logMsg:     inner.LogMessage,
+		logAttrs:   inner.LogAttrs,
+	}
+	keep := recorder.statusCode < 500 &&
+		recorder.statusCode != http.StatusTooManyRequests &&
+		recorder.statusCode != http.StatusUnauthorized &&
+		recorder.statusCode != http.StatusForbidden
+	web.idempotency.finish(cacheKey, entry, cached, web.snapshot(r.Context()).config.IdempotencyTTL, keep)
+}
+
+// suppressDuplicate runs fn unless an identical trigger was started within
+// the duplicate window, in that case the build of the first one is returned
+func (web *Web) suppressDuplicate(ctx context.Context, t *core.Trigger, fn func() (*core.Build, error)) (build *core.Build, duplicate bool, err error) {
+	window := web.snapshot(ctx).config.DuplicateWindow
+	if window <= 0 {
+		build, err = fn()
+		return build, false, err
+	}
+	key, err := triggerKey(t)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entry, owner := web.duplicates.begin(key, "", time.Now())
+	if !owner {
+		<-entry.done
+		result := entry.value.(*duplicateResult)
+		return result.build, true, result.err
+	}
+	build, err = fn()
+	web.duplicates.finish(key, entry, &duplicateResult{build, err}, window, err == nil && build != nil)
+	return build, false, err
+}
+
+// triggerKey identifies identical triggers
+func triggerKey(t *core.Trigger) (string, error) {
+	normalized := *t
+	normalized.Action = t.GetAction()
+	key, err := json.Marshal(normalized)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode trigger: %w", err)
+	}
+	return string(key), nil
+}
+
+// WriteHeader passes the statusCode through and stores it with a copy of the
+// headers
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.header = r.ResponseWriter.Header().Clone()
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write passes the body through and stores a copy
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.header == nil {
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
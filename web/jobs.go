@@ -0,0 +1,407 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+	"github.com/bitsbeats/dronetrigger/store"
+)
+
+var (
+	// errQueueFull is returned if no more jobs can be queued
+	errQueueFull = errors.New("job queue full")
+)
+
+// maxRetryDelay limits the backoff between attempts of a job
+const maxRetryDelay = time.Hour
+
+// StartWorkers starts the worker pool processing asynchronous jobs and
+// resumes the pending jobs of the store
+func (web *Web) StartWorkers() {
+	web.queue = make(chan string, web.config().Jobs.QueueSize)
+	web.stop = make(chan struct{})
+	for i := 0; i < web.config().Jobs.Workers; i++ {
+		web.workers.Add(1)
+		go func() {
+			defer web.workers.Done()
+			web.work()
+		}()
+	}
+	interrupted, err := web.Jobs.Interrupt(time.Now())
+	if err != nil {
+		slog.Error("unable to store interrupted jobs", "error", err)
+	}
+	for _, job := range interrupted {
+		slog.Warn("job interrupted while running, requeue to retry", "job", job.ID, "repo", job.Trigger.Repo, "state", job.State)
+	}
+	pending := web.Jobs.Pending()
+	if len(pending) > 0 {
+		slog.Info("resuming pending jobs", "jobs", len(pending))
+	}
+	for _, job := range pending {
+		web.schedule(job)
+	}
+}
+
+// work processes queued jobs until the workers are stopped, the jobs queued
+// by then are processed before returning
+func (web *Web) work() {
+	for {
+		select {
+		case id := <-web.queue:
+			web.process(id)
+		case <-web.stop:
+			for {
+				select {
+				case id := <-web.queue:
+					web.process(id)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// schedule queues a job at its next run, jobs due after the workers are
+// stopped stay pending until the next start
+func (web *Web) schedule(job *store.Job) {
+	delay := time.Duration(0)
+	if job.NextRun != nil {
+		delay = time.Until(*job.NextRun)
+	}
+	id := job.ID
+	time.AfterFunc(delay, func() {
+		select {
+		case web.queue <- id:
+		case <-web.stop:
+		}
+	})
+}
+
+// retryDelay doubles the configured delay with every failed attempt
+func retryDelay(c *core.JobsConfig, attempts int) time.Duration {
+	delay := c.RetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// enqueue stores a job for the trigger and queues it for the workers, jobs
+// with runAt are scheduled instead. The request ID and source IP of ctx are
+// kept for the logs and audit of the job.
+func (web *Web) enqueue(ctx context.Context, t *core.Trigger, token *core.Token, runAt *time.Time) (*store.Job, error) {
+	now := time.Now()
+	job := &store.Job{
+		ID:        store.NewID(),
+		State:     store.JOB_QUEUED,
+		Trigger:   *t,
+		Token:     token.Name,
+		RequestID: logging.RequestID(ctx),
+		SourceIP:  sourceIPFrom(ctx),
+		Created:   now,
+		Updated:   now,
+	}
+	if runAt != nil {
+		job.State = store.JOB_SCHEDULED
+		job.NextRun = runAt
+	}
+	var err error
+	if max := web.snapshot(ctx).config.Jobs.MaxScheduled; runAt != nil && max > 0 {
+		// counted and added at once, concurrent requests can't exceed max
+		err = web.Jobs.AddIfBelow(job, max)
+	} else {
+		err = web.Jobs.Add(job)
+	}
+	if errors.Is(err, store.ErrTooManyScheduled) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to store job: %w", err)
+	}
+	if runAt != nil {
+		web.schedule(job)
+		return job, nil
+	}
+	select {
+	case web.queue <- job.ID:
+	default:
+		if err := web.Jobs.Delete(job.ID); err != nil {
+			slog.ErrorContext(ctx, "unable to delete rejected job", "job", job.ID, "error", err)
+		}
+		return nil, errQueueFull
+	}
+	return job, nil
+}
+
+// jobToken checks that the token a job was queued with still exists, is
+// valid and allowed to run the trigger
+func (web *Web) jobToken(ctx context.Context, job *store.Job, now time.Time) error {
+	token := (*core.Token)(nil)
+	if subject, ok := strings.CutPrefix(job.Token, "cert:"); ok {
+		token = web.clientCertToken(ctx, subject, job.Trigger.Repo)
+	} else if tokens, ok := lookupTokens(web.bearerTokens(ctx), job.Trigger.Repo); ok {
+		for _, t := range tokens {
+			if t.Name == job.Token {
+				token = t
+				break
+			}
+		}
+	}
+	if token == nil {
+		return fmt.Errorf("token %s no longer exists", job.Token)
+	}
+	if !token.Valid(now) {
+		return fmt.Errorf("token %s: %w", job.Token, errTokenNotValid)
+	}
+	if err := authorize(token, &job.Trigger); err != nil {
+		return fmt.Errorf("token %s: %w", job.Token, err)
+	}
+	return nil
+}
+
+// process runs a queued job. Attempts failing with transport or server
+// errors of drone are retried with an increasing delay until the job is
+// dead, other failures are dead immediately. The token of the job is
+// checked again before every attempt. Jobs delayed by a debounce window do
+// not block the worker, they are finished once the window ended.
+func (web *Web) process(id string) {
+	job, err := web.Jobs.Start(id, time.Now())
+	if errors.Is(err, store.ErrJobNotPending) {
+		return
+	}
+	if err != nil {
+		slog.Error("unable to start job", "job", id, "error", err)
+		return
+	}
+
+	ctx := web.withSnapshot(withSourceIP(logging.WithRequestID(context.Background(), job.RequestID), job.SourceIP))
+	if err := web.jobToken(ctx, job, time.Now()); err != nil {
+		web.audit(ctx, &job.Trigger, job.Token, nil, store.AUDIT_DENIED, err)
+		result := core.TriggerResult{Repo: job.Trigger.Repo, Branch: job.Trigger.Branch, Target: job.Trigger.Target, Err: err.Error()}
+		web.finishJob(ctx, id, result, err)
+		return
+	}
+	web.executeLater(ctx, &job.Trigger, job.Token, func(build *core.Build, duplicate bool, err error) {
+		web.finishJob(ctx, id, triggerResult(&job.Trigger, build, duplicate, err), err)
+	})
+}
+
+// finishJob stores the result of an attempt of a job, failed jobs are
+// scheduled for a retry or dead
+func (web *Web) finishJob(ctx context.Context, id string, result core.TriggerResult, runErr error) {
+	jobs := web.snapshot(ctx).config.Jobs
+	job, err := web.Jobs.Update(id, func(job *store.Job) {
+		now := time.Now()
+		job.Attempts += 1
+		job.Build = result.Build
+		job.Err = result.Err
+		job.NextRun = nil
+		job.Updated = now
+		switch {
+		case result.Err == "":
+			job.State = store.JOB_DONE
+		case !core.Temporary(runErr) || job.Attempts >= jobs.MaxAttempts:
+			job.State = store.JOB_DEAD
+		default:
+			job.State = store.JOB_FAILED
+			next := now.Add(retryDelay(jobs, job.Attempts))
+			job.NextRun = &next
+		}
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to finish job", "job", id, "error", err)
+	}
+	if job == nil {
+		return
+	}
+	jobsTotal.Inc(job.State)
+	attrs := []any{"job", id, "state", job.State, "attempts", job.Attempts}
+	switch job.State {
+	case store.JOB_FAILED:
+		logTrigger(ctx, "job failed", &job.Trigger, job.Token, result, append(attrs, "retry_at", job.NextRun)...)
+		web.schedule(job)
+	case store.JOB_DEAD:
+		logTrigger(ctx, "job dead", &job.Trigger, job.Token, result, attrs...)
+	default:
+		logTrigger(ctx, "job", &job.Trigger, job.Token, result, attrs...)
+	}
+}
+
+// requeue resets a dead job and queues it again
+func (web *Web) requeue(id string) (*store.Job, error) {
+	job, err := web.Jobs.Requeue(id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	web.schedule(job)
+	return job, nil
+}
+
+// handleAsync validates and queues or schedules a trigger, the job is
+// answered with 202 and its location
+func (web *Web) handleAsync(w http.ResponseWriter, r *http.Request, p *Payload, token *core.Token) {
+	t := &p.Trigger
+	attrs := logging.TriggerAttrs(t, token.Name, 0)
+	if err := core.Validate(t); err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      "invalid request",
+			ResponseMsg: "invalid request",
+			LogAttrs:    attrs,
+		})
+		return
+	}
+	runAt, err := p.runAt(time.Now())
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("invalid schedule for %s: %s", t.Repo, err),
+			ResponseMsg: err.Error(),
+			LogAttrs:    attrs,
+		})
+		return
+	}
+	job, err := web.enqueue(r.Context(), t, token, runAt)
+	if errors.Is(err, store.ErrTooManyScheduled) {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusTooManyRequests,
+			LogMsg:      fmt.Sprintf("unable to schedule %s of %s@%s: %s", t.GetAction(), t.Repo, t.Branch, err),
+			ResponseMsg: err.Error(),
+			LogAttrs:    attrs,
+		})
+		return
+	}
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusServiceUnavailable,
+			LogMsg:      fmt.Sprintf("unable to queue %s of %s@%s: %s", t.GetAction(), t.Repo, t.Branch, err),
+			ResponseMsg: "unable to queue job",
+			LogAttrs:    attrs,
+			RetryAfter:  time.Second,
+		})
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	logMsg := fmt.Sprintf(
+		"%s queued job %s to %s %s@%s for target %s, token %s",
+		web.clientIP(r), job.ID, t.GetAction(), t.Repo, t.Branch, t.Target, token.Name,
+	)
+	if runAt != nil {
+		logMsg = fmt.Sprintf(
+			"%s scheduled job %s to %s %s@%s for target %s at %s, token %s",
+			web.clientIP(r), job.ID, t.GetAction(), t.Repo, t.Branch, t.Target, runAt.Format(time.RFC3339), token.Name,
+		)
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusAccepted,
+		LogMsg:      logMsg,
+		ResponseMsg: job.State,
+		Data:        job,
+		LogAttrs:    append(attrs, "job", job.ID),
+	})
+}
+
+// runAt returns the time a scheduled trigger runs, nil for triggers which
+// are not scheduled
+func (p *Payload) runAt(now time.Time) (*time.Time, error) {
+	switch {
+	case p.RunAt != nil && p.Delay != "":
+		return nil, fmt.Errorf("run_at and delay are mutually exclusive")
+	case p.RunAt != nil:
+		if p.RunAt.Before(now) {
+			return nil, fmt.Errorf("run_at is in the past")
+		}
+		return p.RunAt, nil
+	case p.Delay != "":
+		delay, err := time.ParseDuration(p.Delay)
+		if err != nil || delay <= 0 {
+			return nil, fmt.Errorf("invalid delay")
+		}
+		runAt := now.Add(delay)
+		return &runAt, nil
+	}
+	return nil, nil
+}
+
+// HandleJob returns the state of a job at /jobs/<id>, it requires a valid
+// token of the job's repository or the admin token
+func (web *Web) HandleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusMethodNotAllowed,
+			LogMsg:      fmt.Sprintf("method %s not allowed", r.Method),
+			ResponseMsg: "method not allowed",
+		})
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	job, ok := (*store.Job)(nil), false
+	if web.Jobs != nil {
+		job, ok = web.Jobs.Get(id)
+	}
+	if !ok {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      fmt.Sprintf("job %s not found", id),
+			ResponseMsg: store.ErrJobNotFound.Error(),
+		})
+		return
+	}
+	if !web.jobAuthorized(r, job) {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusForbidden,
+			LogMsg:      fmt.Sprintf("invalid bearer token for job %s", id),
+			ResponseMsg: "invalid bearer token",
+		})
+		return
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("job %s is %s", id, job.State),
+		ResponseMsg: "ok",
+		Data:        job,
+	})
+}
+
+// jobAuthorized checks if the bearer token is valid for the repository of
+// the job or the admin token
+func (web *Web) jobAuthorized(r *http.Request, job *store.Job) bool {
+	return web.isAdmin(r) || web.repoToken(r, job.Trigger.Repo) != nil
+}
+
+// isAdmin checks if the request uses the admin token
+func (web *Web) isAdmin(r *http.Request) bool {
+	bearer := bearerToken(r)
+	adminToken := web.snapshot(r.Context()).config.AdminToken
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(adminToken), []byte(bearer)) == 1
+}
+
+// repoToken returns the valid token or client certificate of the request
+// for repo
+func (web *Web) repoToken(r *http.Request, repo string) *core.Token {
+	if token := web.certToken(r, repo); token != nil {
+		return token
+	}
+	tokens, ok := lookupTokens(web.bearerTokens(r.Context()), repo)
+	if !ok {
+		return nil
+	}
+	token, err := findToken(tokens, bearerToken(r), time.Now())
+	if err != nil {
+		return nil
+	}
+	return token
+}
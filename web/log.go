@@ -0,0 +1,49 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+)
+
+// maxRequestIDLength limits request IDs taken from clients
+const maxRequestIDLength = 128
+
+// logTrigger logs the result of a trigger which is not answered by its own
+// request, failures are logged as warning
+func logTrigger(ctx context.Context, msg string, t *core.Trigger, token string, result core.TriggerResult, attrs ...any) {
+	attrs = append(logging.TriggerAttrs(t, token, result.Build), attrs...)
+	if result.Err != "" {
+		slog.WarnContext(ctx, msg, append(attrs, "error", result.Err)...)
+		return
+	}
+	slog.InfoContext(ctx, msg, append(attrs, "duplicate", result.Duplicate)...)
+}
+
+// requestID returns the valid request ID of the request or a new one
+func requestID(r *http.Request) string {
+	id := r.Header.Get(logging.REQUEST_ID_HEADER)
+	if id == "" || len(id) > maxRequestIDLength {
+		return logging.NewRequestID()
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return logging.NewRequestID()
+		}
+	}
+	return id
+}
+
+// statusLevel returns the log level of a response status
+func statusLevel(status int) slog.Level {
+	switch {
+	case status >= 500:
+		return slog.LevelError
+	case status >= 400:
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
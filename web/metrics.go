@@ -0,0 +1,31 @@
+package web
+
+import "github.com/bitsbeats/dronetrigger/metrics"
+
+var (
+	triggersTotal = metrics.NewCounterVec(
+		"dronetrigger_triggers_total",
+		"Triggers by repository, action and result (success, failure or duplicate).",
+		"repo", "action", "result",
+	)
+	requestDuration = metrics.NewHistogramVec(
+		"dronetrigger_http_request_duration_seconds",
+		"Duration of http requests by status code.",
+		nil, "status",
+	)
+	rateLimitedTotal = metrics.NewCounterVec(
+		"dronetrigger_rate_limited_total",
+		"Triggers rejected by rate limits by limit (repo, token or ip).",
+		"limit",
+	)
+	jobsTotal = metrics.NewCounterVec(
+		"dronetrigger_jobs_total",
+		"Attempts of asynchronous jobs by resulting state (done, failed or dead).",
+		"state",
+	)
+	buildOutcomesTotal = metrics.NewCounterVec(
+		"dronetrigger_build_outcomes_total",
+		"Final status of builds started by dronetrigger, reported by the drone webhook.",
+		"repo", "status",
+	)
+)
@@ -0,0 +1,63 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+)
+
+// runPromotions promotes a successful build according to the promotion rules
+func (web *Web) runPromotions(ctx context.Context, event *BuildEvent) {
+	if event.Status != "success" {
+		return
+	}
+	for _, rule := range web.snapshot(ctx).config.Promotions {
+		if !rule.Enabled || !promotionMatches(rule, event) {
+			continue
+		}
+		t := &core.Trigger{
+			Repo:    event.Repo,
+			Target:  rule.Target,
+			BuildID: event.Number,
+			Action:  core.ACTION_PROMOTE,
+			Params:  rule.Params,
+		}
+		if rule.DryRun {
+			slog.InfoContext(ctx, "promotion (dry run)", append(logging.TriggerAttrs(t, "promotion:"+rule.Name, 0), "dry_run", true)...)
+			continue
+		}
+		token := "promotion:" + rule.Name
+		result := web.run(ctx, t, token)
+		logTrigger(ctx, "promotion", t, token, result, "after_build", event.Number)
+	}
+}
+
+// promotionMatches checks if a promotion rule applies to a build. Rules
+// without event match push and tag builds.
+func promotionMatches(rule *core.PromotionRule, event *BuildEvent) bool {
+	if ok, _ := path.Match(rule.Repo, event.Repo); !ok {
+		return false
+	}
+	switch {
+	case rule.Event != "" && rule.Event != event.Event:
+		return false
+	case rule.Event == "" && event.Event != "push" && event.Event != "tag":
+		return false
+	}
+	if rule.Branch != "" {
+		if ok, _ := path.Match(rule.Branch, event.Branch); event.Event != "push" || !ok {
+			return false
+		}
+	}
+	if rule.Tag != "" {
+		tag := strings.TrimPrefix(event.Ref, "refs/tags/")
+		if ok, _ := path.Match(rule.Tag, tag); event.Event != "tag" || !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+)
+
+const (
+	LIMIT_REPO  = "repo"
+	LIMIT_TOKEN = "token"
+	LIMIT_IP    = "ip"
+
+	// maxBuckets triggers dropping full buckets, if none is full the least
+	// recently used bucket is dropped
+	maxBuckets = 10000
+)
+
+type (
+	// rateLimiter keeps a token bucket per limited key
+	rateLimiter struct {
+		mu      sync.Mutex
+		buckets map[string]*bucket
+		limited map[string]uint64
+	}
+
+	// limitCheck is a limit applied to the bucket of key, name is logged
+	limitCheck struct {
+		kind  string
+		key   string
+		name  string
+		limit *core.RateLimit
+	}
+
+	bucket struct {
+		limit   *core.RateLimit
+		tokens  float64
+		updated time.Time
+		used    time.Time
+	}
+)
+
+// refill adds the tokens accumulated since the last update
+func (b *bucket) refill(now time.Time) {
+	rate := float64(b.limit.Requests) / b.limit.Per.Seconds()
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+}
+
+// allow takes a token from the bucket of key, if none is left the time until
+// the next token is returned
+func (l *rateLimiter) allow(kind, key string, limit *core.RateLimit, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+		l.limited = map[string]uint64{}
+	}
+	if len(l.buckets) >= maxBuckets {
+		for k, b := range l.buckets {
+			b.refill(now)
+			if b.tokens >= float64(b.limit.Burst) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	if len(l.buckets) >= maxBuckets {
+		oldest := ""
+		for k, b := range l.buckets {
+			if oldest == "" || b.used.Before(l.buckets[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(l.buckets, oldest)
+	}
+
+	id := kind + ":" + key
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+		l.buckets[id] = b
+	}
+	// the limit changes when the config is reloaded
+	b.limit = limit
+	b.used = now
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return true, 0
+	}
+	l.limited[kind] += 1
+	rateLimitedTotal.Inc(kind)
+	rate := float64(limit.Requests) / limit.Per.Seconds()
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// counts returns the number of rejected triggers per limit
+func (l *rateLimiter) counts() map[string]uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limited := map[string]uint64{}
+	for kind, count := range l.limited {
+		limited[kind] = count
+	}
+	return limited
+}
+
+// rateLimit checks the limit of the source IP before authentication and the
+// limits of the repository and token afterwards. On failure the returned
+// Response describes the error.
+func (web *Web) rateLimit(r *http.Request, t *core.Trigger, token *core.Token) *Response {
+	limits := web.snapshot(r.Context()).config.RateLimits
+	if limits == nil {
+		return nil
+	}
+	checks := []limitCheck{}
+	if token == nil {
+		ip := web.clientIP(r)
+		checks = append(checks, limitCheck{LIMIT_IP, ip, ip, limits.IP})
+	} else {
+		checks = append(checks,
+			limitCheck{LIMIT_REPO, t.Repo, t.Repo, limits.Repo},
+			limitCheck{LIMIT_TOKEN, tokenIdentity(token), token.Name, limits.Token},
+		)
+	}
+	tokenName := ""
+	if token != nil {
+		tokenName = token.Name
+	}
+	now := time.Now()
+	for _, check := range checks {
+		if check.limit == nil {
+			continue
+		}
+		ok, retryAfter := web.limiter.allow(check.kind, check.key, check.limit, now)
+		if ok {
+			continue
+		}
+		return &Response{
+			StatusCode:  http.StatusTooManyRequests,
+			LogMsg:      fmt.Sprintf("rate limit of %s %s exceeded for %s, retry after %s", check.kind, check.name, t.Repo, retryAfter.Round(time.Millisecond)),
+			ResponseMsg: "rate limit exceeded",
+			RetryAfter:  retryAfter,
+			LogAttrs:    append(logging.TriggerAttrs(t, tokenName, 0), "limit", check.kind),
+		}
+	}
+	return nil
+}
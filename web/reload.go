@@ -0,0 +1,82 @@
+package web
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+type (
+	// state is the config swapped on reload together with its drone client
+	state struct {
+		config *core.WebConfig
+		drone  core.Drone
+	}
+
+	stateKey struct{}
+)
+
+// withSnapshot pins the current state to ctx unless it already has one, a
+// request sees the same config and drone client even if they are reloaded
+// while it is handled
+func (web *Web) withSnapshot(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(stateKey{}).(*state); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, stateKey{}, web.state.Load())
+}
+
+// snapshot returns the state pinned to ctx, the current one if there is none
+func (web *Web) snapshot(ctx context.Context) *state {
+	if s, ok := ctx.Value(stateKey{}).(*state); ok {
+		return s
+	}
+	return web.state.Load()
+}
+
+// Reload swaps in the validated config c and its drone client d. Settings
+// which are only used on startup keep their current value, the names of
+// those which changed are returned.
+func (web *Web) Reload(c *core.WebConfig, d core.Drone) (restart []string) {
+	current := web.config()
+	keep := func(name string, changed bool, restore func()) {
+		if changed {
+			restart = append(restart, name)
+			restore()
+		}
+	}
+	keep("listen", c.Listen != current.Listen, func() { c.Listen = current.Listen })
+	keep("metrics_listen", c.MetricsListen != current.MetricsListen, func() { c.MetricsListen = current.MetricsListen })
+	keep("server", c.Server != current.Server, func() { c.Server = current.Server })
+	keep("token_store", c.TokenStore != current.TokenStore, func() { c.TokenStore = current.TokenStore })
+	keep("audit_log", c.AuditLog != current.AuditLog, func() { c.AuditLog = current.AuditLog })
+	keep("jobs", !reflect.DeepEqual(c.Jobs, current.Jobs), func() { c.Jobs = current.Jobs })
+
+	// sections registering handlers or opening stores
+	keep("admin_token", (c.AdminToken == "") != (current.AdminToken == ""), func() { c.AdminToken = current.AdminToken })
+	keep("webhooks", (c.Webhooks == nil) != (current.Webhooks == nil), func() { c.Webhooks = current.Webhooks })
+	keep("drone_webhook", (c.DroneWebhook == nil) != (current.DroneWebhook == nil), func() { c.DroneWebhook = current.DroneWebhook })
+	if c.DroneWebhook != nil {
+		keep("drone_webhook.build_store", c.DroneWebhook.BuildStore != current.DroneWebhook.BuildStore, func() { c.DroneWebhook.BuildStore = current.DroneWebhook.BuildStore })
+	}
+	keep("chains", (c.Chains == nil) != (current.Chains == nil), func() { c.Chains = current.Chains })
+	if c.Chains != nil {
+		keep("chains.run_store", c.Chains.RunStore != current.Chains.RunStore, func() { c.Chains.RunStore = current.Chains.RunStore })
+	}
+
+	// client certificates are applied, the listener keeps its tls config
+	keep("tls", (c.TLS == nil) != (current.TLS == nil), func() { c.TLS = current.TLS })
+	if c.TLS != nil {
+		changed := c.TLS.Cert != current.TLS.Cert || c.TLS.Key != current.TLS.Key ||
+			c.TLS.MinVersion != current.TLS.MinVersion || c.TLS.ClientCA != current.TLS.ClientCA
+		keep("tls", changed, func() {
+			tls := *current.TLS
+			tls.ClientCerts = c.TLS.ClientCerts
+			c.TLS = &tls
+		})
+	}
+
+	web.state.Store(&state{config: c, drone: d})
+	return restart
+}
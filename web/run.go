@@ -0,0 +1,79 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+// run executes a trigger on behalf of token and converts the outcome to a
+// TriggerResult
+func (web *Web) run(ctx context.Context, t *core.Trigger, token string) core.TriggerResult {
+	build, duplicate, err := web.execute(ctx, t, token)
+	return triggerResult(t, build, duplicate, err)
+}
+
+// runLater runs a trigger like run without waiting for the debounce window
+// of its repository. done receives the result, for delayed triggers once the
+// window ended, they return a result marked as debounced right away.
+func (web *Web) runLater(ctx context.Context, t *core.Trigger, token string, done func(core.TriggerResult)) core.TriggerResult {
+	results := make(chan core.TriggerResult, 1)
+	delayed := web.executeLater(ctx, t, token, func(build *core.Build, duplicate bool, err error) {
+		result := triggerResult(t, build, duplicate, err)
+		done(result)
+		results <- result
+	})
+	if delayed {
+		return core.TriggerResult{Repo: t.Repo, Branch: t.Branch, Target: t.Target, Debounced: true}
+	}
+	return <-results
+}
+
+// triggerResult converts the outcome of a trigger to a TriggerResult
+func triggerResult(t *core.Trigger, build *core.Build, duplicate bool, err error) core.TriggerResult {
+	result := core.TriggerResult{Repo: t.Repo, Branch: t.Branch, Target: t.Target}
+	if err == nil && build == nil {
+		err = fmt.Errorf("no build returned")
+	}
+	if err != nil {
+		result.Err = fmt.Sprintf("unable to %s build: %s", verb(t), err)
+		return result
+	}
+	result.Build = build.Number
+	result.Duplicate = duplicate
+	return result
+}
+
+// runAll executes triggers on behalf of the token of the same index with at
+// most concurrency parallel drone calls, the results keep the order of the
+// triggers
+func (web *Web) runAll(ctx context.Context, triggers []*core.Trigger, tokens []string, concurrency int) []core.TriggerResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]core.TriggerResult, len(triggers))
+	semaphore := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for i, t := range triggers {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, t *core.Trigger) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			results[i] = web.run(ctx, t, tokens[i])
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+// repeat returns a list of n times token
+func repeat(token string, n int) []string {
+	tokens := make([]string, n)
+	for i := range tokens {
+		tokens[i] = token
+	}
+	return tokens
+}
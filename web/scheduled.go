@@ -0,0 +1,109 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/store"
+)
+
+// HandleScheduled lists the scheduled jobs of a repository (GET /scheduled
+// with the query parameter repo) and cancels scheduled jobs (DELETE
+// /scheduled/<id>). Cancelling requires a token allowed to run the trigger.
+func (web *Web) HandleScheduled(w http.ResponseWriter, r *http.Request) {
+	if web.Jobs == nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      "jobs are disabled",
+			ResponseMsg: "jobs are disabled",
+		})
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/scheduled"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		web.listScheduled(w, r)
+	case r.Method == http.MethodDelete && id != "":
+		web.cancelScheduled(w, r, id)
+	default:
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusMethodNotAllowed,
+			LogMsg:      fmt.Sprintf("method %s not allowed", r.Method),
+			ResponseMsg: "method not allowed",
+		})
+	}
+}
+
+func (web *Web) listScheduled(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get("repo")
+	if repo == "" {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      "no repo specified",
+			ResponseMsg: "no repo specified",
+		})
+		return
+	}
+	if !web.isAdmin(r) && web.repoToken(r, repo) == nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusForbidden,
+			LogMsg:      fmt.Sprintf("invalid bearer token for scheduled jobs of %s", repo),
+			ResponseMsg: "invalid bearer token",
+		})
+		return
+	}
+	jobs := []*store.Job{}
+	for _, job := range web.Jobs.Filter(store.JOB_SCHEDULED) {
+		if job.Trigger.Repo == repo {
+			jobs = append(jobs, job)
+		}
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("listed %d scheduled jobs of %s", len(jobs), repo),
+		ResponseMsg: "ok",
+		Data:        jobs,
+	})
+}
+
+func (web *Web) cancelScheduled(w http.ResponseWriter, r *http.Request, id string) {
+	job, ok := web.Jobs.Get(id)
+	if !ok {
+		writeStoreError(w, store.ErrJobNotFound, fmt.Sprintf("unable to cancel job %s", id))
+		return
+	}
+	name := "admin"
+	if !web.isAdmin(r) {
+		token := web.repoToken(r, job.Trigger.Repo)
+		if token == nil {
+			WriteResponse(w, Response{
+				StatusCode:  http.StatusForbidden,
+				LogMsg:      fmt.Sprintf("invalid bearer token to cancel job %s", id),
+				ResponseMsg: "invalid bearer token",
+			})
+			return
+		}
+		if err := authorize(token, &job.Trigger); err != nil {
+			WriteResponse(w, Response{
+				StatusCode:  http.StatusForbidden,
+				LogMsg:      fmt.Sprintf("token %s denied to cancel job %s: %s", token.Name, id, err),
+				ResponseMsg: err.Error(),
+			})
+			return
+		}
+		name = token.Name
+	}
+	job, err := web.Jobs.Cancel(id, time.Now())
+	if err != nil {
+		writeStoreError(w, err, fmt.Sprintf("unable to cancel job %s", id))
+		return
+	}
+	WriteResponse(w, Response{
+		StatusCode:  http.StatusOK,
+		LogMsg:      fmt.Sprintf("%s cancelled scheduled job %s of %s, token %s", web.clientIP(r), id, job.Trigger.Repo, name),
+		ResponseMsg: "ok",
+		Data:        job,
+	})
+}
@@ -0,0 +1,160 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+// tlsVersions are the supported values of min_version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader loads the certificate again when its files change
+type certReloader struct {
+	cert string
+	key  string
+
+	mu          sync.Mutex
+	modified    time.Time
+	certificate *tls.Certificate
+}
+
+// NewTLSConfig creates the tls config of the webserver. The certificate is
+// reloaded when its files change, client certificates are requested and
+// verified if a client CA is configured.
+func NewTLSConfig(c *core.TLSConfig) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid min_version %q", c.MinVersion)
+	}
+	reloader := &certReloader{cert: c.Cert, key: c.Key}
+	if _, err := reloader.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if c.ClientCA != "" {
+		data, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in client ca %s", c.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// GetCertificate returns the certificate, it is loaded again if one of its
+// files was modified. Failed reloads are logged and the previous
+// certificate is kept.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modified, err := c.modTime()
+	if err == nil && c.certificate != nil && modified.Equal(c.modified) {
+		return c.certificate, nil
+	}
+	if err == nil {
+		certificate, loadErr := tls.LoadX509KeyPair(c.cert, c.key)
+		if loadErr == nil {
+			if c.certificate != nil {
+				slog.Info("reloaded tls certificate", "cert", c.cert)
+			}
+			c.certificate = &certificate
+			c.modified = modified
+			return c.certificate, nil
+		}
+		err = loadErr
+	}
+	if c.certificate == nil {
+		return nil, fmt.Errorf("unable to load tls certificate: %w", err)
+	}
+	slog.Error("unable to reload tls certificate, keeping the previous one", "cert", c.cert, "error", err)
+	c.modified = modified
+	return c.certificate, nil
+}
+
+// modTime returns the latest modification of the certificate and key files
+func (c *certReloader) modTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, file := range []string{c.cert, c.key} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// clientCertToken returns the token of the configured client certificate
+// subject if it may trigger repo
+func (web *Web) clientCertToken(ctx context.Context, subject, repo string) *core.Token {
+	c := web.snapshot(ctx).config.TLS
+	if c == nil {
+		return nil
+	}
+	for _, cert := range c.ClientCerts {
+		if cert.Subject == subject && matchAny(cert.Repos, repo) {
+			return &core.Token{Name: "cert:" + cert.Subject}
+		}
+	}
+	return nil
+}
+
+// certSubject returns the configured subject of the verified client
+// certificate of the request, it is empty if the subject is not configured
+func (web *Web) certSubject(r *http.Request) string {
+	c := web.snapshot(r.Context()).config.TLS
+	if c == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	for _, cert := range c.ClientCerts {
+		if cert.Subject == subject.CommonName || cert.Subject == subject.String() {
+			return cert.Subject
+		}
+	}
+	return ""
+}
+
+// certToken returns a token for the verified client certificate of the
+// request if it may trigger repo. Requests with a bearer token are not
+// authenticated by their certificate.
+func (web *Web) certToken(r *http.Request, repo string) *core.Token {
+	c := web.snapshot(r.Context()).config.TLS
+	if c == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || bearerToken(r) != "" {
+		return nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	for _, cert := range c.ClientCerts {
+		if cert.Subject != subject.CommonName && cert.Subject != subject.String() {
+			continue
+		}
+		if matchAny(cert.Repos, repo) {
+			return &core.Token{Name: "cert:" + cert.Subject}
+		}
+	}
+	return nil
+}
@@ -1,45 +1,96 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+	"github.com/bitsbeats/dronetrigger/store"
 )
 
 type (
 	// Web is a WebAPI for dronetrigger
 	Web struct {
-		Config *core.WebConfig
-		Drone  core.Drone
+		Tokens *store.TokenStore
+		Builds *store.BuildStore
+		Chains *store.ChainStore
+		Jobs   *store.JobStore
+		Audit  *store.AuditLog
+
+		state       atomic.Pointer[state]
+		background  sync.WaitGroup
+		workers     sync.WaitGroup
+		queue       chan string
+		stop        chan struct{}
+		stopOnce    sync.Once
+		idempotency resultCache
+		duplicates  resultCache
+		debouncer   debouncer
+		limiter     rateLimiter
+		ready       readiness
 	}
 
-	// Payload is the payload send to drone
+	// Payload is the payload send to drone, either a single trigger or a
+	// batch of items. Async triggers are queued as job, triggers with RunAt
+	// or Delay are scheduled.
 	Payload struct {
-		Repo    string `json:"repo"`
-		Branch  string `json:"branch"`
-		Release bool   `json:"release"`
-		Target  string `json:"target"`
-		BuildID int64  `json:"build_id"`
+		core.Trigger
+		Items []*core.Trigger `json:"items"`
+		Async bool            `json:"async"`
+		RunAt *time.Time      `json:"run_at"`
+		Delay string          `json:"delay"`
 	}
 )
 
 // NewWeb creates a new Web
 func NewWeb(c *core.WebConfig, d core.Drone) *Web {
-	return &Web{
-		Config: c,
-		Drone:  d,
-	}
+	web := &Web{}
+	web.state.Store(&state{config: c, drone: d})
+	return web
+}
+
+// config returns the current config
+func (web *Web) config() *core.WebConfig {
+	return web.state.Load().config
 }
 
-// Handle handles an API request
+// Handle handles an API request, requests with an Idempotency-Key header
+// and a credential are only executed once. The body is limited to
+// max_body_bytes.
 func (web *Web) Handle(w http.ResponseWriter, r *http.Request) {
+	if limit := web.snapshot(r.Context()).config.Server.MaxBodyBytes; limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" && web.credential(r) != "" {
+		web.handleIdempotent(w, r, key)
+		return
+	}
+	web.handle(w, r)
+}
+
+// handle handles an API request
+func (web *Web) handle(w http.ResponseWriter, r *http.Request) {
 	// validate request
 	p := Payload{}
 	err := json.NewDecoder(r.Body).Decode(&p)
+	if tooLarge(err) {
+		WriteResponse(w, bodyTooLarge(err))
+		return
+	}
 	if err != nil {
 		WriteResponse(w, Response{
 			StatusCode:  http.StatusInternalServerError,
@@ -48,48 +99,49 @@ func (web *Web) Handle(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	if p.Repo == "" {
+	async := p.Async || p.RunAt != nil || p.Delay != ""
+	if async && (len(p.Items) > 0 || core.IsGlob(p.Branch)) {
 		WriteResponse(w, Response{
-			StatusCode:  http.StatusInternalServerError,
-			LogMsg:      "no repo specified",
-			ResponseMsg: "no repo specified",
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      "async batch or branch glob request",
+			ResponseMsg: "async mode only supports single triggers",
 		})
 		return
 	}
-	if _, ok := web.Config.BearerToken[p.Repo]; !ok {
-		WriteResponse(w, Response{
-			StatusCode:  http.StatusForbidden,
-			LogMsg:      "invalid repository",
-			ResponseMsg: "invalid repository",
-		})
+	if len(p.Items) > 0 {
+		web.handleBatch(w, r, &p)
 		return
 	}
-	if r.Header.Get("Authorization") != fmt.Sprintf("Bearer %s", web.Config.BearerToken[p.Repo]) {
-		WriteResponse(w, Response{
-			StatusCode:  http.StatusForbidden,
-			LogMsg:      "invalid bearer token",
-			ResponseMsg: "invalid bearer token",
-		})
+	if core.IsGlob(p.Branch) {
+		web.handleBranches(w, r, &p)
+		return
+	}
+	token, failure := web.authenticate(r, &p.Trigger)
+	if failure != nil {
+		WriteResponse(w, *failure)
+		return
+	}
+	if async {
+		if web.Jobs == nil {
+			WriteResponse(w, Response{
+				StatusCode:  http.StatusBadRequest,
+				LogMsg:      "async request without jobs configured",
+				ResponseMsg: "async mode is disabled",
+			})
+			return
+		}
+		web.handleAsync(w, r, &p, token)
 		return
 	}
 
 	// handle request
-	build := (*core.Build)(nil)
-	if p.Release && p.Target == "" {
-		build, err = web.Drone.RebuildLastTag(p.Repo)
-	} else if !p.Release && p.Target == "" {
-		build, err = web.Drone.RebuildLastBuild(p.Repo, p.Branch)
-	} else if p.BuildID != 0 && p.Target != "" {
-		build, err = web.Drone.Promote(p.Repo, p.Target, p.BuildID)
-	} else if p.Release && p.Target != "" {
-		build, err = web.Drone.PromoteLastTag(p.Repo, p.Target)
-	} else if !p.Release && p.Target != "" {
-		build, err = web.Drone.PromoteLastBuild(p.Repo, p.Branch, p.Target)
-	} else {
+	build, duplicate, err := web.execute(r.Context(), &p.Trigger, token.Name)
+	if errors.Is(err, core.ErrInvalidTrigger) {
 		WriteResponse(w, Response{
 			StatusCode:  http.StatusBadRequest,
 			LogMsg:      "invalid request",
 			ResponseMsg: "invalid request",
+			LogAttrs:    logging.TriggerAttrs(&p.Trigger, token.Name, 0),
 		})
 		return
 	}
@@ -98,48 +150,334 @@ func (web *Web) Handle(w http.ResponseWriter, r *http.Request) {
 	if err != nil || build == nil {
 		WriteResponse(w, Response{
 			StatusCode:  http.StatusInternalServerError,
-			LogMsg:      fmt.Sprintf("unable to start last build for %s@%s: %s", p.Repo, p.Branch, err),
-			ResponseMsg: "unable to restart build",
+			LogMsg:      fmt.Sprintf("unable to %s build for %s@%s: %s", verb(&p.Trigger), p.Repo, p.Branch, err),
+			ResponseMsg: fmt.Sprintf("unable to %s build", verb(&p.Trigger)),
+			LogAttrs:    logging.TriggerAttrs(&p.Trigger, token.Name, 0),
 		})
 		return
 	}
 
-	srcIp := r.Header.Get("X-Forwarded-For")
-	if srcIp == "" {
-		srcIp = r.RemoteAddr
+	if duplicate {
+		WriteResponse(w, Response{
+			StatusCode: http.StatusOK,
+			LogMsg: fmt.Sprintf(
+				"%s suppressed duplicate %s of %s@%s for target %s, build %d, token %s",
+				web.clientIP(r),
+				p.GetAction(),
+				p.Repo,
+				p.Branch,
+				p.Target,
+				build.Number,
+				token.Name,
+			),
+			ResponseMsg: "duplicate",
+			Data:        core.TriggerResult{Repo: p.Repo, Branch: p.Branch, Target: p.Target, Build: build.Number, Duplicate: true},
+			LogAttrs:    append(logging.TriggerAttrs(&p.Trigger, token.Name, build.Number), "duplicate", true),
+		})
+		return
 	}
 
 	WriteResponse(w, Response{
 		StatusCode: http.StatusCreated,
 		LogMsg: fmt.Sprintf(
-			"%s started build %d %s@%s for target %s, commit %s",
-			srcIp,
+			"%s %s build %d %s@%s for target %s, commit %s, token %s",
+			web.clientIP(r),
+			p.GetAction(),
 			build.Number,
 			p.Repo,
 			p.Branch,
 			p.Target,
 			build.After,
+			token.Name,
 		),
 		ResponseMsg: "ok",
+		LogAttrs:    append(logging.TriggerAttrs(&p.Trigger, token.Name, build.Number), "commit", build.After),
+	})
+}
+
+// authenticate finds the token of the request which is allowed to run the
+// trigger, on failure the returned Response describes the error. Denied
+// triggers of known tokens are audited, unauthenticated requests are only
+// logged.
+func (web *Web) authenticate(r *http.Request, t *core.Trigger) (*core.Token, *Response) {
+	return web.authenticateWith(r, t, authorize)
+}
+
+// authenticateWith implements authenticate, the token is authorized by check
+func (web *Web) authenticateWith(r *http.Request, t *core.Trigger, check func(*core.Token, *core.Trigger) error) (*core.Token, *Response) {
+	token, failure := web.authenticateToken(r, t, check)
+	if failure == nil {
+		return token, nil
+	}
+	if token != nil {
+		web.audit(r.Context(), t, token.Name, nil, store.AUDIT_DENIED, errors.New(failure.ResponseMsg))
+	}
+	return nil, failure
+}
+
+// authenticateToken implements authenticateWith, on failure the token is
+// returned if it is known
+func (web *Web) authenticateToken(r *http.Request, t *core.Trigger, check func(*core.Token, *core.Trigger) error) (*core.Token, *Response) {
+	if t.Repo == "" {
+		return nil, &Response{
+			StatusCode:  http.StatusInternalServerError,
+			LogMsg:      "no repo specified",
+			ResponseMsg: "no repo specified",
+		}
+	}
+	if failure := web.rateLimit(r, t, nil); failure != nil {
+		return nil, failure
+	}
+	now := time.Now()
+	token, err := web.certToken(r, t.Repo), error(nil)
+	if token == nil {
+		tokens, ok := lookupTokens(web.bearerTokens(r.Context()), t.Repo)
+		if !ok {
+			return nil, &Response{
+				StatusCode:  http.StatusForbidden,
+				LogMsg:      "invalid repository",
+				ResponseMsg: "invalid repository",
+				LogAttrs:    logging.TriggerAttrs(t, "", 0),
+			}
+		}
+		token, err = findToken(tokens, bearerToken(r), now)
+	}
+	if err != nil {
+		return token, &Response{
+			StatusCode:  http.StatusForbidden,
+			LogMsg:      fmt.Sprintf("warning: token %s for %s presented outside its validity: %s", token.Name, t.Repo, err),
+			ResponseMsg: "invalid bearer token",
+			LogAttrs:    logging.TriggerAttrs(t, token.Name, 0),
+		}
+	}
+	if token == nil {
+		return nil, &Response{
+			StatusCode:  http.StatusForbidden,
+			LogMsg:      "invalid bearer token",
+			ResponseMsg: "invalid bearer token",
+			LogAttrs:    logging.TriggerAttrs(t, "", 0),
+		}
+	}
+	err = check(token, t)
+	if err != nil {
+		return token, &Response{
+			StatusCode:  http.StatusForbidden,
+			LogMsg:      fmt.Sprintf("token %s denied for %s: %s", token.Name, t.Repo, err),
+			ResponseMsg: err.Error(),
+			LogAttrs:    logging.TriggerAttrs(t, token.Name, 0),
+		}
+	}
+
+	if failure := web.rateLimit(r, t, token); failure != nil {
+		return token, failure
+	}
+
+	if expiresSoon(token, now, web.snapshot(r.Context()).config.ExpiryWarning) {
+		slog.WarnContext(r.Context(), "token expires soon", append(logging.TriggerAttrs(t, token.Name, 0), "expires_at", token.ExpiresAt)...)
+	}
+	return token, nil
+}
+
+// tooLarge checks if reading a body failed because of its size limit
+func tooLarge(err error) bool {
+	maxBytes := &http.MaxBytesError{}
+	return errors.As(err, &maxBytes)
+}
+
+// bodyTooLarge describes a body exceeding its size limit
+func bodyTooLarge(err error) Response {
+	maxBytes := &http.MaxBytesError{}
+	errors.As(err, &maxBytes)
+	return Response{
+		StatusCode:  http.StatusRequestEntityTooLarge,
+		LogMsg:      fmt.Sprintf("request body exceeds %d bytes", maxBytes.Limit),
+		ResponseMsg: "request body too large",
+	}
+}
+
+// clientIP returns the address of the client without port. X-Forwarded-For
+// is only used if the request comes from a trusted proxy, the last address
+// not belonging to a trusted proxy is taken.
+func (web *Web) clientIP(r *http.Request) string {
+	trusted := web.snapshot(r.Context()).config.TrustedProxies
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrusted(host, trusted) {
+		return host
+	}
+	forwarded := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		host = strings.TrimSpace(forwarded[i])
+		if !isTrusted(host, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+// isTrusted checks if ip is one of the trusted addresses or networks
+func isTrusted(ip string, trusted []string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, t := range trusted {
+		if prefix, err := netip.ParsePrefix(t); err == nil && prefix.Contains(addr) {
+			return true
+		}
+		if other, err := netip.ParseAddr(t); err == nil && other.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// verb describes the action of a trigger for messages
+func verb(t *core.Trigger) string {
+	if t.GetAction() == core.ACTION_REBUILD {
+		return "restart"
+	}
+	return string(t.GetAction())
+}
+
+// Wait blocks until background work like build follow-ups is done
+func (web *Web) Wait() {
+	web.background.Wait()
+}
+
+// Shutdown stops the workers once the queued jobs are processed and waits
+// for background work. It returns the error of ctx if its deadline passes
+// first, unprocessed jobs stay pending in the job store.
+func (web *Web) Shutdown(ctx context.Context) error {
+	if web.stop != nil {
+		web.stopOnce.Do(func() { close(web.stop) })
+	}
+	done := make(chan struct{})
+	go func() {
+		web.workers.Wait()
+		web.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// execute runs the trigger on behalf of token against drone, audits it and
+// records the started build. Duplicates within the duplicate window return
+// the build of the first one. Triggers of contexts created by withDebounce
+// wait for the debounce window of their repository. Triggers are not
+// aborted when ctx is cancelled, i.e. by a disconnecting client.
+func (web *Web) execute(ctx context.Context, t *core.Trigger, token string) (build *core.Build, duplicate bool, err error) {
+	if ctx.Value(debounceKey{}) == nil {
+		build, duplicate, err = web.dispatch(ctx, t)
+		return web.record(ctx, t, token, build, duplicate, err)
+	}
+	done := make(chan struct{})
+	web.executeLater(ctx, t, token, func(b *core.Build, d bool, e error) {
+		build, duplicate, err = b, d, e
+		close(done)
+	})
+	<-done
+	return build, duplicate, err
+}
+
+// executeLater runs the trigger like execute without waiting for the
+// debounce window of its repository. Triggers of repositories with a window
+// are delayed and coalesced with identical ones, it returns true for them
+// and done receives their outcome once the window ended. Otherwise done is
+// called before executeLater returns.
+func (web *Web) executeLater(ctx context.Context, t *core.Trigger, token string, done func(*core.Build, bool, error)) (delayed bool) {
+	finish := func(build *core.Build, duplicate bool, err error) {
+		done(web.record(ctx, t, token, build, duplicate, err))
+	}
+	dispatch := func() (*core.Build, bool, error) {
+		return web.dispatch(ctx, t)
+	}
+	if web.debounce(ctx, t, dispatch, finish) {
+		return true
+	}
+	finish(dispatch())
+	return false
+}
+
+// dispatch starts the trigger in drone, identical triggers within the
+// duplicate window receive the build of the first one
+func (web *Web) dispatch(ctx context.Context, t *core.Trigger) (*core.Build, bool, error) {
+	return web.suppressDuplicate(ctx, t, func() (*core.Build, error) {
+		return core.Dispatch(context.WithoutCancel(ctx), web.snapshot(ctx).drone, t)
 	})
 }
 
-// Middleware provides logging
+// record audits the outcome of a trigger and records the started build
+func (web *Web) record(ctx context.Context, t *core.Trigger, token string, build *core.Build, duplicate bool, err error) (*core.Build, bool, error) {
+	outcome := store.AUDIT_SUCCESS
+	switch {
+	case err != nil || build == nil:
+		outcome = store.AUDIT_FAILURE
+	case duplicate:
+		outcome = store.AUDIT_DUPLICATE
+	}
+	triggersTotal.Inc(t.Repo, string(t.GetAction()), outcome)
+	web.audit(ctx, t, token, build, outcome, err)
+	if err != nil || build == nil || duplicate || web.Builds == nil || t.GetAction() == core.ACTION_CANCEL {
+		return build, duplicate, err
+	}
+	now := time.Now()
+	recordErr := web.Builds.Add(&store.BuildRecord{
+		Repo:    t.Repo,
+		Number:  build.Number,
+		Action:  t.GetAction(),
+		Branch:  t.Branch,
+		Target:  t.Target,
+		Status:  "pending",
+		Created: now,
+		Updated: now,
+	})
+	if recordErr != nil {
+		slog.ErrorContext(ctx, "unable to record build", append(logging.TriggerAttrs(t, "", build.Number), "error", recordErr)...)
+	}
+	return build, false, nil
+}
+
+// Middleware provides logging and request metrics, health checks are not
+// logged. Every request gets a request ID, taken from X-Request-ID if valid,
+// which is echoed in the response and forwarded to drone.
 func (web *Web) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		w = NewResponseWriterWithStatus(w)
-		next.ServeHTTP(w, r)
-		log.Printf(
-			"%s %d %s %s %s %s - %s",
-			time.Now().Format("2006-01-02 15:04:05"),
-			w.(*ResponseWriterWithStatus).StatusCode,
-			r.Method,
-			r.RequestURI,
-			r.RemoteAddr,
-			time.Since(start).String(),
-			w.(*ResponseWriterWithStatus).LogMessage,
-		)
+		id := requestID(r)
+		w.Header().Set(logging.REQUEST_ID_HEADER, id)
+		r = r.WithContext(web.withSnapshot(logging.WithRequestID(r.Context(), id)))
+		r = r.WithContext(withSourceIP(r.Context(), web.clientIP(r)))
+		ws := NewResponseWriterWithStatus(w)
+		next.ServeHTTP(ws, r)
+		requestDuration.Observe(time.Since(start).Seconds(), strconv.Itoa(ws.StatusCode))
+		if quiet(r.URL.Path) {
+			return
+		}
+		msg := ws.LogMessage
+		if msg == "" {
+			msg = "request"
+		}
+		attrs := append([]any{
+			"status", ws.StatusCode,
+			"method", r.Method,
+			"uri", r.RequestURI,
+			"remote_addr", r.RemoteAddr,
+			"source_ip", sourceIPFrom(r.Context()),
+			"duration", time.Since(start),
+		}, ws.LogAttrs...)
+		slog.Log(r.Context(), statusLevel(ws.StatusCode), msg, attrs...)
 	})
 }
 
@@ -148,6 +486,7 @@ type ResponseWriterWithStatus struct {
 	http.ResponseWriter
 	StatusCode int
 	LogMessage string
+	LogAttrs   []any
 }
 
 // NewResponseWriterWithStatus creates a new ResponseWriter
@@ -164,9 +503,10 @@ func (r *ResponseWriterWithStatus) WriteHeader(statusCode int) {
 	r.ResponseWriter.WriteHeader(statusCode)
 }
 
-// SetMessage sets the LogMessage
-func (r *ResponseWriterWithStatus) SetMessage(message string) {
+// SetMessage sets the LogMessage and its fields
+func (r *ResponseWriterWithStatus) SetMessage(message string, attrs ...any) {
 	r.LogMessage = message
+	r.LogAttrs = attrs
 }
 
 // Response is a helper to create uniform responses
@@ -174,11 +514,18 @@ type Response struct {
 	StatusCode  int
 	ResponseMsg string
 	LogMsg      string
+	Data        interface{}
+	RetryAfter  time.Duration
+	// LogAttrs are logged as fields with LogMsg
+	LogAttrs []any
 }
 
 // WriteResponse writes a response to http.ResponseWriter
 func WriteResponse(w http.ResponseWriter, r Response) {
-	w.(*ResponseWriterWithStatus).SetMessage(r.LogMsg)
+	w.(*ResponseWriterWithStatus).SetMessage(r.LogMsg, r.LogAttrs...)
+	if r.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(r.RetryAfter.Seconds()))))
+	}
 	w.WriteHeader(r.StatusCode)
 	responseMsg := r.ResponseMsg
 	errorMsg := ""
@@ -192,6 +539,7 @@ func WriteResponse(w http.ResponseWriter, r Response) {
 	jr := core.JsonResponse{
 		Status: responseMsg,
 		Err:    errorMsg,
+		Data:   r.Data,
 	}
 	_ = json.NewEncoder(w).Encode(jr)
 }
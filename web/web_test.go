@@ -2,14 +2,38 @@ package web
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bitsbeats/dronetrigger/core"
+	"github.com/bitsbeats/dronetrigger/logging"
+	"github.com/bitsbeats/dronetrigger/metrics"
 	"github.com/bitsbeats/dronetrigger/mock"
+	"github.com/bitsbeats/dronetrigger/store"
 	"go.uber.org/mock/gomock"
 	check "gopkg.in/check.v1"
 )
@@ -22,6 +46,29 @@ type TestSuite struct{}
 
 var _ = check.Suite(&TestSuite{})
 
+// newRequest creates a request with the header given as key and value pairs,
+// pairs with an empty value are skipped
+func newRequest(method, target, body string, header ...string) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		if header[i+1] != "" {
+			r.Header.Set(header[i], header[i+1])
+		}
+	}
+	return r
+}
+
+// serve passes a request to handler and returns the writer and the decoded
+// response
+func serve(handler http.HandlerFunc, r *http.Request) (*ResponseWriterWithStatus, *core.JsonResponse) {
+	recorder := httptest.NewRecorder()
+	w := NewResponseWriterWithStatus(recorder)
+	handler(w, r)
+	resp := &core.JsonResponse{}
+	_ = json.NewDecoder(recorder.Body).Decode(resp)
+	return w, resp
+}
+
 func (s *TestSuite) TestHandler(c *check.C) {
 	mockCtrl := gomock.NewController(c)
 	defer mockCtrl.Finish()
@@ -114,54 +161,1420 @@ func (s *TestSuite) TestHandler(c *check.C) {
 		d := mock.NewMockDrone(mockCtrl)
 		if test.call {
 			d.EXPECT().
-				RebuildLastBuild(test.repo, test.branch).
+				RebuildLastBuild(gomock.Any(), test.repo, test.branch, nil).
 				Return(test.build, test.droneErr)
 		}
 
 		web := NewWeb(&core.WebConfig{
-			BearerToken: map[string]string{"octocat/repo": "token"},
+			BearerToken: map[string]core.Tokens{"octocat/repo": {{Name: "default", Token: "token"}}},
 			Listen:      ":1337",
 		}, d)
 
-		body := bytes.NewBufferString(test.body)
-		r := httptest.NewRequest("POST", "/", body)
-		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", test.bearer))
-		w := NewResponseWriterWithStatus(httptest.NewRecorder())
-		web.Handle(w, r)
-
-		resp := &core.JsonResponse{}
-		_ = json.NewDecoder(w.ResponseWriter.(*httptest.ResponseRecorder).Body).Decode(resp)
+		_, resp := serve(web.Handle, newRequest("POST", "/", test.body, "Authorization", "Bearer "+test.bearer))
 		c.Assert(*resp, check.Equals, *test.resp)
 
 	}
 
 	// test tag
 	d := mock.NewMockDrone(mockCtrl)
-	d.EXPECT().RebuildLastTag("octocat/repo3").Return(&core.Build{Number: 1337}, nil)
+	d.EXPECT().RebuildLastTag(gomock.Any(), "octocat/repo3", nil).Return(&core.Build{Number: 1337}, nil)
 	web := NewWeb(&core.WebConfig{
-		BearerToken: map[string]string{"octocat/repo3": "0ct0cat!"},
+		BearerToken: map[string]core.Tokens{"octocat/repo3": {{Name: "default", Token: "0ct0cat!"}}},
 		Listen:      "1337",
 	}, d)
 
-	body := bytes.NewBufferString(`{"repo": "octocat/repo3", "release": true}`)
-	r := httptest.NewRequest("POST", "/", body)
-	r.Header.Set("Authorization", "Bearer 0ct0cat!")
-	w := NewResponseWriterWithStatus(httptest.NewRecorder())
-	web.Handle(w, r)
-
-	resp := &core.JsonResponse{}
-	_ = json.NewDecoder(w.ResponseWriter.(*httptest.ResponseRecorder).Body).Decode(resp)
+	_, resp := serve(web.Handle, newRequest("POST", "/", `{"repo": "octocat/repo3", "release": true}`, "Authorization", "Bearer 0ct0cat!"))
 	c.Assert(*resp, check.DeepEquals, core.JsonResponse{Status: "ok", Err: ""})
 
 }
 
+func (s *TestSuite) TestScopedTokens(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/repo": {
+			{
+				Name:     "ci",
+				Token:    "ci_token",
+				Actions:  []core.Action{core.ACTION_REBUILD, core.ACTION_PROMOTE},
+				Branches: []string{"main", "release/*"},
+				Targets:  []string{"staging"},
+				Params:   []string{"VERSION"},
+			},
+			{Name: "admin", Token: "admin_token"},
+			{Name: "develop", Token: "develop_token", Branches: []string{"develop"}},
+		}},
+		Listen: ":1337",
+	}, d)
+
+	tests := []struct {
+		bearer string
+		body   string
+		resp   core.JsonResponse
+	}{
+		{"ci_token", `{"repo": "octocat/repo", "branch": "release/1.0"}`, core.JsonResponse{Status: "ok"}},
+		{"ci_token", `{"repo": "octocat/repo", "branch": "main", "target": "staging", "params": {"VERSION": "1"}}`, core.JsonResponse{Status: "ok"}},
+		{"ci_token", `{"repo": "octocat/repo", "branch": "dev"}`, core.JsonResponse{Status: "error", Err: "branch dev not allowed"}},
+		{"ci_token", `{"repo": "octocat/repo", "release": true}`, core.JsonResponse{Status: "error", Err: "token requires an explicit branch"}},
+		{"ci_token", `{"repo": "octocat/repo", "branch": "main", "target": "production"}`, core.JsonResponse{Status: "error", Err: "target production not allowed"}},
+		{"ci_token", `{"repo": "octocat/repo", "branch": "main", "params": {"DEBUG": "1"}}`, core.JsonResponse{Status: "error", Err: "param DEBUG not allowed"}},
+		{"ci_token", `{"repo": "octocat/repo", "action": "cancel", "build_id": 5}`, core.JsonResponse{Status: "error", Err: "action cancel not allowed"}},
+		{"admin_token", `{"repo": "octocat/repo", "action": "cancel", "build_id": 5}`, core.JsonResponse{Status: "ok"}},
+		{"admin_token", `{"repo": "octocat/repo", "action": "rollback", "target": "production", "build_id": 5}`, core.JsonResponse{Status: "ok"}},
+		{"admin_token", `{"repo": "octocat/repo", "action": "rollback", "target": "production"}`, core.JsonResponse{Status: "error", Err: "invalid request"}},
+		// builds may belong to other branches than the claimed one
+		{"develop_token", `{"repo": "octocat/repo", "branch": "develop", "target": "production", "build_id": 42}`, core.JsonResponse{Status: "error", Err: "build_id not allowed for tokens restricted to branches"}},
+		{"develop_token", `{"repo": "octocat/repo", "branch": "develop", "action": "rollback", "target": "production", "build_id": 42}`, core.JsonResponse{Status: "error", Err: "build_id not allowed for tokens restricted to branches"}},
+		{"develop_token", `{"repo": "octocat/repo", "action": "cancel", "build_id": 43}`, core.JsonResponse{Status: "error", Err: "build_id not allowed for tokens restricted to branches"}},
+	}
+
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/repo", "release/1.0", nil).Return(&core.Build{Number: 1}, nil)
+	d.EXPECT().PromoteLastBuild(gomock.Any(), "octocat/repo", "main", "staging", map[string]string{"VERSION": "1"}).Return(&core.Build{Number: 2}, nil)
+	d.EXPECT().Cancel(gomock.Any(), "octocat/repo", int64(5)).Return(&core.Build{Number: 5}, nil)
+	d.EXPECT().Rollback(gomock.Any(), "octocat/repo", "production", int64(5), nil).Return(&core.Build{Number: 6}, nil)
+
+	for _, test := range tests {
+		_, resp := serve(web.Handle, newRequest("POST", "/", test.body, "Authorization", "Bearer "+test.bearer))
+		c.Assert(*resp, check.Equals, test.resp, check.Commentf("body: %s", test.body))
+	}
+}
+
+func (s *TestSuite) TestBatch(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/*":    {{Name: "org", Token: "token"}},
+			"octocat/prod": {{Name: "prod", Token: "token", Actions: []core.Action{core.ACTION_PROMOTE}}},
+		},
+		BatchConcurrency: 2,
+	}, d)
+
+	request := func(body string) (int, *core.JsonResponse) {
+		w, resp := serve(web.Handle, newRequest("POST", "/", body, "Authorization", "Bearer token"))
+		return w.StatusCode, resp
+	}
+
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/a", "main", nil).Return(&core.Build{Number: 1}, nil)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/b", "main", nil).Return(nil, fmt.Errorf("Fail"))
+	d.EXPECT().PromoteLastBuild(gomock.Any(), "octocat/prod", "main", "production", nil).Return(&core.Build{Number: 3}, nil)
+	status, resp := request(`{"items": [
+		{"repo": "octocat/a", "branch": "main"},
+		{"repo": "octocat/b", "branch": "main"},
+		{"repo": "octocat/prod", "branch": "main"},
+		{"repo": "octocat/prod", "branch": "main", "target": "production"},
+		{"repo": "other/repo", "branch": "main"}
+	]}`)
+	c.Assert(status, check.Equals, http.StatusMultiStatus)
+	c.Assert(resp.Status, check.Equals, "partial")
+	c.Assert(resp.Data, check.DeepEquals, []interface{}{
+		map[string]interface{}{"repo": "octocat/a", "branch": "main", "build": float64(1)},
+		map[string]interface{}{"repo": "octocat/b", "branch": "main", "error": "unable to restart build: Fail"},
+		map[string]interface{}{"repo": "octocat/prod", "branch": "main", "error": "action rebuild not allowed"},
+		map[string]interface{}{"repo": "octocat/prod", "branch": "main", "target": "production", "build": float64(3)},
+		map[string]interface{}{"repo": "other/repo", "branch": "main", "error": "invalid repository"},
+	})
+
+	// items rejected before reaching drone are client errors
+	status, resp = request(`{"items": [{"repo": "other/repo"}]}`)
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	c.Assert(resp.Err, check.Equals, "all items failed")
+	status, _ = request(`{"items": [{"repo": "other/repo"}, null, {"branch": "main"}]}`)
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/b", "main", nil).Return(nil, fmt.Errorf("Fail"))
+	status, _ = request(`{"items": [{"repo": "other/repo"}, {"repo": "octocat/b", "branch": "main"}]}`)
+	c.Assert(status, check.Equals, http.StatusInternalServerError)
+
+	status, _ = request(`{"repo": "octocat/a", "items": [{"repo": "octocat/b"}]}`)
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+
+	// null items fail individually
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/a", "main", nil).Return(&core.Build{Number: 4}, nil)
+	status, resp = request(`{"items": [null, {"repo": "octocat/a", "branch": "main"}]}`)
+	c.Assert(status, check.Equals, http.StatusMultiStatus)
+	c.Assert(resp.Data, check.DeepEquals, []interface{}{
+		map[string]interface{}{"repo": "", "error": "invalid trigger"},
+		map[string]interface{}{"repo": "octocat/a", "branch": "main", "build": float64(4)},
+	})
+
+	web.Reload(&core.WebConfig{BearerToken: web.config().BearerToken, BatchConcurrency: 2, BatchMaxItems: 2}, d)
+	status, resp = request(`{"items": [{"repo": "octocat/a"}, {"repo": "octocat/b"}, {"repo": "octocat/c"}]}`)
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+	c.Assert(resp.Err, check.Equals, "too many items, at most 2 are allowed")
+}
+
+func (s *TestSuite) TestBranches(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/test": {{Name: "release", Token: "token", Branches: []string{"release/1.*", "release/2.*"}}},
+		},
+		BatchConcurrency: 2,
+	}, d)
+
+	request := func(body string) (int, *core.JsonResponse) {
+		w, resp := serve(web.Handle, newRequest("POST", "/", body, "Authorization", "Bearer token"))
+		return w.StatusCode, resp
+	}
+
+	branches := []*core.Build{
+		{Source: "release/2.0", Event: "push"},
+		{Source: "main", Event: "push"},
+		{Source: "release/1.0", Event: "push"},
+		{Source: "release/3.0", Event: "push"},
+		{Source: "release/9.0", Event: "pull_request"},
+	}
+	d.EXPECT().Branches(gomock.Any(), "octocat/test").Return(branches, nil).Times(3)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "release/1.0", nil).Return(&core.Build{Number: 1}, nil)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "release/2.0", nil).Return(&core.Build{Number: 2}, nil)
+	status, resp := request(`{"repo": "octocat/test", "branch": "release/*"}`)
+	c.Assert(status, check.Equals, http.StatusMultiStatus)
+	c.Assert(resp.Data, check.DeepEquals, []interface{}{
+		map[string]interface{}{"repo": "octocat/test", "branch": "release/1.0", "build": float64(1)},
+		map[string]interface{}{"repo": "octocat/test", "branch": "release/2.0", "build": float64(2)},
+		map[string]interface{}{"repo": "octocat/test", "branch": "release/3.0", "error": "branch release/3.0 not allowed"},
+	})
+
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "release/1.0", nil).Return(&core.Build{Number: 3}, nil)
+	status, _ = request(`{"repo": "octocat/test", "branch": "release/1*"}`)
+	c.Assert(status, check.Equals, http.StatusCreated)
+
+	status, resp = request(`{"repo": "octocat/test", "branch": "feature/*"}`)
+	c.Assert(status, check.Equals, http.StatusNotFound)
+	c.Assert(resp.Err, check.Equals, "no matching branches")
+
+	status, _ = request(`{"repo": "octocat/test", "branch": "release/*", "target": "production"}`)
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+
+	status, _ = request(`{"items": [{"repo": "octocat/test", "branch": "release/*"}]}`)
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+
+	// globs are only allowed before the branches are resolved
+	token := &core.Token{Name: "release", Branches: []string{"release/1.*"}}
+	glob := &core.Trigger{Repo: "octocat/test", Branch: "release/*"}
+	c.Assert(authorize(token, glob), check.ErrorMatches, "branch release/\\* not allowed")
+	c.Assert(authorizeScope(token, glob), check.Equals, nil)
+}
+
+func (s *TestSuite) TestIdempotency(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/*": {
+				{Name: "a", Token: "token-a"},
+				{Name: "b", Token: "token-b"},
+				{Name: "c", Token: "token-c", Actions: []core.Action{core.ACTION_PROMOTE}},
+			},
+		},
+		IdempotencyTTL: time.Hour,
+	}, d)
+
+	request := func(token, key, body string) (int, *core.JsonResponse, http.Header) {
+		w, resp := serve(web.Handle, newRequest("POST", "/", body, "Authorization", "Bearer "+token, "Idempotency-Key", key))
+		return w.StatusCode, resp, w.Header()
+	}
+
+	// repeated keys replay the first response
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "main", nil).Return(&core.Build{Number: 1}, nil)
+	body := `{"repo": "octocat/test", "branch": "main"}`
+	status, _, header := request("token-a", "key-1", body)
+	c.Assert(status, check.Equals, http.StatusCreated)
+	c.Assert(header.Get("Idempotent-Replayed"), check.Equals, "")
+	status, _, header = request("token-a", "key-1", body)
+	c.Assert(status, check.Equals, http.StatusCreated)
+	c.Assert(header.Get("Idempotent-Replayed"), check.Equals, "true")
+
+	// keys are scoped per bearer token
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "main", nil).Return(&core.Build{Number: 2}, nil)
+	status, _, _ = request("token-b", "key-1", body)
+	c.Assert(status, check.Equals, http.StatusCreated)
+
+	// reusing a key with another request fails
+	status, resp, _ := request("token-a", "key-1", `{"repo": "octocat/test", "branch": "dev"}`)
+	c.Assert(status, check.Equals, http.StatusUnprocessableEntity)
+	c.Assert(resp.Err, check.Equals, "idempotency key reused with a different request")
+
+	// server errors are not kept
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "dev", nil).Return(nil, fmt.Errorf("Fail"))
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "dev", nil).Return(&core.Build{Number: 3}, nil)
+	status, _, _ = request("token-a", "key-2", `{"repo": "octocat/test", "branch": "dev"}`)
+	c.Assert(status, check.Equals, http.StatusInternalServerError)
+	status, _, _ = request("token-a", "key-2", `{"repo": "octocat/test", "branch": "dev"}`)
+	c.Assert(status, check.Equals, http.StatusCreated)
+
+	// unknown tokens are not cached and denied requests are not kept
+	entries := len(web.idempotency.entries)
+	for i := 0; i < 10; i++ {
+		status, _, _ = request(fmt.Sprintf("junk-%d", i), "key-1", body)
+		c.Assert(status, check.Equals, http.StatusForbidden)
+	}
+	status, _, _ = request("token-c", "key-1", body)
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	c.Assert(web.idempotency.entries, check.HasLen, entries)
+
+	// rate limited requests are not kept
+	web.Reload(&core.WebConfig{
+		BearerToken:    web.config().BearerToken,
+		IdempotencyTTL: time.Hour,
+		RateLimits:     &core.RateLimitsConfig{Repo: &core.RateLimit{Requests: 1, Per: 50 * time.Millisecond, Burst: 1}},
+	}, d)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/limited", "main", nil).Return(&core.Build{Number: 4}, nil).Times(2)
+	status, _, _ = request("token-a", "key-3", `{"repo": "octocat/limited", "branch": "main"}`)
+	c.Assert(status, check.Equals, http.StatusCreated)
+	status, _, header = request("token-a", "key-4", `{"repo": "octocat/limited", "branch": "main"}`)
+	c.Assert(status, check.Equals, http.StatusTooManyRequests)
+	c.Assert(header.Get("Retry-After"), check.Not(check.Equals), "")
+	time.Sleep(50 * time.Millisecond)
+	status, _, header = request("token-a", "key-4", `{"repo": "octocat/limited", "branch": "main"}`)
+	c.Assert(status, check.Equals, http.StatusCreated)
+	c.Assert(header.Get("Idempotent-Replayed"), check.Equals, "")
+}
+
+func (s *TestSuite) TestResultCache(c *check.C) {
+	cache := resultCache{}
+	now := time.Now()
+	for i := 0; i < maxCacheEntries+10; i++ {
+		key := strconv.Itoa(i)
+		entry, owner := cache.begin(key, "", now)
+		c.Assert(owner, check.Equals, true)
+		cache.finish(key, entry, i, time.Duration(i+1)*time.Minute, true)
+	}
+
+	// the entries expiring first are dropped
+	c.Assert(cache.entries, check.HasLen, maxCacheEntries)
+	_, owner := cache.begin("0", "", now)
+	c.Assert(owner, check.Equals, true)
+	entry, owner := cache.begin(strconv.Itoa(maxCacheEntries+9), "", now)
+	c.Assert(owner, check.Equals, false)
+	c.Assert(entry.value, check.Equals, maxCacheEntries+9)
+
+	// expired entries are dropped
+	_, _ = cache.begin("new", "", now.Add(time.Duration(maxCacheEntries+1)*time.Minute))
+	c.Assert(cache.entries, check.HasLen, 12)
+}
+
+func (s *TestSuite) TestDuplicateWindow(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/*": {{Name: "default", Token: "token"}},
+		},
+		BatchConcurrency: 2,
+		DuplicateWindow:  time.Hour,
+	}, d)
+
+	request := func(body string) (int, *core.JsonResponse) {
+		w, resp := serve(web.Handle, newRequest("POST", "/", body, "Authorization", "Bearer token"))
+		return w.StatusCode, resp
+	}
+
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "main", nil).Return(&core.Build{Number: 1}, nil)
+	d.EXPECT().PromoteLastBuild(gomock.Any(), "octocat/test", "main", "staging", nil).Return(&core.Build{Number: 2}, nil)
+	status, _ := request(`{"repo": "octocat/test", "branch": "main"}`)
+	c.Assert(status, check.Equals, http.StatusCreated)
+	status, resp := request(`{"repo": "octocat/test", "branch": "main", "action": "rebuild"}`)
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(resp.Status, check.Equals, "duplicate")
+	c.Assert(resp.Data, check.DeepEquals, map[string]interface{}{
+		"repo": "octocat/test", "branch": "main", "build": float64(1), "duplicate": true,
+	})
+
+	status, resp = request(`{"items": [
+		{"repo": "octocat/test", "branch": "main"},
+		{"repo": "octocat/test", "branch": "main", "target": "staging"}
+	]}`)
+	c.Assert(status, check.Equals, http.StatusCreated)
+	c.Assert(resp.Data, check.DeepEquals, []interface{}{
+		map[string]interface{}{"repo": "octocat/test", "branch": "main", "build": float64(1), "duplicate": true},
+		map[string]interface{}{"repo": "octocat/test", "branch": "main", "target": "staging", "build": float64(2)},
+	})
+
+	// failed triggers are not suppressed
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "dev", nil).Return(nil, fmt.Errorf("Fail"))
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/test", "dev", nil).Return(&core.Build{Number: 3}, nil)
+	status, _ = request(`{"repo": "octocat/test", "branch": "dev"}`)
+	c.Assert(status, check.Equals, http.StatusInternalServerError)
+	status, _ = request(`{"repo": "octocat/test", "branch": "dev"}`)
+	c.Assert(status, check.Equals, http.StatusCreated)
+}
+
+func (s *TestSuite) TestDebounce(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/*": {{Name: "default", Token: "token"}},
+		},
+		BatchConcurrency: 4,
+		Debounce: map[string]time.Duration{
+			"octocat/*":    50 * time.Millisecond,
+			"octocat/fast": 0,
+		},
+		Jobs: &core.JobsConfig{Workers: 1, QueueSize: 10, MaxAttempts: 1},
+	}, d)
+	web.Jobs, _ = store.NewJobStore("")
+	web.StartWorkers()
+
+	request := func(body string) (int, *core.JsonResponse) {
+		w, resp := serve(web.Handle, newRequest("POST", "/", body, "Authorization", "Bearer token"))
+		return w.StatusCode, resp
+	}
+
+	// background triggers are coalesced
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 1}, nil)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "dev", nil).Return(&core.Build{Number: 2}, nil)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/fast", "main", nil).Return(&core.Build{Number: 3}, nil)
+	start := time.Now()
+	results := web.runAll(withDebounce(context.Background()), []*core.Trigger{
+		{Repo: "octocat/app", Branch: "main"},
+		{Repo: "octocat/app", Branch: "main"},
+		{Repo: "octocat/app", Branch: "dev"},
+		{Repo: "octocat/fast", Branch: "main"},
+	}, repeat("chain:test", 4), 4)
+	c.Assert(time.Since(start) >= 50*time.Millisecond, check.Equals, true)
+	c.Assert(results, check.DeepEquals, []core.TriggerResult{
+		{Repo: "octocat/app", Branch: "main", Build: 1},
+		{Repo: "octocat/app", Branch: "main", Build: 1},
+		{Repo: "octocat/app", Branch: "dev", Build: 2},
+		{Repo: "octocat/fast", Branch: "main", Build: 3},
+	})
+
+	// synchronous requests are not delayed
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 4}, nil).Times(2)
+	start = time.Now()
+	status, resp := request(`{"items": [
+		{"repo": "octocat/app", "branch": "main"},
+		{"repo": "octocat/app", "branch": "main"}
+	]}`)
+	c.Assert(status, check.Equals, http.StatusCreated)
+	c.Assert(time.Since(start) < 50*time.Millisecond, check.Equals, true)
+	c.Assert(resp.Data, check.HasLen, 2)
+
+	// asynchronous jobs do not block the worker while they wait
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 5}, nil)
+	locations := []string{}
+	for i := 0; i < 10; i++ {
+		w, _ := serve(web.Handle, newRequest("POST", "/", `{"repo": "octocat/app", "branch": "main", "async": true}`, "Authorization", "Bearer token"))
+		c.Assert(w.StatusCode, check.Equals, http.StatusAccepted)
+		locations = append(locations, w.Header().Get("Location"))
+	}
+	for i := 0; i < 100 && len(web.Jobs.Filter(store.JOB_DONE)) < len(locations); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, location := range locations {
+		job, ok := web.Jobs.Get(path.Base(location))
+		c.Assert(ok, check.Equals, true)
+		c.Assert(job.State, check.Equals, store.JOB_DONE)
+		c.Assert(job.Build, check.Equals, int64(5))
+	}
+	c.Assert(web.Shutdown(context.Background()), check.Equals, nil)
+}
+
+func (s *TestSuite) TestRateLimits(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/*": {{Name: "a", Token: "token-a"}, {Name: "b", Token: "token-b"}},
+		},
+		RateLimits: &core.RateLimitsConfig{
+			Repo:  &core.RateLimit{Requests: 3, Per: time.Hour, Burst: 3},
+			Token: &core.RateLimit{Requests: 2, Per: time.Hour, Burst: 2},
+			IP:    &core.RateLimit{Requests: 5, Per: time.Hour, Burst: 5},
+		},
+	}, d)
+
+	request := func(token, ip, repo string) (int, *core.JsonResponse, http.Header) {
+		r := newRequest("POST", "/", fmt.Sprintf(`{"repo": "%s", "branch": "main"}`, repo), "Authorization", "Bearer "+token)
+		r.RemoteAddr = ip + ":1234"
+		w, resp := serve(web.Handle, r)
+		return w.StatusCode, resp, w.Header()
+	}
+
+	d.EXPECT().RebuildLastBuild(gomock.Any(), gomock.Any(), "main", nil).Return(&core.Build{Number: 1}, nil).Times(4)
+
+	// token limit
+	status, _, _ := request("token-a", "10.0.0.1", "octocat/a")
+	c.Assert(status, check.Equals, http.StatusCreated)
+	status, _, _ = request("token-a", "10.0.0.1", "octocat/a")
+	c.Assert(status, check.Equals, http.StatusCreated)
+	status, resp, header := request("token-a", "10.0.0.1", "octocat/b")
+	c.Assert(status, check.Equals, http.StatusTooManyRequests)
+	c.Assert(resp.Err, check.Equals, "rate limit exceeded")
+	c.Assert(header.Get("Retry-After"), check.Equals, "1800")
+
+	// repo limit
+	status, _, _ = request("token-b", "10.0.0.1", "octocat/a")
+	c.Assert(status, check.Equals, http.StatusCreated)
+	status, _, _ = request("token-b", "10.0.0.2", "octocat/a")
+	c.Assert(status, check.Equals, http.StatusTooManyRequests)
+
+	// ip limit, also applies to invalid tokens
+	status, _, _ = request("token-b", "10.0.0.1", "octocat/c")
+	c.Assert(status, check.Equals, http.StatusCreated)
+	status, _, _ = request("invalid", "10.0.0.1", "octocat/c")
+	c.Assert(status, check.Equals, http.StatusTooManyRequests)
+
+	c.Assert(web.limiter.counts(), check.DeepEquals, map[string]uint64{LIMIT_TOKEN: 1, LIMIT_REPO: 1, LIMIT_IP: 1})
+}
+
+func (s *TestSuite) TestClientIP(c *check.C) {
+	web := NewWeb(&core.WebConfig{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}}, nil)
+	for _, tc := range []struct {
+		remote    string
+		forwarded []string
+		ip        string
+	}{
+		{"198.51.100.1:1234", nil, "198.51.100.1"},
+		// spoofed header of an untrusted client
+		{"198.51.100.1:1234", []string{"203.0.113.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		// the first address is set by the client
+		{"10.0.0.1:1234", []string{"203.0.113.1, 198.51.100.2, 192.0.2.1"}, "198.51.100.2"},
+		{"192.0.2.1:1234", []string{"203.0.113.1", "198.51.100.2, 10.1.1.1"}, "198.51.100.2"},
+		{"10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2"},
+	} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = tc.remote
+		for _, f := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		c.Assert(web.clientIP(r), check.Equals, tc.ip, check.Commentf("%v", tc))
+	}
+}
+
+func (s *TestSuite) TestRateLimitBuckets(c *check.C) {
+	limiter := &rateLimiter{}
+	limit := &core.RateLimit{Requests: 1, Per: time.Hour, Burst: 1}
+	now := time.Now()
+	for i := 0; i < maxBuckets+10; i++ {
+		ok, _ := limiter.allow(LIMIT_IP, strconv.Itoa(i), limit, now.Add(time.Duration(i)))
+		c.Assert(ok, check.Equals, true)
+	}
+	c.Assert(limiter.buckets, check.HasLen, maxBuckets)
+	_, ok := limiter.buckets[LIMIT_IP+":0"]
+	c.Assert(ok, check.Equals, false)
+	_, ok = limiter.buckets[LIMIT_IP+":"+strconv.Itoa(maxBuckets+9)]
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *TestSuite) TestMetrics(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"metrics/repo": {{Name: "default", Token: "token"}}},
+	}, d)
+	handler := web.Middleware(http.HandlerFunc(web.Handle))
+	request := func(body string) int {
+		w, _ := serve(handler.ServeHTTP, newRequest("POST", "/", body, "Authorization", "Bearer token"))
+		return w.StatusCode
+	}
+
+	created := requestDuration.Count("201")
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "metrics/repo", "main", nil).Return(&core.Build{Number: 1}, nil)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "metrics/repo", "broken", nil).Return(nil, fmt.Errorf("no build found"))
+	c.Assert(request(`{"repo": "metrics/repo", "branch": "main"}`), check.Equals, http.StatusCreated)
+	c.Assert(request(`{"repo": "metrics/repo", "branch": "broken"}`), check.Equals, http.StatusInternalServerError)
+	c.Assert(triggersTotal.Get("metrics/repo", "rebuild", "success"), check.Equals, 1.0)
+	c.Assert(triggersTotal.Get("metrics/repo", "rebuild", "failure"), check.Equals, 1.0)
+	c.Assert(requestDuration.Count("201"), check.Equals, created+1)
+
+	w := httptest.NewRecorder()
+	metrics.Default.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(w.Body.String(), check.Matches, `(?s).*dronetrigger_triggers_total\{repo="metrics/repo",action="rebuild",result="success"\} 1\n.*`)
+}
+
+func (s *TestSuite) TestAudit(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/app": {{Name: "ci", Token: "ci-token", Actions: []core.Action{core.ACTION_REBUILD}}},
+		},
+		AdminToken: "admin-token",
+	}, d)
+	web.Tokens, _ = store.NewTokenStore("")
+	var err error
+	web.Audit, err = store.NewAuditLog(filepath.Join(c.MkDir(), "audit.jsonl"))
+	c.Assert(err, check.Equals, nil)
+	handler := web.Middleware(http.HandlerFunc(web.Handle))
+	// the forwarded address is spoofed, the client is no trusted proxy
+	trigger := func(token, body string) int {
+		w, _ := serve(handler.ServeHTTP, newRequest("POST", "/", body, "Authorization", "Bearer "+token, "X-Request-ID", "req-1", "X-Forwarded-For", "203.0.113.9"))
+		return w.StatusCode
+	}
+	query := func(params string) (int, []*store.AuditEntry) {
+		w, resp := serve(web.HandleAdminAudit, newRequest("GET", "/admin/audit?"+params, "", "Authorization", "Bearer admin-token"))
+		entries := []*store.AuditEntry{}
+		data, _ := json.Marshal(resp.Data)
+		_ = json.Unmarshal(data, &entries)
+		return w.StatusCode, entries
+	}
+
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 8, Parent: 7, After: "abc"}, nil)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "broken", nil).Return(nil, fmt.Errorf("no build found"))
+	c.Assert(trigger("ci-token", `{"repo": "octocat/app", "branch": "main"}`), check.Equals, http.StatusCreated)
+	c.Assert(trigger("ci-token", `{"repo": "octocat/app", "branch": "broken"}`), check.Equals, http.StatusInternalServerError)
+	c.Assert(trigger("ci-token", `{"repo": "octocat/app", "target": "production"}`), check.Equals, http.StatusForbidden)
+	c.Assert(trigger("invalid", `{"repo": "octocat/app", "branch": "main"}`), check.Equals, http.StatusForbidden)
+
+	status, entries := query("")
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(entries, check.HasLen, 3)
+	c.Assert(entries[0].Time.IsZero(), check.Equals, false)
+	entries[0].Time = time.Time{}
+	c.Assert(entries[0], check.DeepEquals, &store.AuditEntry{
+		RequestID: "req-1",
+		Token:     "ci",
+		SourceIP:  "192.0.2.1",
+		Action:    core.ACTION_REBUILD,
+		Trigger:   core.Trigger{Repo: "octocat/app", Branch: "main"},
+		Parent:    7,
+		Commit:    "abc",
+		Build:     8,
+		Outcome:   store.AUDIT_SUCCESS,
+	})
+	c.Assert(entries[1].Outcome, check.Equals, store.AUDIT_FAILURE)
+	c.Assert(entries[1].Err, check.Equals, "no build found")
+	c.Assert(entries[2].Outcome, check.Equals, store.AUDIT_DENIED)
+	c.Assert(entries[2].Token, check.Equals, "ci")
+	c.Assert(entries[2].Action, check.Equals, core.ACTION_PROMOTE)
+
+	_, entries = query("action=promote")
+	c.Assert(entries, check.HasLen, 1)
+	_, entries = query("repo=octocat/*&since=1h&limit=2")
+	c.Assert(entries, check.HasLen, 2)
+	c.Assert(entries[1].Outcome, check.Equals, store.AUDIT_DENIED)
+	_, entries = query("until=2000-01-01T00:00:00Z")
+	c.Assert(entries, check.HasLen, 0)
+	status, _ = query("since=yesterday")
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+
+	// the address forwarded by a trusted proxy is recorded
+	web.Reload(&core.WebConfig{
+		BearerToken:    web.config().BearerToken,
+		AdminToken:     "admin-token",
+		TrustedProxies: []string{"192.0.2.1"},
+	}, d)
+	c.Assert(trigger("ci-token", `{"repo": "octocat/app", "target": "production"}`), check.Equals, http.StatusForbidden)
+	_, entries = query("")
+	c.Assert(entries, check.HasLen, 4)
+	c.Assert(entries[3].SourceIP, check.Equals, "203.0.113.9")
+}
+
+func (s *TestSuite) TestJobs(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/*": {{Name: "default", Token: "token"}},
+			"other/*":   {{Name: "other", Token: "other-token"}},
+		},
+		Jobs:           &core.JobsConfig{Workers: 1, QueueSize: 1, MaxAttempts: 1},
+		IdempotencyTTL: time.Hour,
+	}, d)
+	web.Jobs, _ = store.NewJobStore("")
+	web.StartWorkers()
+
+	idempotencyKey := ""
+	request := func(method, path, token, body string) (int, *core.JsonResponse, http.Header) {
+		handler := web.Handle
+		if strings.HasPrefix(path, "/jobs/") {
+			handler = web.HandleJob
+		}
+		w, resp := serve(handler, newRequest(method, path, body, "Authorization", "Bearer "+token, "Idempotency-Key", idempotencyKey))
+		return w.StatusCode, resp, w.Header()
+	}
+	waitJob := func(location string) map[string]interface{} {
+		for i := 0; i < 100; i++ {
+			_, resp, _ := request("GET", location, "token", "")
+			job := resp.Data.(map[string]interface{})
+			if job["state"] == store.JOB_DONE || job["state"] == store.JOB_DEAD {
+				return job
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Fatalf("job %s did not finish", location)
+		return nil
+	}
+
+	d.EXPECT().PromoteLastBuild(gomock.Any(), "octocat/app", "main", "staging", nil).Return(&core.Build{Number: 7}, nil)
+	status, resp, header := request("POST", "/", "token", `{"repo": "octocat/app", "branch": "main", "target": "staging", "async": true}`)
+	c.Assert(status, check.Equals, http.StatusAccepted)
+	c.Assert(resp.Status, check.Equals, "queued")
+	location := header.Get("Location")
+	c.Assert(location, check.Matches, "/jobs/[0-9a-f]{16}")
+	job := waitJob(location)
+	c.Assert(job["state"], check.Equals, store.JOB_DONE)
+	c.Assert(job["build"], check.Equals, float64(7))
+
+	// replayed responses keep the location of the job
+	d.EXPECT().PromoteLastBuild(gomock.Any(), "octocat/app", "main", "staging", nil).Return(&core.Build{Number: 8}, nil)
+	idempotencyKey = "key-1"
+	_, _, header = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "main", "target": "staging", "async": true}`)
+	location = header.Get("Location")
+	status, _, header = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "main", "target": "staging", "async": true}`)
+	idempotencyKey = ""
+	c.Assert(status, check.Equals, http.StatusAccepted)
+	c.Assert(header.Get("Idempotent-Replayed"), check.Equals, "true")
+	c.Assert(header.Get("Location"), check.Equals, location)
+	waitJob(location)
+
+	// other tokens can not read the job
+	status, _, _ = request("GET", location, "other-token", "")
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	status, _, _ = request("GET", "/jobs/unknown", "token", "")
+	c.Assert(status, check.Equals, http.StatusNotFound)
+
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "broken", nil).Return(nil, fmt.Errorf("Fail"))
+	_, _, header = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "broken", "async": true}`)
+	job = waitJob(header.Get("Location"))
+	c.Assert(job["state"], check.Equals, store.JOB_DEAD)
+	c.Assert(job["error"], check.Equals, "unable to restart build: Fail")
+
+	// invalid triggers are rejected before queueing
+	status, _, _ = request("POST", "/", "token", `{"repo": "octocat/app", "action": "rollback", "async": true}`)
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+	status, _, _ = request("POST", "/", "token", `{"items": [{"repo": "octocat/app"}], "async": true}`)
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+
+	// a busy worker and a full queue reject further jobs
+	release := make(chan struct{})
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "slow", nil).DoAndReturn(func(ctx context.Context, repo, branch string, params map[string]string) (*core.Build, error) {
+		<-release
+		return &core.Build{Number: 8}, nil
+	}).Times(2)
+	status, _, _ = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "slow", "async": true}`)
+	c.Assert(status, check.Equals, http.StatusAccepted)
+	for i := 0; i < 100 && len(web.queue) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, _, _ = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "slow", "async": true}`)
+	c.Assert(status, check.Equals, http.StatusAccepted)
+	status, _, header = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "slow", "async": true}`)
+	c.Assert(status, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(header.Get("Retry-After"), check.Equals, "1")
+	close(release)
+	for _, job := range web.Jobs.List() {
+		if job.Trigger.Branch == "slow" {
+			waitJob("/jobs/" + job.ID)
+		}
+	}
+}
+
+func (s *TestSuite) TestJobRetries(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	// a job left over from a previous run
+	path := filepath.Join(c.MkDir(), "jobs.jsonl")
+	jobs, err := store.NewJobStore(path)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(jobs.Add(&store.Job{ID: "left", State: store.JOB_RUNNING, Trigger: core.Trigger{Repo: "octocat/app", Branch: "main"}, Token: "ci"}), check.Equals, nil)
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/*": {{Name: "ci", Token: "ci-token"}}},
+		AdminToken:  "admin-token",
+		Jobs:        &core.JobsConfig{Workers: 2, QueueSize: 10, MaxAttempts: 2, RetryDelay: 10 * time.Millisecond},
+	}, d)
+	web.Tokens, _ = store.NewTokenStore("")
+	web.Jobs, err = store.NewJobStore(path)
+	c.Assert(err, check.Equals, nil)
+
+	waitState := func(id, state string) *store.Job {
+		for i := 0; i < 100; i++ {
+			job, _ := web.Jobs.Get(id)
+			if job.State == state {
+				return job
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Fatalf("job %s did not reach state %s", id, state)
+		return nil
+	}
+	request := func(method, path, body string, handler http.HandlerFunc) (int, *core.JsonResponse) {
+		w, resp := serve(handler, newRequest(method, path, body, "Authorization", "Bearer admin-token"))
+		return w.StatusCode, resp
+	}
+
+	// the interrupted job is dead without running again
+	web.StartWorkers()
+	job := waitState("left", store.JOB_DEAD)
+	c.Assert(job.Attempts, check.Equals, 0)
+	c.Assert(job.Err, check.Equals, "interrupted while running")
+
+	status, resp := request("GET", "/admin/jobs?state=dead", "", web.HandleAdminJobs)
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(len(resp.Data.([]interface{})), check.Equals, 1)
+
+	// server errors are retried until the job is dead
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(nil, &core.APIError{StatusCode: 502, Message: "502 Bad Gateway"}).Times(2)
+	status, _ = request("POST", "/admin/jobs/requeue", `{"id": "left"}`, web.HandleAdminJobRequeue)
+	c.Assert(status, check.Equals, http.StatusOK)
+	job = waitState("left", store.JOB_DEAD)
+	c.Assert(job.Attempts, check.Equals, 2)
+	c.Assert(job.Err, check.Equals, "unable to restart build: 502 Bad Gateway")
+
+	// other errors are not retried
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(nil, &core.APIError{StatusCode: 404, Message: "404 Not Found"})
+	status, _ = request("POST", "/admin/jobs/requeue", `{"id": "left"}`, web.HandleAdminJobRequeue)
+	c.Assert(status, check.Equals, http.StatusOK)
+	job = waitState("left", store.JOB_DEAD)
+	c.Assert(job.Attempts, check.Equals, 1)
+
+	// requeued dead jobs start over
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 5}, nil)
+	status, _ = request("POST", "/admin/jobs/requeue", `{"id": "left"}`, web.HandleAdminJobRequeue)
+	c.Assert(status, check.Equals, http.StatusOK)
+	job = waitState("left", store.JOB_DONE)
+	c.Assert(job.Build, check.Equals, int64(5))
+	c.Assert(job.Attempts, check.Equals, 1)
+
+	status, _ = request("POST", "/admin/jobs/requeue", `{"id": "left"}`, web.HandleAdminJobRequeue)
+	c.Assert(status, check.Equals, http.StatusConflict)
+	status, _ = request("POST", "/admin/jobs/requeue", `{"id": "unknown"}`, web.HandleAdminJobRequeue)
+	c.Assert(status, check.Equals, http.StatusNotFound)
+
+	// the state is persisted
+	jobs, err = store.NewJobStore(path)
+	c.Assert(err, check.Equals, nil)
+	job, _ = jobs.Get("left")
+	c.Assert(job.State, check.Equals, store.JOB_DONE)
+}
+
+func (s *TestSuite) TestScheduled(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/app": {
+				{Name: "default", Token: "token"},
+				{Name: "staging", Token: "staging-token", Targets: []string{"staging"}},
+			},
+		},
+		Jobs: &core.JobsConfig{Workers: 1, QueueSize: 10, MaxAttempts: 1, MaxScheduled: 1},
+	}, d)
+	web.Jobs, _ = store.NewJobStore("")
+	web.StartWorkers()
+
+	request := func(method, path, token, body string) (int, *core.JsonResponse) {
+		handler := web.Handle
+		if strings.HasPrefix(path, "/scheduled") {
+			handler = web.HandleScheduled
+		}
+		w, resp := serve(handler, newRequest(method, path, body, "Authorization", "Bearer "+token))
+		return w.StatusCode, resp
+	}
+
+	// delayed triggers run after the delay
+	d.EXPECT().Promote(gomock.Any(), "octocat/app", "staging", int64(123), nil).Return(&core.Build{Number: 124}, nil)
+	status, resp := request("POST", "/", "token", `{"repo": "octocat/app", "build_id": 123, "target": "staging", "delay": "50ms"}`)
+	c.Assert(status, check.Equals, http.StatusAccepted)
+	c.Assert(resp.Status, check.Equals, store.JOB_SCHEDULED)
+	id := resp.Data.(map[string]interface{})["id"].(string)
+	job, _ := web.Jobs.Get(id)
+	c.Assert(job.State, check.Equals, store.JOB_SCHEDULED)
+	for i := 0; i < 100 && job.State != store.JOB_DONE; i++ {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = web.Jobs.Get(id)
+	}
+	c.Assert(job.State, check.Equals, store.JOB_DONE)
+	c.Assert(job.Build, check.Equals, int64(124))
+
+	// scheduled triggers are listed per repo and may be cancelled
+	runAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	status, resp = request("POST", "/", "token", fmt.Sprintf(`{"repo": "octocat/app", "build_id": 123, "target": "production", "run_at": "%s"}`, runAt))
+	c.Assert(status, check.Equals, http.StatusAccepted)
+	id = resp.Data.(map[string]interface{})["id"].(string)
+	status, resp = request("GET", "/scheduled?repo=octocat/app", "token", "")
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(len(resp.Data.([]interface{})), check.Equals, 1)
+	status, _ = request("GET", "/scheduled?repo=octocat/other", "token", "")
+	c.Assert(status, check.Equals, http.StatusForbidden)
+
+	status, resp = request("DELETE", "/scheduled/"+id, "staging-token", "")
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	c.Assert(resp.Err, check.Equals, "target production not allowed")
+	status, _ = request("DELETE", "/scheduled/"+id, "token", "")
+	c.Assert(status, check.Equals, http.StatusOK)
+	status, _ = request("DELETE", "/scheduled/"+id, "token", "")
+	c.Assert(status, check.Equals, http.StatusConflict)
+	status, resp = request("GET", "/scheduled?repo=octocat/app", "token", "")
+	c.Assert(len(resp.Data.([]interface{})), check.Equals, 0)
+
+	// invalid schedules
+	status, resp = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "main", "run_at": "2020-01-01T00:00:00Z"}`)
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+	c.Assert(resp.Err, check.Equals, "run_at is in the past")
+	status, resp = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "main", "delay": "soon"}`)
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+	c.Assert(resp.Err, check.Equals, "invalid delay")
+	status, _ = request("POST", "/", "token", fmt.Sprintf(`{"repo": "octocat/app", "branch": "main", "delay": "1h", "run_at": "%s"}`, runAt))
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+
+	// the token is checked again when the job runs
+	status, resp = request("POST", "/", "staging-token", `{"repo": "octocat/app", "build_id": 123, "target": "staging", "delay": "50ms"}`)
+	c.Assert(status, check.Equals, http.StatusAccepted)
+	id = resp.Data.(map[string]interface{})["id"].(string)
+	web.Reload(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/app": {{Name: "default", Token: "token"}}},
+		Jobs:        web.config().Jobs,
+	}, d)
+	job, _ = web.Jobs.Get(id)
+	for i := 0; i < 100 && job.State != store.JOB_DEAD; i++ {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = web.Jobs.Get(id)
+	}
+	c.Assert(job.State, check.Equals, store.JOB_DEAD)
+	c.Assert(job.Err, check.Equals, "token staging no longer exists")
+
+	// the number of scheduled jobs per repository is limited
+	status, _ = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "main", "delay": "1h"}`)
+	c.Assert(status, check.Equals, http.StatusAccepted)
+	status, resp = request("POST", "/", "token", `{"repo": "octocat/app", "branch": "main", "delay": "1h"}`)
+	c.Assert(status, check.Equals, http.StatusTooManyRequests)
+	c.Assert(resp.Err, check.Equals, "too many scheduled jobs")
+}
+
+func (s *TestSuite) TestLookupTokens(c *check.C) {
+	bearerTokens := map[string]core.Tokens{
+		"octocat/repo":      {{Name: "exact"}},
+		"octocat/*":         {{Name: "org"}},
+		"octocat/service-*": {{Name: "service"}},
+		"*/service-a":       {{Name: "any-org"}},
+	}
+
+	tests := []struct {
+		repo  string
+		name  string
+		found bool
+	}{
+		{"octocat/repo", "exact", true},
+		{"octocat/other", "org", true},
+		{"octocat/service-a", "service", true},
+		{"github/service-a", "any-org", true},
+		{"github/repo", "", false},
+		{"octocat/nested/repo", "", false},
+	}
+	for _, test := range tests {
+		tokens, found := lookupTokens(bearerTokens, test.repo)
+		c.Assert(found, check.Equals, test.found, check.Commentf("repo: %s", test.repo))
+		if found {
+			c.Assert(tokens[0].Name, check.Equals, test.name, check.Commentf("repo: %s", test.repo))
+		}
+	}
+}
+
+func (s *TestSuite) TestTokenRotation(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	past := time.Now().Add(-time.Hour)
+	soon := time.Now().Add(time.Hour)
+	future := time.Now().Add(24 * time.Hour)
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/repo": {
+			{Name: "expired", Token: "expired_token", ExpiresAt: &past},
+			{Name: "old", Token: "old_token", ExpiresAt: &soon},
+			{Name: "new", Token: "new_token", NotBefore: &past},
+			{Name: "next", Token: "next_token", NotBefore: &future},
+		}},
+		ExpiryWarning: 2 * time.Hour,
+	}, d)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/repo", "main", nil).Return(&core.Build{Number: 1}, nil).Times(2)
+
+	tests := []struct {
+		bearer  string
+		resp    core.JsonResponse
+		message string
+	}{
+		{"expired_token", core.JsonResponse{Status: "error", Err: "invalid bearer token"}, "warning: token expired for octocat/repo presented outside its validity: token expired or not yet valid"},
+		{"next_token", core.JsonResponse{Status: "error", Err: "invalid bearer token"}, "warning: token next for octocat/repo presented outside its validity: token expired or not yet valid"},
+		{"old_token", core.JsonResponse{Status: "ok"}, "192.0.2.1 rebuild build 1 octocat/repo@main for target , commit , token old"},
+		{"new_token", core.JsonResponse{Status: "ok"}, "192.0.2.1 rebuild build 1 octocat/repo@main for target , commit , token new"},
+	}
+	for _, test := range tests {
+		w, resp := serve(web.Handle, newRequest("POST", "/", `{"repo": "octocat/repo", "branch": "main"}`, "Authorization", "Bearer "+test.bearer))
+		c.Assert(*resp, check.Equals, test.resp, check.Commentf("bearer: %s", test.bearer))
+		c.Assert(w.LogMessage, check.Equals, test.message)
+	}
+}
+
+func (s *TestSuite) TestAdminTokens(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	tokens, _ := store.NewTokenStore("")
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/repo": {{Name: "default", Token: "token"}}},
+		AdminToken:  "adm1n_t0ken",
+	}, d)
+	web.Tokens = tokens
+
+	request := func(handler http.HandlerFunc, method, bearer, body string) (int, *core.JsonResponse) {
+		w, resp := serve(handler, newRequest(method, "/admin/tokens", body, "Authorization", "Bearer "+bearer))
+		return w.StatusCode, resp
+	}
+
+	status, resp := request(web.HandleAdminTokens, "GET", "token", "")
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	c.Assert(resp.Err, check.Equals, "invalid admin token")
+
+	status, _ = request(web.HandleAdminTokens, "POST", "adm1n_t0ken", `{"repo": "octocat/repo", "name": "default"}`)
+	c.Assert(status, check.Equals, http.StatusConflict)
+
+	status, _ = request(web.HandleAdminTokens, "POST", "adm1n_t0ken", `{"repo": "octocat/*", "name": "ci", "token": "c1_t0ken_value", "actions": ["rebuild"]}`)
+	c.Assert(status, check.Equals, http.StatusCreated)
+
+	status, resp = request(web.HandleAdminTokens, "GET", "adm1n_t0ken", "")
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(resp.Data, check.DeepEquals, []interface{}{
+		map[string]interface{}{"repo": "octocat/*", "source": "store", "name": "ci", "actions": []interface{}{"rebuild"}},
+		map[string]interface{}{"repo": "octocat/repo", "source": "config", "name": "default"},
+	})
+
+	// runtime token is usable
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/other", "", nil).Return(&core.Build{Number: 1}, nil)
+	w, _ := serve(web.Handle, newRequest("POST", "/", `{"repo": "octocat/other"}`, "Authorization", "Bearer c1_t0ken_value"))
+	c.Assert(w.StatusCode, check.Equals, http.StatusCreated)
+
+	status, resp = request(web.HandleAdminTokenRotate, "POST", "adm1n_t0ken", `{"repo": "octocat/*", "name": "ci"}`)
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(resp.Data.(map[string]interface{})["token"], check.Not(check.Equals), "c1_t0ken_value")
+
+	status, _ = request(web.HandleAdminTokens, "DELETE", "adm1n_t0ken", `{"repo": "octocat/*", "name": "ci"}`)
+	c.Assert(status, check.Equals, http.StatusOK)
+	status, _ = request(web.HandleAdminTokens, "DELETE", "adm1n_t0ken", `{"repo": "octocat/*", "name": "ci"}`)
+	c.Assert(status, check.Equals, http.StatusNotFound)
+}
+
+func (s *TestSuite) TestWebhook(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		Webhooks: &core.WebhooksConfig{
+			Secrets: map[string]string{"github": "gh_s3cret", "gitea": "gt_s3cret", "gitlab": "gl_s3cret"},
+			Rules: []*core.WebhookRule{
+				{
+					Name: "lib", Repo: "octocat/lib", Event: "push", Ref: "main",
+					Trigger: []*core.Trigger{
+						{Repo: "octocat/app", Branch: "main"},
+						{Repo: "octocat/other", Branch: "main"},
+					},
+				},
+				{
+					Name: "release", Provider: "gitlab", Repo: "octocat/*", Event: "release", Ref: "v*",
+					Trigger: []*core.Trigger{{Repo: "octocat/app", Branch: "main", Target: "production"}},
+				},
+			},
+		},
+	}, d)
+
+	sign := func(secret, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	request := func(provider string, header map[string]string, body string) (int, *core.JsonResponse) {
+		r := newRequest("POST", "/hooks/"+provider, body)
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		w, resp := serve(web.HandleWebhook, r)
+		return w.StatusCode, resp
+	}
+
+	// github push with one failing trigger
+	push := `{"ref": "refs/heads/main", "after": "a1e168b9", "repository": {"full_name": "octocat/lib"}}`
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 42}, nil)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/other", "main", nil).Return(nil, fmt.Errorf("Fail"))
+	status, resp := request("github", map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign("gh_s3cret", push),
+	}, push)
+	c.Assert(status, check.Equals, http.StatusInternalServerError)
+	c.Assert(resp.Err, check.Equals, "1 of 2 triggers failed")
+	c.Assert(resp.Data, check.DeepEquals, []interface{}{
+		map[string]interface{}{"repo": "octocat/app", "branch": "main", "build": float64(42)},
+		map[string]interface{}{"repo": "octocat/other", "branch": "main", "error": "unable to restart build: Fail"},
+	})
+
+	// invalid signatures
+	status, resp = request("github", map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign("wrong", push),
+	}, push)
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	c.Assert(resp.Err, check.Equals, "invalid signature")
+	status, _ = request("gitlab", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"}, push)
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	status, _ = request("bitbucket", map[string]string{}, push)
+	c.Assert(status, check.Equals, http.StatusNotFound)
+
+	// gitea push of an other branch matches no rule
+	other := `{"ref": "refs/heads/dev", "after": "a1e168b9", "repository": {"full_name": "octocat/lib"}}`
+	status, resp = request("gitea", map[string]string{
+		"X-Gitea-Event":     "push",
+		"X-Gitea-Signature": sign("gt_s3cret", other),
+	}, other)
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(resp.Data, check.DeepEquals, []interface{}{})
+
+	// gitlab release
+	release := `{"action": "create", "tag": "v1.2.0", "project": {"path_with_namespace": "octocat/lib"}}`
+	d.EXPECT().PromoteLastBuild(gomock.Any(), "octocat/app", "main", "production", nil).Return(&core.Build{Number: 43}, nil)
+	status, _ = request("gitlab", map[string]string{"X-Gitlab-Event": "Release Hook", "X-Gitlab-Token": "gl_s3cret"}, release)
+	c.Assert(status, check.Equals, http.StatusOK)
+
+	// ping is ignored
+	status, resp = request("github", map[string]string{
+		"X-GitHub-Event":      "ping",
+		"X-Hub-Signature-256": "sha256=" + sign("gh_s3cret", "{}"),
+	}, "{}")
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(resp.Status, check.Equals, "ignored")
+
+	// a burst of pushes is debounced into a single build, the response does
+	// not wait for the window
+	web.Reload(&core.WebConfig{
+		Webhooks: web.config().Webhooks,
+		Debounce: map[string]time.Duration{"octocat/app": 50 * time.Millisecond},
+	}, d)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 44}, nil)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/other", "main", nil).Return(&core.Build{Number: 7}, nil).Times(3)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		status, resp = request("github", map[string]string{
+			"X-GitHub-Event":      "push",
+			"X-Hub-Signature-256": "sha256=" + sign("gh_s3cret", push),
+		}, push)
+		c.Assert(status, check.Equals, http.StatusOK)
+		c.Assert(resp.Data, check.DeepEquals, []interface{}{
+			map[string]interface{}{"repo": "octocat/app", "branch": "main", "debounced": true},
+			map[string]interface{}{"repo": "octocat/other", "branch": "main", "build": float64(7)},
+		})
+	}
+	c.Assert(time.Since(start) < 50*time.Millisecond, check.Equals, true)
+	web.Wait()
+}
+
+func (s *TestSuite) TestDroneWebhook(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	notified := make(chan BuildEvent, 1)
+	notifyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := BuildEvent{}
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		notified <- event
+	}))
+	defer notifyServer.Close()
+
+	d := mock.NewMockDrone(mockCtrl)
+	builds, _ := store.NewBuildStore("")
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/base": {{Name: "default", Token: "token"}}},
+		DroneWebhook: &core.DroneWebhookConfig{
+			Secret: "dr0ne_s3cret",
+			Followups: []*core.Followup{{
+				Name:    "base",
+				Repo:    "octocat/base",
+				Branch:  "main",
+				Status:  []string{"success"},
+				Notify:  []string{notifyServer.URL},
+				Trigger: []*core.Trigger{{Repo: "octocat/app", Branch: "main"}},
+			}},
+		},
+	}, d)
+	web.Builds = builds
+
+	// trigger a build which gets tracked
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/base", "main", nil).Return(&core.Build{Number: 7}, nil)
+	w, _ := serve(web.Handle, newRequest("POST", "/", `{"repo": "octocat/base", "branch": "main"}`, "Authorization", "Bearer token"))
+	c.Assert(w.StatusCode, check.Equals, http.StatusCreated)
+
+	request := func(secret, body string) (int, *core.JsonResponse) {
+		r := newRequest("POST", "/hooks/drone", body)
+		signDroneRequest(r, secret, body)
+		w, resp := serve(web.HandleDroneWebhook, r)
+		return w.StatusCode, resp
+	}
+
+	status, resp := request("wrong", `{"event": "build"}`)
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	c.Assert(resp.Err, check.Equals, "invalid signature")
+
+	// signatures not covering the date could be replayed
+	replay := `{"event": "build", "action": "updated", "repo": {"slug": "octocat/base"}, "build": {"number": 7, "status": "success", "event": "push", "target": "main"}}`
+	r := newRequest("POST", "/hooks/drone", replay)
+	digest := sha256.Sum256([]byte(replay))
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	mac := hmac.New(sha256.New, []byte("dr0ne_s3cret"))
+	mac.Write([]byte("digest: " + r.Header.Get("Digest")))
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="hmac-key",algorithm="hmac-sha256",signature="%s",headers="digest"`, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+	w, resp = serve(web.HandleDroneWebhook, r)
+	c.Assert(w.StatusCode, check.Equals, http.StatusForbidden)
+	c.Assert(resp.Err, check.Equals, "invalid signature")
+
+	// running builds only update the status
+	status, _ = request("dr0ne_s3cret", `{"event": "build", "action": "updated", "repo": {"slug": "octocat/base"}, "build": {"number": 7, "status": "running", "event": "push", "target": "main"}}`)
+	c.Assert(status, check.Equals, http.StatusOK)
+	web.Wait()
+	record, _ := builds.Get("octocat/base", 7)
+	c.Assert(record.Status, check.Equals, "running")
+
+	// finished builds run the follow-ups
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 3}, nil)
+	status, _ = request("dr0ne_s3cret", `{"event": "build", "action": "updated", "repo": {"slug": "octocat/base"}, "build": {"number": 7, "status": "success", "event": "push", "target": "main", "ref": "refs/heads/main"}}`)
+	c.Assert(status, check.Equals, http.StatusOK)
+	web.Wait()
+	record, _ = builds.Get("octocat/base", 7)
+	c.Assert(record.Status, check.Equals, "success")
+	c.Assert(<-notified, check.DeepEquals, BuildEvent{
+		Repo: "octocat/base", Number: 7, Status: "success", Event: "push",
+		Branch: "main", Ref: "refs/heads/main", Tracked: true,
+	})
+	_, ok := builds.Get("octocat/app", 3)
+	c.Assert(ok, check.Equals, true)
+
+	// failed builds of other branches are ignored
+	status, _ = request("dr0ne_s3cret", `{"event": "build", "action": "updated", "repo": {"slug": "octocat/base"}, "build": {"number": 8, "status": "failure", "event": "push", "target": "dev"}}`)
+	c.Assert(status, check.Equals, http.StatusOK)
+	web.Wait()
+
+	// builds not started by dronetrigger do not run the follow-ups
+	status, _ = request("dr0ne_s3cret", `{"event": "build", "action": "updated", "repo": {"slug": "octocat/base"}, "build": {"number": 9, "status": "success", "event": "push", "target": "main"}}`)
+	c.Assert(status, check.Equals, http.StatusOK)
+	web.Wait()
+	select {
+	case event := <-notified:
+		c.Fatalf("untracked build notified: %+v", event)
+	default:
+	}
+}
+
+func (s *TestSuite) TestChains(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	chains, _ := store.NewChainStore("")
+	web := NewWeb(&core.WebConfig{
+		DroneWebhook: &core.DroneWebhookConfig{Secret: "dr0ne_s3cret"},
+		Chains: &core.ChainsConfig{
+			Concurrency: 2,
+			Rules: []*core.ChainRule{{
+				Name:   "base-image",
+				Repo:   "octocat/base-image",
+				Branch: "main",
+				Trigger: []*core.Trigger{
+					{Repo: "octocat/service-a", Branch: "main"},
+					{Repo: "octocat/service-b", Branch: "main"},
+					{Repo: "octocat/service-c", Branch: "main"},
+				},
+			}},
+		},
+	}, d)
+	web.Chains = chains
+
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/service-a", "main", nil).Return(&core.Build{Number: 1}, nil)
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/service-b", "main", nil).Return(nil, fmt.Errorf("Fail"))
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/service-c", "main", nil).Return(&core.Build{Number: 3}, nil)
+
+	for _, status := range []string{"failure", "success"} {
+		body := fmt.Sprintf(`{"event": "build", "action": "updated", "repo": {"slug": "octocat/base-image"}, "build": {"number": 7, "status": "%s", "event": "push", "target": "main"}}`, status)
+		r := newRequest("POST", "/hooks/drone", body)
+		signDroneRequest(r, "dr0ne_s3cret", body)
+		w, _ := serve(web.HandleDroneWebhook, r)
+		c.Assert(w.StatusCode, check.Equals, http.StatusOK)
+		web.Wait()
+	}
+
+	runs := chains.List()
+	c.Assert(len(runs), check.Equals, 1)
+	c.Assert(runs[0].Chain, check.Equals, "base-image")
+	c.Assert(runs[0].Build, check.Equals, int64(7))
+	c.Assert(runs[0].Failed, check.Equals, 1)
+	c.Assert(runs[0].Results, check.DeepEquals, []core.TriggerResult{
+		{Repo: "octocat/service-a", Branch: "main", Build: 1},
+		{Repo: "octocat/service-b", Branch: "main", Err: "unable to restart build: Fail"},
+		{Repo: "octocat/service-c", Branch: "main", Build: 3},
+	})
+
+	// finished promotions do not start the chain again
+	body := `{"event": "build", "action": "updated", "repo": {"slug": "octocat/base-image"}, "build": {"number": 8, "status": "success", "event": "promote", "target": "main"}}`
+	r := newRequest("POST", "/hooks/drone", body)
+	signDroneRequest(r, "dr0ne_s3cret", body)
+	w, _ := serve(web.HandleDroneWebhook, r)
+	c.Assert(w.StatusCode, check.Equals, http.StatusOK)
+	web.Wait()
+	c.Assert(chains.List(), check.HasLen, 1)
+}
+
+func (s *TestSuite) TestPromotions(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		DroneWebhook: &core.DroneWebhookConfig{Secret: "dr0ne_s3cret"},
+		Promotions: []*core.PromotionRule{
+			{Name: "staging", Enabled: true, Repo: "octocat/app", Event: "push", Branch: "main", Target: "staging"},
+			{Name: "canary", Enabled: true, Repo: "octocat/*", Tag: "v*", Target: "production-canary", Params: map[string]string{"CANARY": "true"}},
+			{Name: "dry", Enabled: true, DryRun: true, Repo: "octocat/app", Target: "production"},
+			{Name: "disabled", Enabled: false, Repo: "octocat/app", Target: "production"},
+		},
+	}, d)
+
+	d.EXPECT().Promote(gomock.Any(), "octocat/app", "staging", int64(7), nil).Return(&core.Build{Number: 8}, nil)
+	d.EXPECT().Promote(gomock.Any(), "octocat/app", "production-canary", int64(9), map[string]string{"CANARY": "true"}).Return(&core.Build{Number: 10}, nil)
+
+	builds := []string{
+		`{"number": 7, "status": "success", "event": "push", "target": "main", "ref": "refs/heads/main"}`,
+		`{"number": 8, "status": "success", "event": "promote", "target": "main", "deploy_to": "staging"}`,
+		`{"number": 9, "status": "success", "event": "tag", "ref": "refs/tags/v1.0.0"}`,
+		`{"number": 11, "status": "failure", "event": "push", "target": "main"}`,
+		`{"number": 12, "status": "success", "event": "push", "target": "dev"}`,
+	}
+	for _, build := range builds {
+		body := fmt.Sprintf(`{"event": "build", "action": "updated", "repo": {"slug": "octocat/app"}, "build": %s}`, build)
+		r := newRequest("POST", "/hooks/drone", body)
+		signDroneRequest(r, "dr0ne_s3cret", body)
+		w, _ := serve(web.HandleDroneWebhook, r)
+		c.Assert(w.StatusCode, check.Equals, http.StatusOK)
+		web.Wait()
+	}
+}
+
+// signDroneRequest signs a request like drone global webhooks
+func signDroneRequest(r *http.Request, secret, body string) {
+	digest := sha256.Sum256([]byte(body))
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("date: %s\ndigest: %s", r.Header.Get("Date"), r.Header.Get("Digest"))))
+	r.Header.Set("Signature", fmt.Sprintf(
+		`keyId="hmac-key",algorithm="hmac-sha256",signature="%s",headers="date digest"`,
+		base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	))
+}
+
+func (s *TestSuite) TestHealth(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/repo": {{Name: "default", Token: "token"}}},
+	}, d)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", web.HandleHealth)
+	mux.HandleFunc("/readyz", web.HandleReady)
+	handler := web.Middleware(mux)
+	request := func(path string) (int, *core.JsonResponse) {
+		w, resp := serve(handler.ServeHTTP, newRequest("GET", path, ""))
+		return w.StatusCode, resp
+	}
+
+	status, _ := request("/healthz")
+	c.Assert(status, check.Equals, http.StatusOK)
+
+	// the drone check is cached
+	d.EXPECT().User(gomock.Any()).Return(nil, fmt.Errorf("401 Unauthorized"))
+	status, resp := request("/readyz")
+	c.Assert(status, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Err, check.Equals, "unable to reach drone: 401 Unauthorized")
+	status, _ = request("/readyz")
+	c.Assert(status, check.Equals, http.StatusServiceUnavailable)
+
+	d.EXPECT().User(gomock.Any()).Return(&core.User{Login: "octocat"}, nil)
+	c.Assert(web.checkReady(context.Background(), time.Now().Add(readyInterval)), check.Equals, nil)
+	status, _ = request("/readyz")
+	c.Assert(status, check.Equals, http.StatusOK)
+}
+
+func (s *TestSuite) TestRequestID(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	out := &bytes.Buffer{}
+	logger, err := logging.New(&core.LogConfig{Format: logging.FORMAT_JSON}, out)
+	c.Assert(err, check.Equals, nil)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/repo": {{Name: "ci", Token: "token"}}},
+	}, d)
+	handler := web.Middleware(http.HandlerFunc(web.Handle))
+	request := func(id string) *ResponseWriterWithStatus {
+		w, _ := serve(handler.ServeHTTP, newRequest("POST", "/", `{"repo": "octocat/repo", "branch": "main"}`, "Authorization", "Bearer token", "X-Request-ID", id))
+		return w
+	}
+
+	// taken from the request and forwarded to drone
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/repo", "main", nil).DoAndReturn(func(ctx context.Context, repo, branch string, params map[string]string) (*core.Build, error) {
+		c.Check(logging.RequestID(ctx), check.Equals, "abc123")
+		return &core.Build{Number: 7}, nil
+	})
+	w := request("abc123")
+	c.Assert(w.StatusCode, check.Equals, http.StatusCreated)
+	c.Assert(w.Header().Get("X-Request-ID"), check.Equals, "abc123")
+
+	record := map[string]interface{}{}
+	c.Assert(json.Unmarshal(out.Bytes(), &record), check.Equals, nil)
+	c.Assert(record["level"], check.Equals, "INFO")
+	c.Assert(record["request_id"], check.Equals, "abc123")
+	c.Assert(record["repo"], check.Equals, "octocat/repo")
+	c.Assert(record["branch"], check.Equals, "main")
+	c.Assert(record["build"], check.Equals, 7.0)
+	c.Assert(record["token"], check.Equals, "ci")
+	c.Assert(record["source_ip"], check.Equals, "192.0.2.1")
+
+	// generated if missing or invalid
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/repo", "main", nil).Return(&core.Build{Number: 8}, nil).Times(2)
+	c.Assert(request("").Header().Get("X-Request-ID"), check.HasLen, 16)
+	c.Assert(request("abc 123").Header().Get("X-Request-ID"), check.HasLen, 16)
+}
+
 func (s *TestSuite) TestMiddleware(c *check.C) {
 	mockCtrl := gomock.NewController(c)
 	defer mockCtrl.Finish()
 
 	d := mock.NewMockDrone(mockCtrl)
 	web := NewWeb(&core.WebConfig{
-		BearerToken: map[string]string{"octocat/repo": "token"},
+		BearerToken: map[string]core.Tokens{"octocat/repo": {{Name: "default", Token: "token"}}},
 		Listen:      ":1337",
 	}, d)
 
@@ -181,3 +1594,266 @@ func (s *TestSuite) TestMiddleware(c *check.C) {
 	}
 
 }
+
+func (s *TestSuite) TestShutdown(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/*": {{Name: "default", Token: "token"}}},
+		Jobs:        &core.JobsConfig{Workers: 1, QueueSize: 2, MaxAttempts: 1},
+		Server:      core.ServerConfig{MaxBodyBytes: 128},
+	}, d)
+	web.Jobs, _ = store.NewJobStore("")
+	web.StartWorkers()
+
+	request := func(body string, header ...string) int {
+		w, _ := serve(web.Handle, newRequest("POST", "/", body, append([]string{"Authorization", "Bearer token"}, header...)...))
+		return w.StatusCode
+	}
+
+	// bodies are limited
+	large := fmt.Sprintf(`{"repo": "octocat/app", "branch": "%s"}`, strings.Repeat("a", 128))
+	c.Assert(request(large), check.Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(request(large, "Idempotency-Key", "large"), check.Equals, http.StatusRequestEntityTooLarge)
+
+	// queued jobs are processed before the workers stop
+	release := make(chan struct{})
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "slow", nil).DoAndReturn(func(ctx context.Context, repo, branch string, params map[string]string) (*core.Build, error) {
+		<-release
+		return &core.Build{Number: 1}, nil
+	})
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "queued", nil).Return(&core.Build{Number: 2}, nil)
+	c.Assert(request(`{"repo": "octocat/app", "branch": "slow", "async": true}`), check.Equals, http.StatusAccepted)
+	c.Assert(request(`{"repo": "octocat/app", "branch": "queued", "async": true}`), check.Equals, http.StatusAccepted)
+
+	// the deadline passes while a job is running
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c.Assert(web.Shutdown(ctx), check.Equals, context.DeadlineExceeded)
+
+	close(release)
+	c.Assert(web.Shutdown(context.Background()), check.Equals, nil)
+	for _, job := range web.Jobs.List() {
+		c.Assert(job.State, check.Equals, store.JOB_DONE)
+	}
+
+	// jobs scheduled after the shutdown stay pending
+	runAt := time.Now().Add(10 * time.Millisecond).Format(time.RFC3339Nano)
+	c.Assert(request(fmt.Sprintf(`{"repo": "octocat/app", "branch": "later", "run_at": "%s"}`, runAt)), check.Equals, http.StatusAccepted)
+	time.Sleep(30 * time.Millisecond)
+	c.Assert(web.Jobs.Pending(), check.HasLen, 1)
+}
+
+// newCert creates a certificate signed by parent, self-signed without parent
+func newCert(c *check.C, cn string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.Equals, nil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	c.Assert(err, check.Equals, nil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, check.Equals, nil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.Equals, nil)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func (s *TestSuite) TestTLS(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	dir := c.MkDir()
+	write := func(name string, data []byte, modified time.Time) string {
+		file := filepath.Join(dir, name)
+		c.Assert(os.WriteFile(file, data, 0o600), check.Equals, nil)
+		c.Assert(os.Chtimes(file, modified, modified), check.Equals, nil)
+		return file
+	}
+	ca, caKey, caPEM, _ := newCert(c, "ca", 1, nil, nil)
+	_, _, certPEM, keyPEM := newCert(c, "server", 2, ca, caKey)
+	_, _, clientPEM, clientKeyPEM := newCert(c, "deploy-bot", 3, ca, caKey)
+	_, _, otherPEM, otherKeyPEM := newCert(c, "other", 4, ca, caKey)
+	now := time.Now()
+	tlsConfig := &core.TLSConfig{
+		Cert:        write("tls.crt", certPEM, now),
+		Key:         write("tls.key", keyPEM, now),
+		MinVersion:  "1.3",
+		ClientCA:    write("ca.crt", caPEM, now),
+		ClientCerts: []*core.ClientCert{{Subject: "deploy-bot", Repos: []string{"octocat/*"}}},
+	}
+
+	_, err := NewTLSConfig(&core.TLSConfig{Cert: tlsConfig.Cert, Key: tlsConfig.Key, MinVersion: "1.4"})
+	c.Assert(err, check.ErrorMatches, `invalid min_version "1.4"`)
+	_, err = NewTLSConfig(&core.TLSConfig{Cert: tlsConfig.Cert, Key: tlsConfig.ClientCA, MinVersion: "1.2"})
+	c.Assert(err, check.ErrorMatches, "unable to load tls certificate: .*")
+
+	config, err := NewTLSConfig(tlsConfig)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(config.MinVersion, check.Equals, uint16(tls.VersionTLS13))
+	serial := func() int64 {
+		certificate, err := config.GetCertificate(nil)
+		c.Assert(err, check.Equals, nil)
+		return certificate.Leaf.SerialNumber.Int64()
+	}
+	c.Assert(serial(), check.Equals, int64(2))
+
+	// changed files are reloaded, broken ones are ignored
+	_, _, certPEM, keyPEM = newCert(c, "server", 5, ca, caKey)
+	write("tls.crt", certPEM, now.Add(time.Second))
+	write("tls.key", keyPEM, now.Add(time.Second))
+	c.Assert(serial(), check.Equals, int64(5))
+	write("tls.crt", []byte("broken"), now.Add(2*time.Second))
+	c.Assert(serial(), check.Equals, int64(5))
+
+	// restore for the handshakes
+	write("tls.crt", certPEM, now.Add(3*time.Second))
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"other/app": {{Name: "default", Token: "token"}}},
+		TLS:         tlsConfig,
+	}, d)
+	server := httptest.NewUnstartedServer(web.Middleware(http.HandlerFunc(web.Handle)))
+	server.Listener = tls.NewListener(server.Listener, config)
+	server.Start()
+	defer server.Close()
+	url := strings.Replace(server.URL, "http://", "https://", 1)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	request := func(clientPEM, clientKeyPEM []byte, body string, bearer string) int {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if clientPEM != nil {
+			cert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+			c.Assert(err, check.Equals, nil)
+			clientConfig.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		r, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		resp, err := client.Do(r)
+		c.Assert(err, check.Equals, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the client certificate authenticates its repositories
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 1}, nil)
+	c.Assert(request(clientPEM, clientKeyPEM, `{"repo": "octocat/app", "branch": "main"}`, ""), check.Equals, http.StatusCreated)
+	c.Assert(request(clientPEM, clientKeyPEM, `{"repo": "other/app", "branch": "main"}`, ""), check.Equals, http.StatusForbidden)
+	c.Assert(request(otherPEM, otherKeyPEM, `{"repo": "octocat/app", "branch": "main"}`, ""), check.Equals, http.StatusForbidden)
+	c.Assert(request(nil, nil, `{"repo": "octocat/app", "branch": "main"}`, ""), check.Equals, http.StatusForbidden)
+
+	// bearer tokens still work, with or without certificate
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "other/app", "main", nil).Return(&core.Build{Number: 2}, nil).Times(2)
+	c.Assert(request(nil, nil, `{"repo": "other/app", "branch": "main"}`, "token"), check.Equals, http.StatusCreated)
+	c.Assert(request(clientPEM, clientKeyPEM, `{"repo": "other/app", "branch": "main"}`, "token"), check.Equals, http.StatusCreated)
+}
+
+func (s *TestSuite) TestCertIdentity(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		TLS: &core.TLSConfig{ClientCerts: []*core.ClientCert{
+			{Subject: "bot-a", Repos: []string{"octocat/*"}},
+			{Subject: "bot-b", Repos: []string{"octocat/*"}},
+		}},
+		IdempotencyTTL: time.Hour,
+		RateLimits:     &core.RateLimitsConfig{Token: &core.RateLimit{Requests: 1, Per: time.Hour, Burst: 1}},
+	}, d)
+
+	request := func(subject, key string) (int, http.Header) {
+		r := newRequest("POST", "/", `{"repo": "octocat/app", "branch": "main"}`, "Idempotency-Key", key)
+		if subject != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: subject}}
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		w, _ := serve(web.Handle, r)
+		return w.StatusCode, w.Header()
+	}
+
+	// idempotency keys and token limits are kept per certificate
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/app", "main", nil).Return(&core.Build{Number: 1}, nil).Times(2)
+	status, _ := request("bot-a", "key")
+	c.Assert(status, check.Equals, http.StatusCreated)
+	status, header := request("bot-b", "key")
+	c.Assert(status, check.Equals, http.StatusCreated)
+	c.Assert(header.Get("Idempotent-Replayed"), check.Equals, "")
+	status, _ = request("bot-a", "")
+	c.Assert(status, check.Equals, http.StatusTooManyRequests)
+
+	// requests without a credential are not replayed
+	status, _ = request("", "key")
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	status, header = request("", "key")
+	c.Assert(status, check.Equals, http.StatusForbidden)
+	c.Assert(header.Get("Idempotent-Replayed"), check.Equals, "")
+}
+
+func (s *TestSuite) TestReload(c *check.C) {
+	mockCtrl := gomock.NewController(c)
+	defer mockCtrl.Finish()
+
+	d := mock.NewMockDrone(mockCtrl)
+	web := NewWeb(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{"octocat/old": {{Name: "default", Token: "token"}}},
+		Listen:      ":8080",
+		RateLimits:  &core.RateLimitsConfig{Repo: &core.RateLimit{Requests: 1, Per: time.Hour, Burst: 1}},
+	}, d)
+
+	request := func(repo string) int {
+		w, _ := serve(web.Handle, newRequest("POST", "/", fmt.Sprintf(`{"repo": "%s", "branch": "main"}`, repo), "Authorization", "Bearer token"))
+		return w.StatusCode
+	}
+	d.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/old", "main", nil).Return(&core.Build{Number: 1}, nil)
+	c.Assert(request("octocat/old"), check.Equals, http.StatusCreated)
+	c.Assert(request("octocat/old"), check.Equals, http.StatusTooManyRequests)
+	c.Assert(request("octocat/new"), check.Equals, http.StatusForbidden)
+
+	// tokens, limits and drone are swapped, the listener is kept
+	pinned := web.withSnapshot(context.Background())
+	reloaded := mock.NewMockDrone(mockCtrl)
+	restart := web.Reload(&core.WebConfig{
+		BearerToken: map[string]core.Tokens{
+			"octocat/old": {{Name: "default", Token: "token"}},
+			"octocat/new": {{Name: "default", Token: "token"}},
+		},
+		Listen:     ":9090",
+		RateLimits: &core.RateLimitsConfig{Repo: &core.RateLimit{Requests: 10, Per: time.Millisecond, Burst: 10}},
+		Webhooks:   &core.WebhooksConfig{},
+	}, reloaded)
+	c.Assert(restart, check.DeepEquals, []string{"listen", "webhooks"})
+	c.Assert(web.config().Listen, check.Equals, ":8080")
+	c.Assert(web.config().Webhooks, check.IsNil)
+
+	// a request keeps the state it started with
+	c.Assert(web.snapshot(pinned).drone, check.Equals, d)
+	c.Assert(web.snapshot(web.withSnapshot(pinned)).drone, check.Equals, d)
+	c.Assert(web.snapshot(context.Background()).drone, check.Equals, reloaded)
+
+	reloaded.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/new", "main", nil).Return(&core.Build{Number: 2}, nil)
+	reloaded.EXPECT().RebuildLastBuild(gomock.Any(), "octocat/old", "main", nil).Return(&core.Build{Number: 3}, nil)
+	c.Assert(request("octocat/new"), check.Equals, http.StatusCreated)
+	time.Sleep(time.Millisecond)
+	c.Assert(request("octocat/old"), check.Equals, http.StatusCreated)
+}
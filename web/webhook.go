@@ -0,0 +1,264 @@
+package web
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/bitsbeats/dronetrigger/core"
+)
+
+const (
+	PROVIDER_GITHUB = "github"
+	PROVIDER_GITEA  = "gitea"
+	PROVIDER_GITLAB = "gitlab"
+
+	EVENT_PUSH    = "push"
+	EVENT_TAG     = "tag"
+	EVENT_RELEASE = "release"
+
+	maxWebhookSize = 5 << 20
+)
+
+type (
+	// WebhookEvent is a parsed event of a git provider
+	WebhookEvent struct {
+		Provider string
+		Repo     string
+		Event    string
+		Ref      string
+	}
+
+	// hookPayload contains the relevant fields of all supported providers
+	hookPayload struct {
+		Ref     string `json:"ref"`
+		After   string `json:"after"`
+		Deleted bool   `json:"deleted"`
+		Action  string `json:"action"`
+		Tag     string `json:"tag"`
+		Release struct {
+			TagName string `json:"tag_name"`
+		} `json:"release"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		Project struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+		} `json:"project"`
+	}
+)
+
+var errInvalidSignature = errors.New("invalid signature")
+
+// HandleWebhook handles events of GitHub, Gitea and GitLab at /hooks/<provider>
+func (web *Web) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	provider := path.Base(r.URL.Path)
+	webhooks := web.snapshot(r.Context()).config.Webhooks
+	secret := ""
+	if webhooks != nil {
+		secret = webhooks.Secrets[provider]
+	}
+	if secret == "" {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusNotFound,
+			LogMsg:      fmt.Sprintf("no webhook configured for %q", provider),
+			ResponseMsg: "unknown provider",
+		})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("unable to read %s webhook: %s", provider, err),
+			ResponseMsg: "unable to read request body",
+		})
+		return
+	}
+	err = verifyWebhook(provider, secret, r.Header, body)
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusForbidden,
+			LogMsg:      fmt.Sprintf("%s webhook: %s", provider, err),
+			ResponseMsg: err.Error(),
+		})
+		return
+	}
+	event, err := parseWebhook(provider, r.Header, body)
+	if err != nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusBadRequest,
+			LogMsg:      fmt.Sprintf("unable to parse %s webhook: %s", provider, err),
+			ResponseMsg: "unable to parse request body",
+		})
+		return
+	}
+	if event == nil {
+		WriteResponse(w, Response{
+			StatusCode:  http.StatusOK,
+			LogMsg:      fmt.Sprintf("ignored %s webhook", provider),
+			ResponseMsg: "ignored",
+		})
+		return
+	}
+
+	// debounced triggers finish after the response
+	ctx := context.WithoutCancel(r.Context())
+	sourceIP := web.clientIP(r)
+	results := []core.TriggerResult{}
+	failed := 0
+	for _, rule := range webhooks.Rules {
+		if !ruleMatches(rule, event) {
+			continue
+		}
+		for _, t := range rule.Trigger {
+			t, token := t, "webhook:"+rule.Name
+			result := web.runLater(ctx, t, token, func(result core.TriggerResult) {
+				logTrigger(ctx, "webhook", t, token, result, "source_ip", sourceIP)
+			})
+			if result.Err != "" {
+				failed += 1
+			}
+			results = append(results, result)
+		}
+	}
+
+	statusCode := http.StatusOK
+	responseMsg := "ok"
+	if failed > 0 {
+		statusCode = http.StatusInternalServerError
+		responseMsg = fmt.Sprintf("%d of %d triggers failed", failed, len(results))
+	}
+	WriteResponse(w, Response{
+		StatusCode: statusCode,
+		LogMsg: fmt.Sprintf(
+			"%s %s %s@%s: %d triggers, %d failed",
+			provider, event.Event, event.Repo, event.Ref, len(results), failed,
+		),
+		ResponseMsg: responseMsg,
+		Data:        results,
+	})
+}
+
+// ruleMatches checks if a webhook rule applies to an event
+func ruleMatches(rule *core.WebhookRule, event *WebhookEvent) bool {
+	if rule.Provider != "" && rule.Provider != event.Provider {
+		return false
+	}
+	if rule.Event != "" && rule.Event != event.Event {
+		return false
+	}
+	if ok, _ := path.Match(rule.Repo, event.Repo); !ok {
+		return false
+	}
+	if ok, _ := path.Match(rule.Ref, event.Ref); rule.Ref != "" && !ok {
+		return false
+	}
+	return true
+}
+
+// verifyWebhook validates the signature or token of a webhook
+func verifyWebhook(provider, secret string, header http.Header, body []byte) error {
+	switch provider {
+	case PROVIDER_GITHUB:
+		signature := header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") {
+			return errInvalidSignature
+		}
+		return verifyHMAC(secret, strings.TrimPrefix(signature, "sha256="), body)
+	case PROVIDER_GITEA:
+		return verifyHMAC(secret, header.Get("X-Gitea-Signature"), body)
+	case PROVIDER_GITLAB:
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(header.Get("X-Gitlab-Token"))) != 1 {
+			return errInvalidSignature
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported provider %q", provider)
+}
+
+func verifyHMAC(secret, signature string, body []byte) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return errInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// parseWebhook converts a webhook to a WebhookEvent, irrelevant events return nil
+func parseWebhook(provider string, header http.Header, body []byte) (*WebhookEvent, error) {
+	kind := ""
+	switch provider {
+	case PROVIDER_GITHUB:
+		kind = header.Get("X-GitHub-Event")
+	case PROVIDER_GITEA:
+		kind = header.Get("X-Gitea-Event")
+	case PROVIDER_GITLAB:
+		kind = map[string]string{
+			"Push Hook":     "push",
+			"Tag Push Hook": "push",
+			"Release Hook":  "release",
+		}[header.Get("X-Gitlab-Event")]
+	}
+	if kind != "push" && kind != "release" {
+		return nil, nil
+	}
+
+	payload := hookPayload{}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, err
+	}
+	event := &WebhookEvent{
+		Provider: provider,
+		Repo:     payload.Repository.FullName,
+	}
+	if provider == PROVIDER_GITLAB {
+		event.Repo = payload.Project.PathWithNamespace
+	}
+
+	switch kind {
+	case "push":
+		if payload.Deleted || strings.Trim(payload.After, "0") == "" && payload.After != "" {
+			return nil, nil
+		}
+		switch {
+		case strings.HasPrefix(payload.Ref, "refs/heads/"):
+			event.Event = EVENT_PUSH
+			event.Ref = strings.TrimPrefix(payload.Ref, "refs/heads/")
+		case strings.HasPrefix(payload.Ref, "refs/tags/"):
+			event.Event = EVENT_TAG
+			event.Ref = strings.TrimPrefix(payload.Ref, "refs/tags/")
+		default:
+			return nil, nil
+		}
+	case "release":
+		if payload.Action != "published" && payload.Action != "create" {
+			return nil, nil
+		}
+		event.Event = EVENT_RELEASE
+		event.Ref = payload.Release.TagName
+		if provider == PROVIDER_GITLAB {
+			event.Ref = payload.Tag
+		}
+	}
+	if event.Repo == "" {
+		return nil, fmt.Errorf("no repository in payload")
+	}
+	return event, nil
+}